@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// runBench implements "epub2cbz bench <dir>": it converts every EPUB of a
+// corpus to a discarding sink and reports the throughput of each stage, so
+// pipeline changes can be compared on the same books
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var opts epub2cbz.Options
+	fs.BoolVar(&opts.Recursive, "r", true, "process subdirectories recursively")
+	fs.IntVar(&opts.PageJobs, "page-jobs", 0, "number of pages processed in parallel inside one conversion (default: number of CPU cores)")
+	fs.StringVar(&opts.Compression, "compression", epub2cbz.CompressionAuto, "image entry compression: auto, store, deflate or keep")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bench [options] <source_dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nConverts every EPUB of a directory without writing any output and reports throughput.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	opts.SpillThreshold = epub2cbz.DefaultSpillThreshold
+	conv, err := epub2cbz.NewConverter(opts)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	epubFiles, err := epub2cbz.FindEPUBFiles(fs.Arg(0), opts.Recursive)
+	if err != nil {
+		log.Print("Error reading directory:", err)
+		return 1
+	}
+	if len(epubFiles) == 0 {
+		log.Print("No .epub files found in directory:", fs.Arg(0))
+		return 1
+	}
+
+	// Conversion messages would distort the measures, only failures are reported
+	failures := log.New(log.Writer(), log.Prefix(), log.Flags())
+	log.SetOutput(io.Discard)
+
+	var total epub2cbz.Stats
+	var inputBytes int64
+	files, failed := 0, 0
+	start := time.Now()
+	for _, path := range epubFiles {
+		stats, err := conv.ConvertTo(context.Background(), path, io.Discard)
+		if err != nil {
+			failures.Printf("%s: %v", path, err)
+			failed++
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			inputBytes += info.Size()
+		}
+		files++
+		total.Pages += stats.Pages
+		total.Images += stats.Images
+		total.ImageBytes += stats.ImageBytes
+		total.OutputBytes += stats.OutputBytes
+		total.Spine += stats.Spine
+		total.Parse += stats.Parse
+		total.Fetch += stats.Fetch
+		total.Write += stats.Write
+	}
+	elapsed := time.Since(start)
+	log.SetOutput(failures.Writer())
+
+	pageJobs := opts.PageJobs
+	if pageJobs == 0 {
+		pageJobs = runtime.NumCPU()
+	}
+	fmt.Printf("Converted %d file(s) in %v (%d failed), %d page job(s), GOMAXPROCS %d\n",
+		files, elapsed.Round(time.Millisecond), failed, pageJobs, runtime.GOMAXPROCS(0))
+	fmt.Printf("  input   %10s  %8.1f MB/s\n", epub2cbz.FormatBytes(inputBytes), throughput(inputBytes, elapsed))
+	fmt.Printf("  output  %10s  %8.1f MB/s\n", epub2cbz.FormatBytes(total.OutputBytes), throughput(total.OutputBytes, elapsed))
+	fmt.Printf("  pages   %10d  %8.1f pages/s\n", total.Pages, float64(total.Pages)/elapsed.Seconds())
+	fmt.Printf("  images  %10d  %8.1f images/s\n", total.Images, float64(total.Images)/elapsed.Seconds())
+	fmt.Printf("\nStage times (parse and fetch add up the time of every worker):\n")
+	fmt.Printf("  spine   %10v\n", total.Spine.Round(time.Millisecond))
+	fmt.Printf("  parse   %10v  %8.1f pages/s\n", total.Parse.Round(time.Millisecond), float64(total.Pages)/total.Parse.Seconds())
+	fmt.Printf("  fetch   %10v  %8.1f MB/s\n", total.Fetch.Round(time.Millisecond), throughput(total.ImageBytes, total.Fetch))
+	fmt.Printf("  write   %10v  %8.1f MB/s\n", total.Write.Round(time.Millisecond), throughput(total.OutputBytes, total.Write))
+
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// throughput returns a rate in megabytes per second
+func throughput(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / (1 << 20) / elapsed.Seconds()
+}
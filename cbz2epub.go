@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// runCBZ2EPUB implements "epub2cbz cbz2epub <book.cbz | image_dir> [book.epub]":
+// it makes a fixed-layout EPUB 3 of a comic with the metadata of its
+// ComicInfo.xml, the reverse of the conversion
+func runCBZ2EPUB(args []string) int {
+	fs := flag.NewFlagSet("cbz2epub", flag.ExitOnError)
+	rtl := fs.Bool("rtl", false, "read from right to left (default: for manga marked YesAndRightToLeft in ComicInfo.xml)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s cbz2epub [options] <book.cbz | image_dir> [book.epub]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nMakes a fixed-layout EPUB 3 of a CBZ or a folder of images, with the metadata of its ComicInfo.xml.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	target, err := epub2cbz.ComicToEPUB(fs.Arg(0), fs.Arg(1), *rtl, nil)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	fmt.Printf("EPUB written to %s\n", target)
+	return 0
+}
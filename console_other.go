@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// launchedWithoutConsole reports false, programs are started from a terminal
+// or a script outside of Windows
+func launchedWithoutConsole() bool {
+	return false
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var procGetConsoleProcessList = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleProcessList")
+
+// launchedWithoutConsole reports whether Windows created a console for this
+// process alone, which happens when the executable is double-clicked or files
+// are dropped on it in Explorer: the window closes as soon as the process exits
+func launchedWithoutConsole() bool {
+	var processes [2]uint32
+	count, _, _ := procGetConsoleProcessList.Call(uintptr(unsafe.Pointer(&processes[0])), uintptr(len(processes)))
+	return count == 1
+}
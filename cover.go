@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// runCover implements "epub2cbz cover <book.epub> <cover.jpg>" and
+// "epub2cbz cover <dir> [output_dir]": it extracts the cover image of EPUB
+// files without converting them, for library artwork
+func runCover(args []string) int {
+	fs := flag.NewFlagSet("cover", flag.ExitOnError)
+	recursive := fs.Bool("r", false, "process subdirectories recursively")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s cover [options] <book.epub> [cover.jpg|cover.png]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s cover [options] <dir> [output_dir]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nExtracts the cover image of EPUB files, as <name>.cover.<ext> by default.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+	source, output := fs.Arg(0), fs.Arg(1)
+
+	info, err := os.Stat(source)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	if !info.IsDir() {
+		coverPath, err := epub2cbz.ExtractCover(source, output)
+		if err != nil {
+			log.Printf("Error extracting cover of %s: %v", source, err)
+			return 1
+		}
+		fmt.Printf("Cover extracted to %s\n", coverPath)
+		return 0
+	}
+
+	epubFiles, err := epub2cbz.FindEPUBFiles(source, *recursive)
+	if err != nil {
+		log.Print("Error reading directory:", err)
+		return 1
+	}
+	failed := 0
+	for _, epubPath := range epubFiles {
+		target := ""
+		if output != "" {
+			// The structure of the source directory is mirrored
+			rel, err := filepath.Rel(source, epubPath)
+			if err != nil {
+				log.Printf("Error getting output path for %s: %v", epubPath, err)
+				failed++
+				continue
+			}
+			target = filepath.Join(output, strings.TrimSuffix(rel, filepath.Ext(rel))+".cover")
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				log.Printf("Error creating output directory for %s: %v", epubPath, err)
+				failed++
+				continue
+			}
+		}
+		coverPath, err := epub2cbz.ExtractCover(epubPath, target)
+		if err != nil {
+			log.Printf("Error extracting cover of %s: %v", epubPath, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Cover extracted to %s\n", coverPath)
+	}
+	fmt.Printf("%d cover(s) extracted from %d book(s)\n", len(epubFiles)-failed, len(epubFiles))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
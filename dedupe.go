@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// runDedupe implements "epub2cbz dedupe <dir>": it reports the EPUB and CBZ
+// files of a library that are probably the same book, before a conversion
+// doubles the size of the library
+func runDedupe(args []string) int {
+	fs := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	recursive := fs.Bool("r", true, "process subdirectories recursively")
+	threshold := fs.Float64("threshold", 0.9, "share of the images of the smaller book found in the other one to report them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s dedupe [options] <dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nReports the EPUB and CBZ files sharing their images or their metadata.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if *threshold <= 0 || *threshold > 1 {
+		log.Print("Threshold must be between 0 and 1")
+		return 2
+	}
+
+	duplicates, books, err := epub2cbz.FindDuplicates(fs.Arg(0), *recursive, *threshold, nil)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	for _, pair := range duplicates {
+		fmt.Printf("%s\n%s\n  %s\n\n", pair.A, pair.B, strings.Join(pair.Reasons, ", "))
+	}
+	fmt.Printf("%d probable duplicate(s) found in %d book(s)\n", len(duplicates), books)
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// runDiff implements "epub2cbz diff <book.epub> <book.cbz>": it reports the
+// pages found in only one of the books and the metadata that differs, to
+// check a conversion before deleting the EPUB
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	perceptual := fs.Bool("perceptual", true, "match the pages without an exact copy by perceptual hash, for recompressed images")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [options] <book.epub> <book.cbz>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nReports the pages and the metadata that differ between an EPUB and a CBZ.\n")
+		fmt.Fprintf(os.Stderr, "Exits with 0 when the books match, 1 when they differ.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	epubPath, cbzPath := fs.Arg(0), fs.Arg(1)
+
+	diff, err := epub2cbz.DiffBooks(epubPath, cbzPath, *perceptual, nil)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	fmt.Printf("%d page(s) in %s, %d in %s, %d identical, %d similar\n",
+		diff.EPUBPages, epubPath, diff.CBZPages, cbzPath, diff.Identical, diff.Similar)
+	for _, book := range []struct {
+		path  string
+		pages []string
+	}{{epubPath, diff.OnlyInEPUB}, {cbzPath, diff.OnlyInCBZ}} {
+		if len(book.pages) > 0 {
+			fmt.Printf("\nPages only in %s:\n  %s\n", book.path, strings.Join(book.pages, "\n  "))
+		}
+	}
+	if len(diff.Metadata) > 0 {
+		fmt.Printf("\nMetadata differences (EPUB, CBZ):\n  %s\n", strings.Join(diff.Metadata, "\n  "))
+	}
+	if diff.Different() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// runDropped converts the files and folders dropped on the executable, each
+// next to its source, and keeps the window open until Enter is pressed so
+// the result can be read. Folders are converted with their subfolders, conv
+// is made with Recursive.
+func runDropped(conv *epub2cbz.Converter, paths []string) int {
+	defer pauseConsole()
+
+	converted, failed := 0, 0
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("Error accessing %s: %v", path, err)
+			failed++
+			continue
+		}
+
+		if info.IsDir() {
+			epubFiles, err := epub2cbz.FindEPUBFiles(path, true)
+			if err != nil {
+				log.Printf("Error reading folder %s: %v", path, err)
+				failed++
+				continue
+			}
+			if len(epubFiles) == 0 {
+				fmt.Printf("No EPUB files found in %s\n", path)
+				continue
+			}
+			failures, err := conv.ConvertDirectory(context.Background(), path, "")
+			if err != nil {
+				log.Print(err)
+				failed++
+				continue
+			}
+			converted += len(epubFiles) - len(failures)
+			failed += len(failures)
+			continue
+		}
+
+		fmt.Printf("Processing %s...\n", path)
+		if err := conv.ConvertFile(context.Background(), path, ""); epub2cbz.IsSkipped(err) {
+			fmt.Printf("Skipped %s: %v\n", path, err)
+		} else if err != nil {
+			log.Printf("ERROR processing %s: %v", path, err)
+			failed++
+		} else {
+			converted++
+		}
+	}
+
+	fmt.Printf("\n%d book(s) converted, %d failed\n", converted, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// pauseConsole waits for Enter, before the console window closes
+func pauseConsole() {
+	fmt.Print("\nPress Enter to close this window...")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
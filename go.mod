@@ -1,5 +1,12 @@
-module epub2cbz
+module github.com/hgourvest/epub2cbz
 
 go 1.25.3
 
-require golang.org/x/net v0.46.0 // indirect
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	golang.org/x/image v0.25.0
+	golang.org/x/net v0.46.0
+	golang.org/x/text v0.40.0
+)
+
+require golang.org/x/sys v0.37.0 // indirect
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// jsonRecord is the line printed for each processed file with -json
+type jsonRecord struct {
+	Source      string   `json:"source"`
+	Destination string   `json:"destination"`
+	Status      string   `json:"status"` // converted, skipped or failed
+	Pages       int      `json:"pages"`  // pages written to the CBZ
+	Bytes       int64    `json:"bytes"`  // size of the CBZ
+	Warnings    []string `json:"warnings"`
+	Duration    float64  `json:"duration"`         // seconds
+	Reason      string   `json:"reason,omitempty"` // why a file was skipped
+	Error       string   `json:"error,omitempty"`  // why a file failed
+}
+
+// jsonOutput prints one JSON record per processed file on the standard
+// output, for scripts driving the conversions. Other messages are left out
+// of the standard output, the log still goes to the standard error.
+type jsonOutput struct {
+	mutex   sync.Mutex
+	encoder *json.Encoder
+}
+
+// newJSONOutput prints the JSON records to w
+func newJSONOutput(w io.Writer) *jsonOutput {
+	return &jsonOutput{encoder: json.NewEncoder(w)}
+}
+
+// fileDone prints the record of a file, whatever the outcome of its conversion
+func (o *jsonOutput) fileDone(result epub2cbz.FileResult) {
+	record := jsonRecord{
+		Source: result.Source, Destination: result.Destination, Status: result.Status,
+		Pages: result.Pages, Bytes: result.Bytes, Warnings: result.Warnings, Duration: result.Duration.Seconds(),
+	}
+	if record.Warnings == nil {
+		record.Warnings = []string{}
+	}
+	switch result.Status {
+	case epub2cbz.StatusSkipped:
+		record.Reason = result.Err.Error()
+	case epub2cbz.StatusFailed:
+		record.Error = result.Err.Error()
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.encoder.Encode(record)
+}
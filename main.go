@@ -1,241 +1,167 @@
 package main
 
 import (
-	"archive/zip"
-	"encoding/xml"
+	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"runtime"
-	"runtime/debug"
-	"strconv"
-	"strings"
-	"sync"
 
-	"golang.org/x/net/html"
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
 )
 
-type Container struct {
-	Rootfiles struct {
-		Rootfile struct {
-			FullPath string `xml:"full-path,attr"`
-		} `xml:"rootfile"`
-	} `xml:"rootfiles"`
+// commands are the subcommands accepted as first argument
+var commands = map[string]func(args []string) int{
+	"bench":    runBench,
+	"cbz2epub": runCBZ2EPUB,
+	"cover":    runCover,
+	"dedupe":   runDedupe,
+	"diff":     runDiff,
+	"opds":     runOPDS,
+	"pack":     runPack,
 }
 
-type Package struct {
-	Metadata Metadata `xml:"metadata"`
-	Manifest struct {
-		Items []struct {
-			ID   string `xml:"id,attr"`
-			Href string `xml:"href,attr"`
-		} `xml:"item"`
-	} `xml:"manifest"`
-	Spine struct {
-		Itemrefs []struct {
-			IDRef string `xml:"idref,attr"`
-		} `xml:"itemref"`
-	} `xml:"spine"`
-}
-
-type Metadata struct {
-	XMLName    xml.Name `xml:"metadata"`
-	Identifier []string `xml:"http://purl.org/dc/elements/1.1/ identifier"`
-	Title      []string `xml:"http://purl.org/dc/elements/1.1/ title"`
-	Language   []string `xml:"http://purl.org/dc/elements/1.1/ language"`
-	Creator    []string `xml:"http://purl.org/dc/elements/1.1/ creator"`
-	Publisher  []string `xml:"http://purl.org/dc/elements/1.1/ publisher"`
-	Date       []string `xml:"http://purl.org/dc/elements/1.1/ date"`
-	Rights     []string `xml:"http://purl.org/dc/elements/1.1/ rights"`
-	Series     []string `xml:"http://purl.org/dc/elements/1.1/ series"`
-	SeriesID   []string `xml:"http://purl.org/dc/elements/1.1/ seriesid"`
-	Number     []string `xml:"http://purl.org/dc/elements/1.1/ number"`
-}
-
-type XHTML struct {
-	Body struct {
-		Div struct {
-			Img struct {
-				Src string `xml:"src,attr"`
-			} `xml:"img"`
-		} `xml:"div"`
-	} `xml:"body"`
-}
-
-type ComicInfo struct {
-	XMLName             xml.Name              `xml:"ComicInfo"`
-	Title               string                `xml:"Title,omitempty"`
-	Series              string                `xml:"Series,omitempty"`
-	Number              string                `xml:"Number,omitempty"`
-	Count               int                   `xml:"Count,omitempty"`
-	Volume              int                   `xml:"Volume,omitempty"`
-	AlternateSeries     string                `xml:"AlternateSeries,omitempty"`
-	AlternateNumber     string                `xml:"AlternateNumber,omitempty"`
-	AlternateCount      int                   `xml:"AlternateCount,omitempty"`
-	Summary             string                `xml:"Summary,omitempty"`
-	Notes               string                `xml:"Notes,omitempty"`
-	Year                int                   `xml:"Year,omitempty"`
-	Month               int                   `xml:"Month,omitempty"`
-	Day                 int                   `xml:"Day,omitempty"`
-	Writer              string                `xml:"Writer,omitempty"`
-	Penciller           string                `xml:"Penciller,omitempty"`
-	Inker               string                `xml:"Inker,omitempty"`
-	Colorist            string                `xml:"Colorist,omitempty"`
-	Letterer            string                `xml:"Letterer,omitempty"`
-	CoverArtist         string                `xml:"CoverArtist,omitempty"`
-	Editor              string                `xml:"Editor,omitempty"`
-	Publisher           string                `xml:"Publisher,omitempty"`
-	Imprint             string                `xml:"Imprint,omitempty"`
-	Genre               string                `xml:"Genre,omitempty"`
-	Web                 string                `xml:"Web,omitempty"`
-	PageCount           int                   `xml:"PageCount,omitempty"`
-	LanguageISO         string                `xml:"LanguageISO,omitempty"`
-	Format              string                `xml:"Format,omitempty"`
-	BlackAndWhite       string                `xml:"BlackAndWhite,omitempty"`
-	Manga               string                `xml:"Manga,omitempty"`
-	Characters          string                `xml:"Characters,omitempty"`
-	Teams               string                `xml:"Teams,omitempty"`
-	Locations           string                `xml:"Locations,omitempty"`
-	ScanInformation     string                `xml:"ScanInformation,omitempty"`
-	StoryArc            string                `xml:"StoryArc,omitempty"`
-	SeriesGroup         string                `xml:"SeriesGroup,omitempty"`
-	AgeRating           string                `xml:"AgeRating,omitempty"`
-	Pages               *ArrayOfComicPageInfo `xml:"Pages,omitempty"`
-	CommunityRating     string                `xml:"CommunityRating,omitempty"`
-	MainCharacterOrTeam string                `xml:"MainCharacterOrTeam,omitempty"`
-	Review              string                `xml:"Review,omitempty"`
-}
-
-type ArrayOfComicPageInfo struct {
-	Page []ComicPageInfo `xml:"Page"`
-}
-
-type ComicPageInfo struct {
-	Image       int    `xml:"Image,attr"`
-	Type        string `xml:"Type,attr,omitempty"`
-	DoublePage  bool   `xml:"DoublePage,attr,omitempty"`
-	ImageSize   int64  `xml:"ImageSize,attr,omitempty"`
-	Key         string `xml:"Key,attr,omitempty"`
-	Bookmark    string `xml:"Bookmark,attr,omitempty"`
-	ImageWidth  int    `xml:"ImageWidth,attr,omitempty"`
-	ImageHeight int    `xml:"ImageHeight,attr,omitempty"`
-}
-
-// createComicInfo creates a ComicInfo.xml structure from OPF metadata
-func createComicInfo(metadata Metadata) *ComicInfo {
-	comicInfo := &ComicInfo{
-		Title:       getFirst(metadata.Title),
-		Series:      getFirst(metadata.Series),
-		Number:      getFirst(metadata.Number),
-		Publisher:   getFirst(metadata.Publisher),
-		LanguageISO: getFirst(metadata.Language),
-		Notes:       "Generated from EPUB metadata",
-	}
-
-	// Extract year from date if possible
-	if len(metadata.Date) > 0 {
-		dateStr := metadata.Date[0]
-		if len(dateStr) >= 4 {
-			if year, err := strconv.Atoi(dateStr[:4]); err == nil {
-				comicInfo.Year = year
-			}
-		}
-	}
-
-	// Set Manga to Yes if series is in Japanese (simplified heuristic)
-	if comicInfo.Series != "" {
-		// Check if the series title contains Japanese characters
-		if containsJapanese(comicInfo.Series) {
-			comicInfo.Manga = "Yes"
-		} else {
-			comicInfo.Manga = "No"
-		}
-	} else {
-		comicInfo.Manga = "Unknown"
-	}
-
-	// Map creator to writer (or penciller if appropriate)
-	creator := getFirst(metadata.Creator)
-	if creator != "" {
-		// For manga, often the creator is both writer and penciller
-		comicInfo.Writer = creator
-		comicInfo.Penciller = creator
-	}
-
-	// Set default values according to schema
-	if comicInfo.BlackAndWhite == "" {
-		comicInfo.BlackAndWhite = "Unknown"
-	}
-	if comicInfo.AgeRating == "" {
-		comicInfo.AgeRating = "Unknown"
-	}
-
-	return comicInfo
-}
-
-// getFirst returns the first element of a slice or an empty string if the slice is empty
-func getFirst(items []string) string {
-	if len(items) > 0 {
-		return items[0]
-	}
-	return ""
-}
-
-// containsJapanese checks if a string contains Japanese characters
-func containsJapanese(s string) bool {
-	for _, r := range s {
-		if (r >= 0x3040 && r <= 0x309F) || // Hiragana
-			(r >= 0x30A0 && r <= 0x30FF) || // Katakana
-			(r >= 0x4E00 && r <= 0x9FBF) { // Kanji
-			return true
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
 		}
 	}
-	return false
-}
-
-// hasMetadata checks if there is any useful metadata to include in ComicInfo.xml
-func hasMetadata(metadata Metadata) bool {
-	return len(metadata.Title) > 0 ||
-		len(metadata.Creator) > 0 ||
-		len(metadata.Publisher) > 0 ||
-		len(metadata.Series) > 0 ||
-		len(metadata.Date) > 0 ||
-		len(metadata.Language) > 0 ||
-		len(metadata.Identifier) > 0 ||
-		len(metadata.Number) > 0
-}
-
-// getVersion returns the version of the application
-func getVersion() string {
-	info, ok := debug.ReadBuildInfo()
-	if ok && info.Main.Version != "" {
-		return info.Main.Version
-	}
-	// If build info is not available, return a default version
-	return "v1.0.0"
-}
 
-func main() {
-	var recursive bool
+	var opts epub2cbz.Options
 	var showVersion bool
 	var showHelp bool
-	var jobs int
-
-	flag.BoolVar(&recursive, "r", false, "process subdirectories recursively")
+	var pprofAddr string
+	var traceFile string
+	var buildCatalog bool
+	var readingListPath string
+	var manifestPath string
+	var quiet, verbose, debug bool
+	var jsonRecords bool
+	var overwrite, skipExisting, ifNewer bool
+	var watch bool
+	settle := epub2cbz.DefaultSettleDelay
+	var watchDB string
+
+	flag.BoolVar(&opts.Recursive, "r", false, "process subdirectories recursively")
 	flag.BoolVar(&showVersion, "v", false, "show version information")
 	flag.BoolVar(&showHelp, "h", false, "show help message")
-	flag.IntVar(&jobs, "j", runtime.NumCPU(), "number of parallel jobs (default: number of CPU cores)")
+	flag.BoolVar(&quiet, "q", false, "only print errors")
+	flag.BoolVar(&quiet, "quiet", false, "same as -q")
+	flag.BoolVar(&verbose, "verbose", false, "print the details of each conversion")
+	flag.BoolVar(&debug, "debug", false, "print every page and image of each conversion")
+	flag.BoolVar(&overwrite, "overwrite", false, "convert again the books whose output already exists, replacing it (default)")
+	flag.BoolVar(&skipExisting, "skip-existing", false, "skip the books whose output already exists")
+	flag.BoolVar(&ifNewer, "if-newer", false, "convert again the books more recent than their existing output, skipping the others")
+	flag.BoolVar(&jsonRecords, "json", false, "print one JSON record per processed file on the standard output")
+	flag.StringVar(&pprofAddr, "pprof", "", "serve pprof profiles on this address, e.g. :6060")
+	flag.StringVar(&traceFile, "trace", "", "write an execution trace to this file")
+	flag.IntVar(&opts.Jobs, "j", runtime.NumCPU(), "number of parallel jobs (default: number of CPU cores)")
+	flag.IntVar(&opts.Jobs, "jobs", runtime.NumCPU(), "same as -j")
+	flag.StringVar(&opts.Layout, "layout", "", "organize outputs for a library server: komga, kavita, mylar, kapowarr, tachiyomi")
+	flag.StringVar(&opts.ChapterNaming, "chapter-naming", "", "name output files from their chapter metadata: mangadex")
+	flag.StringVar(&opts.Calibre, "from-calibre", "", "convert the books of a Calibre library, using its metadata")
+	flag.BoolVar(&opts.CalibreAdd, "calibre-add", false, "add converted CBZ files to the Calibre library with calibredb")
+	flag.StringVar(&opts.Sanitize, "sanitize", epub2cbz.SanitizeReplace, "output file name sanitizing policy: none, replace or strip")
+	flag.BoolVar(&opts.PreserveTimes, "preserve-times", false, "copy the EPUB modification time to the CBZ and its entries")
+	flag.IntVar(&opts.PageJobs, "page-jobs", 0, "number of pages processed in parallel inside one conversion (default: CPU cores shared between jobs)")
+	flag.Func("memory-limit", "memory budget shared by parallel conversions, e.g. 2G (default: no limit)", func(value string) error {
+		limit, err := epub2cbz.ParseByteSize(value)
+		opts.MemoryLimit = limit
+		return err
+	})
+	opts.SpillThreshold = epub2cbz.DefaultSpillThreshold
+	flag.Func("spill-threshold", "stage entries larger than this size in temporary files instead of memory, 0 to disable (default: 64M)", func(value string) error {
+		threshold, err := epub2cbz.ParseByteSize(value)
+		opts.SpillThreshold = threshold
+		return err
+	})
+	flag.IntVar(&opts.MaxOpen, "max-open", 0, "maximum number of EPUB files open at the same time in directory mode (default: one per job)")
+	flag.IntVar(&opts.IOWorkers, "io-workers", 0, "maximum number of images read from EPUB files at the same time (default: no separate limit)")
+	flag.IntVar(&opts.CPUWorkers, "cpu-workers", 0, "maximum number of images compressed at the same time (default: no separate limit)")
+	flag.BoolVar(&watch, "watch", false, "keep converting the EPUB files added or modified in the source directory")
+	flag.DurationVar(&settle, "settle", epub2cbz.DefaultSettleDelay, "time a watched file must stay unchanged before it is converted")
+	flag.StringVar(&watchDB, "watch-db", "", "database of the books processed by -watch (default: "+epub2cbz.WatchDatabaseName+" in the watched directory)")
+	flag.StringVar(&opts.Webhook, "webhook", "", "URL receiving a JSON POST after each conversion and at the end of a batch")
+	flag.BoolVar(&opts.Reverse, "reverse", false, "write the pages in reverse spine order, to repair EPUBs with a backwards spine")
+	flag.BoolVar(&opts.NoCover, "no-cover", false, "drop the cover page")
+	flag.BoolVar(&opts.StripBackmatter, "strip-backmatter", false, "drop the ads, previews and catalog pages ending the table of contents")
+	flag.StringVar(&opts.Watermark, "watermark", "", "text stamped on every page, such as the recipient of a review copy")
+	flag.StringVar(&opts.WatermarkStyle, "watermark-style", epub2cbz.WatermarkCorner, "placement of the watermark: corner or diagonal")
+	flag.BoolVar(&opts.SplitSpreads, "split-spreads", false, "cut landscape spread images in two pages, for small screens")
+	flag.StringVar(&opts.SplitOrder, "split-order", epub2cbz.SplitOrderLTR, "order of the halves of a split spread: ltr, or rtl for manga")
+	flag.StringVar(&opts.TitlePage, "title-page", "", "insert a generated title page with the book metadata: first or second (after the cover)")
+	flag.BoolVar(&opts.TOCPage, "toc-page", false, "insert a generated contents page listing the chapters after the cover")
+	flag.IntVar(&opts.PageOffset, "page-offset", 0, "number of the first page name, to continue the numbering of a previous chapter")
+	flag.Func("thumbnails", "write a cover thumbnail fitting this size in a .thumbs folder next to each output, e.g. 300x450", func(value string) error {
+		var err error
+		opts.ThumbnailWidth, opts.ThumbnailHeight, err = epub2cbz.ParseThumbnailSize(value)
+		return err
+	})
+	flag.BoolVar(&opts.VerifySource, "verify-source", false, "check the CRC of every EPUB image, failing corrupted pages instead of copying them")
+	flag.StringVar(&opts.MappingsFile, "mappings", "", "JSON file of the tables mapping publisher metadata onto AgeRating, Manga and BlackAndWhite (default: built-in tables)")
+	flag.StringVar(&opts.ReportFile, "report", "", "write a CSV report comparing each EPUB with its CBZ: sizes, pages, image formats and processing")
+	// Metadata corrections, written over the values of the EPUB
+	overrides := make(map[string]string)
+	for _, field := range []struct{ name, element string }{
+		{"title", "Title"}, {"series", "Series"}, {"number", "Number"}, {"volume", "Volume"},
+		{"writer", "Writer"}, {"publisher", "Publisher"}, {"genre", "Genre"},
+	} {
+		flag.Func(field.name, fmt.Sprintf("ComicInfo %s written in every book instead of the EPUB value", field.element), func(value string) error {
+			return epub2cbz.ParseOverride(overrides, field.element+"="+value)
+		})
+	}
+	flag.Func("set", "ComicInfo value written in every book instead of the EPUB value, as Field=value (repeatable), e.g. -set Imprint=Vertigo", func(value string) error {
+		return epub2cbz.ParseOverride(overrides, value)
+	})
+	flag.StringVar(&opts.ParseFilename, "parse-filename", "", "template of the EPUB file names filling the metadata missing from the EPUB, e.g. \"{series} v{volume} - {title}\"")
+	flag.StringVar(&opts.ComicVineKey, "comicvine-key", "", "ComicVine API key, to fill the summary, characters, teams, story arc and web page of each issue from ComicVine")
+	flag.StringVar(&opts.MangaMetadata, "manga-metadata", "", "fill the genres, summary, staff and age rating of each series from anilist or mangaupdates")
+	flag.StringVar(&opts.Format, "format", "", "ComicInfo format of the books, such as Digital, TPB or Omnibus (default: inferred from the title, series and page count)")
+	flag.BoolVar(&opts.KeepStructure, "keep-structure", false, "store images under their path in the EPUB instead of renaming them page0, page1...")
+	flag.BoolVar(&opts.SplitChapters, "split-chapters", false, "write one CBZ per chapter, from the table of contents or detected chapters")
+	flag.BoolVar(&opts.SplitVolumes, "split-volumes", false, "write one CBZ per volume of an omnibus EPUB, from its packages or table of contents")
+	flag.BoolVar(&opts.KOReader, "koreader", false, "write KOReader sidecar metadata (<name>.sdr) next to each output")
+	flag.BoolVar(&opts.PDF, "pdf", false, "also write each book as a PDF with one image per page, next to its CBZ")
+	flag.BoolVar(&opts.PDFOnly, "pdf-only", false, "write each book as a PDF with one image per page instead of a CBZ")
+	flag.BoolVar(&opts.ExtractDir, "extract-dir", false, "write the pages and ComicInfo.xml into a folder named after each book instead of a CBZ")
+	flag.StringVar(&opts.Kindle, "send-to-kindle", "", "email each converted book as a PDF to this Send to Kindle address, through the SMTP_* server")
+	flag.StringVar(&opts.KindleDevice, "kindle-device", epub2cbz.KindlePaperwhite, "Kindle the pages sent to Kindle are fitted to: basic, paperwhite, scribe, colorsoft, or none to send them as converted")
+	flag.StringVar(&opts.Ntfy, "ntfy", "", "ntfy topic URL receiving the summary of a batch (e.g. https://ntfy.sh/my-topic)")
+	flag.StringVar(&opts.Email, "email", "", "address receiving the summary of a batch, sent through the SMTP_* server")
+	flag.StringVar(&opts.MetricsAddr, "metrics", "", "serve Prometheus metrics on this address (e.g. :9090)")
+	flag.StringVar(&manifestPath, "manifest", "", "CSV file listing the books to convert with their destination and metadata corrections")
+	flag.StringVar(&readingListPath, "cbl", "", "write a ComicRack reading list (.cbl) of the output directory after a directory conversion")
+	flag.BoolVar(&buildCatalog, "opds", false, "write an OPDS catalog of the output directory after a directory conversion")
+	flag.StringVar(&opts.CacheFile, "cache", "", "cache file recording converted books, unchanged books are skipped on later runs")
+	flag.StringVar(&opts.Compression, "compression", epub2cbz.CompressionAuto, "image entry compression: auto, store, deflate or keep")
+	flag.BoolVar(&opts.StrictMetadata, "strict-metadata", false, "fail when the generated ComicInfo.xml does not match the schema")
+	flag.StringVar(&opts.Metadata, "metadata", epub2cbz.MetadataComicInfo, "metadata files written in the archives, comma separated: comicinfo, comet, acbf")
+	flag.BoolVar(&opts.ComicBookInfo, "cbi", false, "also write the metadata as a ComicBookInfo JSON comment of the archive, for readers of the older format")
+	flag.BoolVar(&opts.ComicTagger, "comictagger", false, "write metadata with the ComicTagger conventions, in ComicInfo.xml and a ComicBookInfo comment")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [-r] [-v] [-h] [-j <num>] <epub_file.epub | source_dir> [output_dir]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] <epub_file.epub | source_dir> [output_dir]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s -from-calibre <library> [options] [output_dir]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s bench [options] <source_dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s opds [options] <dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s dedupe [options] <dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s diff [options] <book.epub> <book.cbz>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s cover [options] <book.epub | dir> [cover | output_dir]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s cbz2epub [options] <book.cbz | image_dir> [book.epub]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s pack [options] <image_dir> [book.cbz]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
+	if len(overrides) > 0 {
+		opts.Overrides = overrides
+	}
 
 	if showHelp {
 		flag.Usage()
@@ -243,362 +169,271 @@ func main() {
 	}
 
 	if showVersion {
-		version := getVersion()
-		fmt.Printf("epub2cbz version %s\n", version)
+		fmt.Printf("epub2cbz version %s\n", epub2cbz.Version())
 		return
 	}
 
-	if jobs <= 0 {
-		log.Fatal("Number of parallel jobs must be greater than 0")
-	}
-
-	if len(flag.Args()) < 1 {
-		flag.Usage()
-		return
+	// Messages of the conversions go to the standard output, unless it
+	// carries the JSON records
+	output := io.Writer(os.Stdout)
+	switch {
+	case quiet && (verbose || debug):
+		log.Fatal("-q cannot be combined with -verbose or -debug")
+	case quiet:
+		opts.Verbosity = epub2cbz.VerbosityQuiet
+		output = nil
+		log.SetOutput(errorsOnly{log.Writer()})
+	case debug:
+		opts.Verbosity = epub2cbz.VerbosityDebug
+	case verbose:
+		opts.Verbosity = epub2cbz.VerbosityVerbose
+	}
+	var records *jsonOutput
+	if jsonRecords {
+		records = newJSONOutput(os.Stdout)
+		output = nil
+	}
+
+	// Existing outputs are replaced unless asked otherwise
+	policies := 0
+	for _, given := range []bool{overwrite, skipExisting, ifNewer} {
+		if given {
+			policies++
+		}
 	}
-
-	sourcePath := flag.Arg(0)
-	var outputPath string
-	if len(flag.Args()) > 1 {
-		outputPath = flag.Arg(1)
+	switch {
+	case policies > 1:
+		log.Fatal("-overwrite, -skip-existing and -if-newer cannot be combined")
+	case skipExisting:
+		opts.Existing = epub2cbz.ExistingSkip
+	case ifNewer:
+		opts.Existing = epub2cbz.ExistingIfNewer
+	default:
+		opts.Existing = epub2cbz.ExistingOverwrite
 	}
 
-	// Check if source is a directory
-	sourceInfo, err := os.Stat(sourcePath)
-	if err != nil {
-		log.Fatal("Error accessing source path:", err)
+	if opts.Jobs <= 0 {
+		log.Fatal("Number of parallel jobs must be greater than 0")
 	}
-
-	if sourceInfo.IsDir() {
-		// Process all .epub files in the directory based on recursive flag
-		processDirectory(sourcePath, outputPath, recursive, jobs)
-	} else {
-		// Process single .epub file
-		if err := processFile(sourcePath, outputPath); err != nil {
-			log.Fatal(err)
-		}
+	if settle <= 0 {
+		log.Fatal("-settle must be greater than 0")
 	}
-}
 
-func processDirectory(sourceDir string, outputDir string, recursive bool, maxConcurrency int) {
-	var epubFiles []string
-
-	if recursive {
-		// Walk the directory recursively
-		err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() && strings.HasSuffix(strings.ToLower(path), ".epub") {
-				epubFiles = append(epubFiles, path)
-			}
-			return nil
-		})
-		if err != nil {
-			log.Fatal("Error walking directory:", err)
+	// Files dropped on the executable in Explorer arrive as arguments of a
+	// console closed on exit: every argument is a source converted in place
+	if launchedWithoutConsole() {
+		if flag.NArg() == 0 {
+			flag.Usage()
+			pauseConsole()
+			return
 		}
+		opts.Recursive = true
+		bar := newProgressBar()
+		opts.Output = bar.writer(os.Stdout)
+		opts.Events = batchEvents(opts.Output, bar, nil, nil)
+		conv := newConverter(opts)
+		code := runDropped(conv, flag.Args())
+		bar.close()
+		closeConverter(conv)
+		os.Exit(code)
+	}
+
+	var sourcePath, outputPath string
+	if opts.Calibre != "" {
+		// The library is the source, books are stored in author/title folders
+		sourcePath = opts.Calibre
+		outputPath = flag.Arg(0)
+		opts.Recursive = true
+	} else if manifestPath != "" {
+		// Sources and destinations are listed in the manifest
+		sourcePath = manifestPath
 	} else {
-		// Only process files in the top-level directory (non-recursive)
-		entries, err := os.ReadDir(sourceDir)
-		if err != nil {
-			log.Fatal("Error reading directory:", err)
+		if len(flag.Args()) < 1 {
+			flag.Usage()
+			return
 		}
-		for _, entry := range entries {
-			if !entry.IsDir() && strings.HasSuffix(strings.ToLower(entry.Name()), ".epub") {
-				epubFiles = append(epubFiles, filepath.Join(sourceDir, entry.Name()))
-			}
+		sourcePath = flag.Arg(0)
+		if len(flag.Args()) > 1 {
+			outputPath = flag.Arg(1)
 		}
 	}
 
-	if len(epubFiles) == 0 {
-		if recursive {
-			log.Fatal("No .epub files found in directory or subdirectories:", sourceDir)
-		} else {
-			log.Fatal("No .epub files found in directory:", sourceDir)
-		}
-	}
-
-	// Create output directory if specified
-	if outputDir != "" {
-		err := os.MkdirAll(outputDir, 0755)
+	// Check if source is a directory, remote sources are always single EPUB files
+	isDir := false
+	if !epub2cbz.IsRemoteURL(sourcePath) {
+		sourceInfo, err := os.Stat(sourcePath)
 		if err != nil {
-			log.Fatal("Error creating output directory:", err)
-		}
-	}
-
-	var wg sync.WaitGroup
-	// Limit the number of goroutines to the number of available CPUs or user-defined value
-	semaphore := make(chan struct{}, maxConcurrency)
-
-	// Process each .epub file
-	for _, epubPath := range epubFiles {
-		wg.Add(1)
-		semaphore <- struct{}{}
-
-		go func(path string) {
-			defer wg.Done()
-			defer func() { <-semaphore }()
-
-			fmt.Printf("Processing %s...\n", path)
-
-			var finalOutputPath string
-			if outputDir != "" {
-				// Generate output path preserving directory structure if recursive
-				if recursive {
-					relPath, err := filepath.Rel(sourceDir, path)
-					if err != nil {
-						log.Printf("Error getting relative path for %s: %v", path, err)
-						return
-					}
-					// Create corresponding output directory structure
-					outputDirPath := filepath.Join(outputDir, filepath.Dir(relPath))
-					err = os.MkdirAll(outputDirPath, 0755)
-					if err != nil {
-						log.Printf("Error creating output directory structure for %s: %v", path, err)
-						return
-					}
-					// Generate output path in the output directory
-					baseName := strings.TrimSuffix(filepath.Base(path), ".epub")
-					finalOutputPath = filepath.Join(outputDirPath, baseName+".cbz")
-				} else {
-					// Just put output in the output directory without subdirectory structure
-					baseName := strings.TrimSuffix(filepath.Base(path), ".epub")
-					finalOutputPath = filepath.Join(outputDir, baseName+".cbz")
-				}
-			} else {
-				// Use default naming in source directory
-				finalOutputPath = ""
-			}
-
-			if err := processFile(path, finalOutputPath); err != nil {
-				log.Printf("ERROR processing %s: %v", path, err)
-			}
-		}(epubPath)
-	}
-
-	wg.Wait()
-}
-
-// findAndOpenFile searches for a file by name in the zip archive and returns an open reader.
-func findAndOpenFile(zipReader *zip.ReadCloser, fileName string) (io.ReadCloser, error) {
-	for _, f := range zipReader.File {
-		if f.Name == fileName {
-			return f.Open()
+			log.Fatal("Error accessing source path:", err)
 		}
+		isDir = sourceInfo.IsDir()
 	}
-	return nil, fmt.Errorf("file not found in archive: %s", fileName)
-}
-
-func processFile(epubPath string, outputPath string) error {
-	// Validate input file
-	if filepath.Ext(epubPath) != ".epub" {
-		return fmt.Errorf("input file must have .epub extension")
-	}
-
-	// Generate output path if not provided
-	if outputPath == "" {
-		outputPath = epubPath[:len(epubPath)-len(".epub")] + ".cbz"
-	}
-
-	// Open the EPUB file
-	zipReader, err := zip.OpenReader(epubPath)
-	if err != nil {
-		return fmt.Errorf("error opening EPUB file: %w", err)
-	}
-	defer zipReader.Close()
-
-	// 1. Find the vol.opf file
-	var volOPFPath string
-	containerFile, err := findAndOpenFile(zipReader, "META-INF/container.xml")
-	if err != nil {
-		return fmt.Errorf("error finding container.xml: %w", err)
-	}
-	defer containerFile.Close()
-
-	var container Container
-	if err := xml.NewDecoder(containerFile).Decode(&container); err != nil {
-		return fmt.Errorf("error decoding container.xml: %w", err)
-	}
-	volOPFPath = container.Rootfiles.Rootfile.FullPath
-
-	if volOPFPath == "" {
-		return fmt.Errorf("vol.opf file not found in container")
+	if watch && manifestPath == "" && !isDir {
+		log.Fatal("-watch requires a source directory")
 	}
 
-	// 2. Read vol.opf to get the metadata and pages
-	var pages []string
-	var metadata Metadata
-	opfFile, err := findAndOpenFile(zipReader, volOPFPath)
+	stopProfiling, err := startProfiling(pprofAddr, traceFile)
 	if err != nil {
-		return fmt.Errorf("error finding vol.opf: %w", err)
-	}
-	defer opfFile.Close()
-
-	var pkg Package
-	if err := xml.NewDecoder(opfFile).Decode(&pkg); err != nil {
-		return fmt.Errorf("error decoding vol.opf: %w", err)
-	}
-
-	// Store the metadata for later use
-	metadata = pkg.Metadata
-
-	// Find hrefs of pages via spine
-	pageMap := make(map[string]string)
-	for _, item := range pkg.Manifest.Items {
-		pageMap[item.ID] = item.Href
+		log.Fatal(err)
 	}
+	defer stopProfiling()
 
-	for _, ref := range pkg.Spine.Itemrefs {
-		href, exists := pageMap[ref.IDRef]
-		if exists {
-			// Convert relative path to absolute path based on volOPFPath
-			absPath := filepath.Join(filepath.Dir(volOPFPath), href)
-			// Normalize path separators to forward slashes for ZIP/EPUB compatibility
-			absPath = filepath.ToSlash(absPath)
-			absPath = strings.TrimPrefix(absPath, "/")
-			pages = append(pages, absPath)
+	// A progress bar follows the batches on a terminal, with the messages
+	// printed above it
+	var bar *progressBar
+	var summary *batchSummary
+	if manifestPath != "" || (isDir && !watch) {
+		if output != nil {
+			bar = newProgressBar()
 		}
+		summary = newBatchSummary()
 	}
-
-	if len(pages) == 0 {
-		return fmt.Errorf("no pages found in spine")
-	}
-
-	// 3. Open each page and extract images
-	zipWriter, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("error creating ZIP file: %w", err)
+	opts.Output = bar.writer(output)
+	if manifestPath != "" || isDir {
+		opts.Events = batchEvents(opts.Output, bar, records, summary)
+	} else if records != nil {
+		opts.Events.FileDone = records.fileDone
 	}
-	defer zipWriter.Close()
-
-	zipw := zip.NewWriter(zipWriter)
-	defer zipw.Close()
-
-	// Variables to track images
-	imageIndex := 0
-	var imgSrcs []string
-	for _, pageHref := range pages {
-		for _, f := range zipReader.File {
-			if f.Name == pageHref {
-				file, err := f.Open()
-				if err != nil {
-					log.Printf("Error opening %s: %v", pageHref, err)
-					continue
-				}
-				// Read the content of the page
-				content, err := io.ReadAll(file)
-				file.Close() // Close the file immediately after reading
-				if err != nil {
-					log.Printf("Error reading %s: %v", pageHref, err)
-					continue
-				}
+	conv := newConverter(opts)
+	ctx := context.Background()
 
-				// Extract images
-				imgSrcs = extractImagesFromXHTML(string(content), pageHref, imgSrcs)
-
-				break
-			}
+	if manifestPath != "" {
+		failed, err := conv.ConvertManifest(ctx, manifestPath)
+		bar.close()
+		closeConverter(conv)
+		if err != nil {
+			stopProfiling()
+			log.Fatal(err)
 		}
-	}
-	for _, src := range imgSrcs {
-		addImageToZip(zipw, zipReader, src, imageIndex, len(imgSrcs))
-		imageIndex++
-	}
-
-	// Generate and add ComicInfo.xml to the ZIP if metadata exists
-	if hasMetadata(metadata) {
-		comicInfo := createComicInfo(metadata)
-		comicInfoXML, err := xml.MarshalIndent(comicInfo, "", "  ")
+		summary.print(orDiscard(output), failed)
+		if len(failed) > 0 {
+			stopProfiling()
+			os.Exit(1)
+		}
+	} else if watch {
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		if output != nil {
+			fmt.Fprintf(output, "Watching %s for EPUB files, press Ctrl+C to stop\n", sourcePath)
+		}
+		err := conv.Watch(ctx, sourcePath, outputPath, settle, watchDB)
+		closeConverter(conv)
 		if err != nil {
-			log.Printf("Error marshaling ComicInfo: %v", err)
-		} else {
-			// Add XML declaration to the beginning of the XML
-			comicInfoContent := xml.Header + string(comicInfoXML)
-
-			// Create the ComicInfo.xml entry in the ZIP
-			comicInfoFile, err := zipw.Create("ComicInfo.xml")
-			if err != nil {
-				log.Printf("Error creating ComicInfo.xml in ZIP: %v", err)
+			stopProfiling()
+			log.Fatal(err)
+		}
+	} else if isDir {
+		// Process all .epub files in the directory based on recursive flag
+		failed, err := conv.ConvertDirectory(ctx, sourcePath, outputPath)
+		bar.close()
+		closeConverter(conv)
+		if err != nil {
+			stopProfiling()
+			log.Fatal(err)
+		}
+		libraryDir := outputPath
+		if libraryDir == "" {
+			libraryDir = sourcePath
+		}
+		if buildCatalog {
+			if epub2cbz.IsRemoteURL(libraryDir) {
+				log.Print("Error writing OPDS catalog: remote output directories are not supported")
+			} else if err := writeCatalog(orDiscard(output), libraryDir, ""); err != nil {
+				log.Print(err)
+			}
+		}
+		if readingListPath != "" {
+			if epub2cbz.IsRemoteURL(libraryDir) {
+				log.Print("Error writing reading list: remote output directories are not supported")
+			} else if books, err := epub2cbz.WriteReadingList(readingListPath, libraryDir, nil); err != nil {
+				log.Print(err)
 			} else {
-				_, err = comicInfoFile.Write([]byte(comicInfoContent))
-				if err != nil {
-					log.Printf("Error writing ComicInfo.xml to ZIP: %v", err)
-				}
+				fmt.Fprintf(orDiscard(output), "Reading list of %d book(s) written to %s\n", books, readingListPath)
+			}
+		}
+		summary.print(orDiscard(output), failed)
+		if len(failed) > 0 {
+			stopProfiling()
+			os.Exit(1)
+		}
+	} else {
+		// Process single .epub file
+		outputPath, err := conv.OutputPath(sourcePath, outputPath)
+		if err == nil {
+			err = conv.ConvertFile(ctx, sourcePath, outputPath)
+		}
+		closeConverter(conv)
+		if epub2cbz.IsSkipped(err) {
+			if output != nil {
+				fmt.Fprintf(output, "Skipped %s: %v\n", sourcePath, err)
 			}
+		} else if err != nil {
+			stopProfiling()
+			log.Fatal(err)
 		}
 	}
-
-	fmt.Printf("Images extracted to %s\n", outputPath)
-	return nil
 }
 
-// extractImagesFromHTML extracts image paths from HTML content using XML parser
-func extractImagesFromXHTML(htmlContent string, pageHref string, srcs []string) []string {
-	doc, err := html.Parse(strings.NewReader(htmlContent))
+// newConverter prepares the conversions of the command line, exiting on
+// invalid options
+func newConverter(opts epub2cbz.Options) *epub2cbz.Converter {
+	conv, err := epub2cbz.NewConverter(opts)
 	if err != nil {
-		log.Printf("Error parsing HTML from %s: %v", pageHref, err)
-		return srcs
+		log.Fatal(err)
 	}
+	return conv
+}
 
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "img" {
-			for _, a := range n.Attr {
-				if a.Key == "src" {
-					imgPath := filepath.Join(filepath.Dir(pageHref), a.Val)
-					imgPath = filepath.ToSlash(imgPath)
-					imgPath = strings.TrimPrefix(imgPath, "/")
-					srcs = append(srcs, imgPath)
-					break
-				}
-			}
-		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
-		}
+// closeConverter saves the cache and the report once the conversions are done
+func closeConverter(conv *epub2cbz.Converter) {
+	if err := conv.Close(); err != nil {
+		log.Print(err)
 	}
-	f(doc)
-	return srcs
 }
 
-// normalizeImageName renames images with the format "pageX.extension"
-func normalizeImageName(originalName string, index int, totalFiles int) string {
-	// Extract file extension
-	ext := filepath.Ext(originalName)
-
-	// Calculate number of digits needed for total
-	totalDigits := len(strconv.Itoa(totalFiles))
-
-	// Create new name with prefix "page" + padded index
-	return fmt.Sprintf("page%0*d%s", totalDigits, index, ext)
+// batchEvents follows the books of a batch: they are shown on the progress
+// bar, or announced on output without it, and recorded in the JSON records
+// and the summary when not nil
+func batchEvents(output io.Writer, bar *progressBar, records *jsonOutput, summary *batchSummary) epub2cbz.Events {
+	events := epub2cbz.Events{
+		BatchStart: bar.startBatch,
+		FileStart: func(source string) {
+			if bar == nil && output != nil {
+				fmt.Fprintf(output, "Processing %s...\n", source)
+			}
+			bar.startFile(source)
+		},
+		FileDone: func(result epub2cbz.FileResult) {
+			bar.finishFile(result.Source)
+			if records != nil {
+				records.fileDone(result)
+			}
+			if summary != nil {
+				summary.fileDone(result)
+			}
+		},
+	}
+	if bar != nil {
+		events.Page = bar.addPage
+	}
+	return events
 }
 
-// addImageToZip adds an image from the EPUB to the output ZIP
-func addImageToZip(zipw *zip.Writer, zipReader *zip.ReadCloser, imgPath string, imageIndex int, total int) {
-	for _, f := range zipReader.File {
-		if f.Name == imgPath {
-			srcFile, err := f.Open()
-			if err != nil {
-				log.Printf("Error opening image %s: %v", imgPath, err)
-				return
-			}
-			defer srcFile.Close()
+// orDiscard returns w, or an output discarding everything when nil
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
 
-			// Create entry in ZIP
-			dstFile, err := zipw.Create(filepath.Base(normalizeImageName(imgPath, imageIndex, total)))
-			if err != nil {
-				log.Printf("Error creating entry in ZIP: %v", err)
-				return
-			}
+// errorsOnly drops the warnings written to a log, each write being a message
+type errorsOnly struct {
+	out io.Writer
+}
 
-			// Copy content
-			_, err = io.Copy(dstFile, srcFile)
-			if err != nil {
-				log.Printf("Error copying image %s: %v", imgPath, err)
-				return
-			}
-			return
-		}
+func (w errorsOnly) Write(message []byte) (int, error) {
+	if bytes.Contains(message, []byte("Warning: ")) {
+		return len(message), nil
 	}
-	log.Printf("Image not found in EPUB: %s", imgPath)
+	return w.out.Write(message)
 }
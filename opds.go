@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// runOPDS implements "epub2cbz opds <dir>": it writes an OPDS catalog of the
+// CBZ files of a directory, to be served by any static web server
+func runOPDS(args []string) int {
+	fs := flag.NewFlagSet("opds", flag.ExitOnError)
+	title := fs.String("title", "", "title of the catalog (default: name of the directory)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s opds [options] <dir>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nWrites an OPDS 1.2 acquisition feed of the CBZ files of a directory to %s.\n", epub2cbz.OPDSCatalogName)
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	if err := writeCatalog(os.Stdout, fs.Arg(0), *title); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// writeCatalog writes the OPDS catalog of a directory and reports it on
+// output
+func writeCatalog(output io.Writer, dir string, title string) error {
+	books, err := epub2cbz.WriteOPDSCatalog(dir, title, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Catalog of %d book(s) written to %s\n", books, filepath.Join(dir, epub2cbz.OPDSCatalogName))
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// runPack implements "epub2cbz pack <image_dir> [book.cbz]": it packs a
+// folder of loose images into a CBZ with the page names of the conversion,
+// and the metadata of its ComicInfo.xml sidecar and of the command line
+func runPack(args []string) int {
+	fs := flag.NewFlagSet("pack", flag.ExitOnError)
+	overrides := make(map[string]string)
+	fs.Func("set", "ComicInfo value written in the CBZ, as Field=value (repeatable), e.g. -set Series=Saga -set Number=2", func(value string) error {
+		return epub2cbz.ParseOverride(overrides, value)
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s pack [options] <image_dir> [book.cbz]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nPacks a folder of images into a CBZ, sorted by name with their numbers in numeric order\n")
+		fmt.Fprintf(os.Stderr, "and renamed page0, page1..., with the metadata of its ComicInfo.xml and of -set.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		return 2
+	}
+
+	target, count, err := epub2cbz.PackComic(fs.Arg(0), fs.Arg(1), overrides, nil)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	fmt.Printf("%d image(s) packed to %s\n", count, target)
+	return 0
+}
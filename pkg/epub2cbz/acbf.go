@@ -0,0 +1,216 @@
+package epub2cbz
+
+import (
+	"encoding/xml"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// acbfEntry is the name of the ACBF document in the archives; ACBF readers
+// open the first .acbf entry of a CBZ
+const acbfEntry = "book.acbf"
+
+// acbfGenres maps genres found in ComicInfo onto the closed list of ACBF
+var acbfGenres = map[string]string{
+	"science fiction": "science_fiction",
+	"sci-fi":          "science_fiction",
+	"fantasy":         "fantasy",
+	"adventure":       "adventure",
+	"horror":          "horror",
+	"mystery":         "mystery",
+	"crime":           "crime",
+	"war":             "military",
+	"military":        "military",
+	"slice of life":   "real_life",
+	"humor":           "humor",
+	"comedy":          "humor",
+	"western":         "western",
+	"superhero":       "superhero",
+	"romance":         "romance",
+	"history":         "history",
+	"historical":      "history",
+	"biography":       "biography",
+	"sports":          "sports",
+	"children":        "children",
+	"non-fiction":     "non-fiction",
+	"manga":           "manga",
+}
+
+// acbfActivities maps the ComicInfo credits onto ACBF author activities
+var acbfActivities = []struct {
+	activity string
+	people   func(info *ComicInfo) string
+}{
+	{"Writer", func(info *ComicInfo) string { return info.Writer }},
+	{"Penciller", func(info *ComicInfo) string { return info.Penciller }},
+	{"Inker", func(info *ComicInfo) string { return info.Inker }},
+	{"Colorist", func(info *ComicInfo) string { return info.Colorist }},
+	{"Letterer", func(info *ComicInfo) string { return info.Letterer }},
+	{"CoverArtist", func(info *ComicInfo) string { return info.CoverArtist }},
+	{"Editor", func(info *ComicInfo) string { return info.Editor }},
+	{"Translator", func(info *ComicInfo) string { return info.Translator }},
+}
+
+// acbfAuthor is an ACBF author: first and last names, or a nickname
+type acbfAuthor struct {
+	Activity  string `xml:"activity,attr,omitempty"`
+	FirstName string `xml:"first-name,omitempty"`
+	LastName  string `xml:"last-name,omitempty"`
+	Nickname  string `xml:"nickname,omitempty"`
+}
+
+// acbfImage references a page image of the archive
+type acbfImage struct {
+	Href string `xml:"href,attr"`
+}
+
+// acbfDate is a date shown as text with its ISO value
+type acbfDate struct {
+	Value string `xml:"value,attr,omitempty"`
+	Text  string `xml:",chardata"`
+}
+
+// acbfAnnotation is the summary of the book, by paragraph
+type acbfAnnotation struct {
+	Paragraphs []string `xml:"p"`
+}
+
+// acbfTextLayer is a language of the book, whose text is in the images
+type acbfTextLayer struct {
+	Lang string `xml:"lang,attr"`
+	Show string `xml:"show,attr"`
+}
+
+// acbfSequence is the series of the book and its number in it
+type acbfSequence struct {
+	Title  string `xml:"title,attr"`
+	Volume int    `xml:"volume,attr,omitempty"`
+	Number string `xml:",chardata"`
+}
+
+// acbfPage is a page of the ACBF body
+type acbfPage struct {
+	Title string    `xml:"title,omitempty"`
+	Image acbfImage `xml:"image"`
+}
+
+// acbfDocument is an Advanced Comic Book Format document (ACBF 1.1)
+type acbfDocument struct {
+	XMLName  xml.Name `xml:"ACBF"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	BookInfo struct {
+		Authors          []acbfAuthor    `xml:"author"`
+		Title            string          `xml:"book-title"`
+		Genres           []string        `xml:"genre"`
+		Annotation       *acbfAnnotation `xml:"annotation,omitempty"`
+		Cover            acbfImage       `xml:"coverpage>image"`
+		Languages        *acbfTextLayer  `xml:"languages>text-layer,omitempty"`
+		Sequence         *acbfSequence   `xml:"sequence,omitempty"`
+		ContentRating    string          `xml:"content-rating,omitempty"`
+		ReadingDirection string          `xml:"reading-direction,omitempty"`
+	} `xml:"meta-data>book-info"`
+	PublishInfo struct {
+		Publisher string    `xml:"publisher"`
+		Date      *acbfDate `xml:"publish-date,omitempty"`
+	} `xml:"meta-data>publish-info"`
+	DocumentInfo struct {
+		Authors []acbfAuthor `xml:"author"`
+		Created acbfDate     `xml:"creation-date"`
+		Source  string       `xml:"source>p"`
+		ID      string       `xml:"id"`
+		Version string       `xml:"version"`
+	} `xml:"meta-data>document-info"`
+	Pages []acbfPage `xml:"body>page"`
+}
+
+// acbfAuthors splits ", " separated credits into ACBF authors, the last
+// word of a name being the last name and one-word names nicknames
+func acbfAuthors(activity string, people string) []acbfAuthor {
+	var authors []acbfAuthor
+	for _, person := range strings.Split(people, ",") {
+		words := strings.Fields(person)
+		switch len(words) {
+		case 0:
+			continue
+		case 1:
+			authors = append(authors, acbfAuthor{Activity: activity, Nickname: words[0]})
+		default:
+			last := len(words) - 1
+			authors = append(authors, acbfAuthor{Activity: activity, FirstName: strings.Join(words[:last], " "), LastName: words[last]})
+		}
+	}
+	return authors
+}
+
+// createACBF builds the ACBF document of a converted book: the metadata of
+// its ComicInfo, the first page as cover and the others as body, titled
+// with the chapters starting on them
+func createACBF(info *ComicInfo, entries map[int]string, pages int, source string) *acbfDocument {
+	doc := &acbfDocument{Xmlns: "http://www.acbf.info/xml/acbf/1.1"}
+	book := &doc.BookInfo
+	for _, role := range acbfActivities {
+		book.Authors = append(book.Authors, acbfAuthors(role.activity, role.people(info))...)
+	}
+	book.Title = firstNonEmpty(info.Title, info.Series)
+	for _, genre := range strings.Split(info.Genre, ",") {
+		if mapped, ok := acbfGenres[strings.ToLower(strings.TrimSpace(genre))]; ok && !slices.Contains(book.Genres, mapped) {
+			book.Genres = append(book.Genres, mapped)
+		}
+	}
+	if strings.HasPrefix(info.Manga, "Yes") && !slices.Contains(book.Genres, "manga") {
+		book.Genres = append(book.Genres, "manga")
+	}
+	if len(book.Genres) == 0 {
+		book.Genres = []string{"other"}
+	}
+	for _, paragraph := range strings.Split(info.Summary, "\n") {
+		if paragraph = strings.TrimSpace(paragraph); paragraph != "" {
+			if book.Annotation == nil {
+				book.Annotation = &acbfAnnotation{}
+			}
+			book.Annotation.Paragraphs = append(book.Annotation.Paragraphs, paragraph)
+		}
+	}
+	book.Cover.Href = entries[0]
+	if info.LanguageISO != "" {
+		book.Languages = &acbfTextLayer{Lang: info.LanguageISO, Show: "False"}
+	}
+	if info.Series != "" {
+		book.Sequence = &acbfSequence{Title: info.Series, Volume: info.Volume, Number: firstNonEmpty(info.Number, strconv.Itoa(max(info.Volume, 1)))}
+	}
+	if info.AgeRating != "Unknown" {
+		book.ContentRating = info.AgeRating
+	}
+	if info.Manga == "YesAndRightToLeft" {
+		book.ReadingDirection = "RTL"
+	}
+
+	doc.PublishInfo.Publisher = info.Publisher
+	if date := comicInfoDate(info); date != "" {
+		// ACBF dates are full dates, completed with the first month and day
+		doc.PublishInfo.Date = &acbfDate{Value: date + "-01-01"[len(date)-4:], Text: strconv.Itoa(info.Year)}
+	}
+
+	document := &doc.DocumentInfo
+	document.Authors = []acbfAuthor{{Nickname: "epub2cbz"}}
+	now := time.Now()
+	document.Created = acbfDate{Value: now.Format(time.DateOnly), Text: now.Format(time.DateOnly)}
+	document.Source = source
+	document.ID = strings.TrimPrefix(epubIdentifier(), "urn:uuid:")
+	document.Version = "1.0"
+
+	bookmarks := make(map[int]string)
+	if info.Pages != nil {
+		for _, page := range info.Pages.Page {
+			bookmarks[page.Image] = page.Bookmark
+		}
+	}
+	for i := 1; i < pages; i++ {
+		if name, ok := entries[i]; ok {
+			doc.Pages = append(doc.Pages, acbfPage{Title: bookmarks[i], Image: acbfImage{Href: name}})
+		}
+	}
+	return doc
+}
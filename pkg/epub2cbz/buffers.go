@@ -0,0 +1,56 @@
+package epub2cbz
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+const (
+	copyBufferSize   = 256 << 10 // chunk size used when copying entries
+	outputBufferSize = 1 << 20   // write buffer of the output file
+	maxPooledBuffer  = 64 << 20  // larger entry buffers are left to the GC
+)
+
+// copyBufferPool holds the chunks used by io.CopyBuffer, so batch
+// conversions don't allocate a new one for every image
+var copyBufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
+}
+
+// entryBufferPool holds the buffers receiving whole entries
+var entryBufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// getEntryBuffer returns an empty buffer from the pool
+func getEntryBuffer() *bytes.Buffer {
+	buf := entryBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// releaseEntryBuffer returns a buffer to the pool once its content is written
+func releaseEntryBuffer(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > maxPooledBuffer {
+		return
+	}
+	entryBufferPool.Put(buf)
+}
+
+// readAllPooled reads r into a pooled buffer, which must be released with releaseEntryBuffer
+func readAllPooled(r io.Reader) (*bytes.Buffer, error) {
+	buf := getEntryBuffer()
+	chunk := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(chunk)
+	if _, err := io.CopyBuffer(buf, r, *chunk); err != nil {
+		releaseEntryBuffer(buf)
+		return nil, err
+	}
+	return buf, nil
+}
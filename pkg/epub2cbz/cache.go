@@ -0,0 +1,239 @@
+package epub2cbz
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// conversionCache remembers the EPUBs already converted, keyed by the hash
+// of their content and the fingerprint of the options, so repeated batch runs
+// skip unchanged books even when their outputs were moved or renamed
+type conversionCache struct {
+	path  string
+	mutex sync.Mutex
+	data  cacheData
+	dirty bool
+}
+
+type cacheData struct {
+	// Conversions keyed by "<content hash>:<options fingerprint>"
+	Conversions map[string]cacheConversion `json:"conversions"`
+	// Content hashes keyed by absolute path, valid while size and time match,
+	// so unchanged files are not hashed again on every run
+	Files map[string]cacheFile `json:"files"`
+}
+
+type cacheConversion struct {
+	Source    string    `json:"source"`
+	Output    string    `json:"output"`
+	Converted time.Time `json:"converted"`
+}
+
+type cacheFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+}
+
+// skippedError reports a file that was deliberately not converted
+type skippedError struct {
+	reason string
+}
+
+func (e *skippedError) Error() string {
+	return e.reason
+}
+
+// IsSkipped reports whether an error only means the file was skipped
+func IsSkipped(err error) bool {
+	var skipped *skippedError
+	return errors.As(err, &skipped)
+}
+
+// loadConversionCache reads the cache file, starting empty when it doesn't exist yet
+func loadConversionCache(path string) (*conversionCache, error) {
+	cache := &conversionCache{path: path}
+	content, err := os.ReadFile(longPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading cache: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &cache.data); err != nil {
+			return nil, fmt.Errorf("error decoding cache %s: %w", path, err)
+		}
+	}
+	if cache.data.Conversions == nil {
+		cache.data.Conversions = make(map[string]cacheConversion)
+	}
+	if cache.data.Files == nil {
+		cache.data.Files = make(map[string]cacheFile)
+	}
+	return cache, nil
+}
+
+// save writes the cache back if it changed
+func (c *conversionCache) save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	if err := writeJSONFile(c.path, &c.data); err != nil {
+		return fmt.Errorf("error writing cache: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// writeJSONFile writes v as indented JSON to path, through a temporary file
+// so an interrupted write never corrupts it
+func writeJSONFile(path string, v any) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	partPath := path + ".part"
+	if err := os.WriteFile(longPath(partPath), content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(longPath(partPath), longPath(path))
+}
+
+// key returns the cache key of an EPUB converted with the given options
+func (c *conversionCache) key(epubPath string, opts Options) (string, error) {
+	absPath, err := filepath.Abs(epubPath)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(longPath(epubPath))
+	if err != nil {
+		return "", err
+	}
+
+	c.mutex.Lock()
+	file, known := c.data.Files[absPath]
+	c.mutex.Unlock()
+	if !known || file.Size != info.Size() || !file.ModTime.Equal(info.ModTime()) {
+		hash, err := hashFile(epubPath)
+		if err != nil {
+			return "", err
+		}
+		file = cacheFile{Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+		c.mutex.Lock()
+		c.data.Files[absPath] = file
+		c.dirty = true
+		c.mutex.Unlock()
+	}
+	return file.Hash + ":" + optionsFingerprint(opts), nil
+}
+
+// lookup returns the previous conversion recorded under key
+func (c *conversionCache) lookup(key string) (cacheConversion, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	conversion, ok := c.data.Conversions[key]
+	return conversion, ok
+}
+
+// record remembers a successful conversion
+func (c *conversionCache) record(key string, epubPath string, outputPath string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.data.Conversions[key] = cacheConversion{Source: epubPath, Output: outputPath, Converted: time.Now()}
+	c.dirty = true
+}
+
+// hashFile returns the SHA-256 of a file content
+func hashFile(path string) (string, error) {
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	chunk := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(chunk)
+	if _, err := io.CopyBuffer(hash, f, *chunk); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// optionsFingerprint hashes the options changing the content of the output,
+// so a conversion done with other settings is not mistaken for a cached one
+func optionsFingerprint(opts Options) string {
+	settings, _ := json.Marshal(struct {
+		Version        string
+		Compression    string
+		StrictMetadata bool
+		PreserveTimes  bool
+		FromCalibre    bool
+		ComicTagger    bool
+		Overrides      map[string]string
+		SplitChapters  bool
+		SplitVolumes   bool
+		TOCPage        bool
+		TitlePage      string
+		Watermark      string
+		WatermarkStyle string
+		Reverse        bool
+		NoCover        bool
+		Backmatter     bool
+		PageOffset     int
+		KeepStructure  bool
+		Format         string
+		Mappings       enumMappings
+		PDF            bool
+		PDFOnly        bool
+		ExtractDir     bool
+		SplitSpreads   bool
+		SplitOrder     string
+		ParseFilename  string
+		ComicVine      bool
+		MangaMetadata  string
+		ComicBookInfo  bool
+		Metadata       string
+	}{
+		Version:        Version(),
+		Compression:    opts.Compression,
+		StrictMetadata: opts.StrictMetadata,
+		PreserveTimes:  opts.PreserveTimes,
+		FromCalibre:    opts.Calibre != "",
+		ComicTagger:    opts.ComicTagger,
+		Overrides:      opts.Overrides,
+		SplitChapters:  opts.SplitChapters,
+		SplitVolumes:   opts.SplitVolumes,
+		TOCPage:        opts.TOCPage,
+		TitlePage:      opts.TitlePage,
+		Watermark:      opts.Watermark,
+		WatermarkStyle: opts.WatermarkStyle,
+		Reverse:        opts.Reverse,
+		NoCover:        opts.NoCover,
+		Backmatter:     opts.StripBackmatter,
+		PageOffset:     opts.PageOffset,
+		KeepStructure:  opts.KeepStructure,
+		Format:         opts.Format,
+		Mappings:       opts.mappings,
+		PDF:            opts.PDF,
+		PDFOnly:        opts.PDFOnly,
+		ExtractDir:     opts.ExtractDir,
+		SplitSpreads:   opts.SplitSpreads,
+		SplitOrder:     opts.SplitOrder,
+		ParseFilename:  opts.ParseFilename,
+		ComicVine:      opts.ComicVineKey != "",
+		MangaMetadata:  opts.MangaMetadata,
+		ComicBookInfo:  opts.ComicBookInfo,
+		Metadata:       opts.Metadata,
+	})
+	hash := sha256.Sum256(settings)
+	return hex.EncodeToString(hash[:8])
+}
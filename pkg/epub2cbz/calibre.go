@@ -0,0 +1,105 @@
+package epub2cbz
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// calibreOPF is the name of the metadata file Calibre keeps next to the
+// formats of each book of a library
+const calibreOPF = "metadata.opf"
+
+// calibreBookID matches the id Calibre appends to book folder names, "Title (42)"
+var calibreBookID = regexp.MustCompile(`\((\d+)\)$`)
+
+// readCalibreMetadata reads the metadata.opf Calibre keeps next to an EPUB.
+// It returns false when the book has none, e.g. outside a Calibre library.
+func readCalibreMetadata(epubPath string) (Metadata, bool, error) {
+	data, err := os.ReadFile(longPath(filepath.Join(filepath.Dir(epubPath), calibreOPF)))
+	if errors.Is(err, os.ErrNotExist) {
+		return Metadata{}, false, nil
+	}
+	if err != nil {
+		return Metadata{}, false, fmt.Errorf("error reading Calibre metadata: %w", err)
+	}
+
+	var pkg Package
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		return Metadata{}, false, fmt.Errorf("error parsing Calibre metadata: %w", err)
+	}
+	return pkg.Metadata, true, nil
+}
+
+// formatSeriesIndex writes a Calibre series index without its useless
+// fraction, 3.0 becomes 3 while 3.5 is kept
+func formatSeriesIndex(index string) string {
+	value, err := strconv.ParseFloat(index, 64)
+	if err != nil {
+		return index
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// mergeCalibreMetadata overrides the metadata of an EPUB with the values of
+// the Calibre library, which are the ones users curate
+func mergeCalibreMetadata(epubPath string, metadata Metadata) (Metadata, error) {
+	calibre, ok, err := readCalibreMetadata(epubPath)
+	if err != nil || !ok {
+		return metadata, err
+	}
+
+	override := func(dst *[]string, src []string) {
+		if len(src) > 0 {
+			*dst = src
+		}
+	}
+	override(&metadata.Identifier, calibre.Identifier)
+	override(&metadata.Title, calibre.Title)
+	override(&metadata.Language, calibre.Language)
+	override(&metadata.Creator, calibre.Creator)
+	if len(calibre.Credits) > 0 {
+		metadata.Credits = calibre.Credits
+	}
+	override(&metadata.Publisher, calibre.Publisher)
+	override(&metadata.Date, calibre.Date)
+	override(&metadata.Rights, calibre.Rights)
+	override(&metadata.Description, calibre.Description)
+	override(&metadata.Series, calibre.Series)
+	override(&metadata.SeriesID, calibre.SeriesID)
+	override(&metadata.Number, calibre.Number)
+	override(&metadata.Subject, calibre.Subject)
+
+	if len(calibre.Meta) > 0 {
+		merged := make(map[string]string, len(metadata.Meta)+len(calibre.Meta))
+		for name, content := range metadata.Meta {
+			merged[name] = content
+		}
+		for name, content := range calibre.Meta {
+			merged[name] = content
+		}
+		metadata.Meta = merged
+	}
+	return metadata, nil
+}
+
+// addCalibreFormat adds a converted CBZ to its book in the Calibre library
+// with calibredb, so it shows up as a new format of the book
+func addCalibreFormat(library string, epubPath string, cbzPath string) error {
+	match := calibreBookID.FindStringSubmatch(filepath.Base(filepath.Dir(epubPath)))
+	if match == nil {
+		return fmt.Errorf("error adding CBZ to Calibre: no book id in folder name %q", filepath.Dir(epubPath))
+	}
+
+	output, err := exec.Command("calibredb", "add_format", "--with-library", library, match[1], cbzPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error adding CBZ to Calibre: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// readingList is a ComicRack reading list (.cbl)
+type readingList struct {
+	XMLName   xml.Name          `xml:"ReadingList"`
+	XmlnsXSD  string            `xml:"xmlns:xsd,attr"`
+	XmlnsXSI  string            `xml:"xmlns:xsi,attr"`
+	Name      string            `xml:"Name"`
+	NumIssues int               `xml:"NumIssues"`
+	Books     []readingListBook `xml:"Books>Book"`
+}
+
+// readingListBook identifies a book the way ComicRack, Kavita and Komga match
+// reading list entries: by series, number, volume and year
+type readingListBook struct {
+	Series   string `xml:"Series,attr"`
+	Number   string `xml:"Number,attr"`
+	Volume   string `xml:"Volume,attr,omitempty"`
+	Year     string `xml:"Year,attr,omitempty"`
+	FileName string `xml:"FileName,attr,omitempty"`
+
+	volume int
+	number float64
+}
+
+// WriteReadingList writes a reading list of every CBZ found under dir, in
+// series order: series, volume then number, and returns the number of books
+// listed. The books that can't be listed are logged to logger, nil for the
+// standard logger.
+func WriteReadingList(listPath string, dir string, logger *log.Logger) (int, error) {
+	logger = loggerOrDefault(logger)
+	var books []readingListBook
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".cbz") {
+			return nil
+		}
+		book, err := readingListEntry(path, filepath.Dir(listPath), logger)
+		if err != nil {
+			logger.Printf("Error adding %s to the reading list: %v", path, err)
+			return nil
+		}
+		books = append(books, book)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading reading list directory: %w", err)
+	}
+
+	sort.SliceStable(books, func(i, j int) bool {
+		a, b := books[i], books[j]
+		if a.Series != b.Series {
+			return a.Series < b.Series
+		}
+		if a.volume != b.volume {
+			return a.volume < b.volume
+		}
+		if a.number != b.number {
+			return a.number < b.number
+		}
+		return a.FileName < b.FileName
+	})
+
+	name := strings.TrimSuffix(filepath.Base(listPath), filepath.Ext(listPath))
+	list := readingList{
+		XmlnsXSD:  "http://www.w3.org/2001/XMLSchema",
+		XmlnsXSI:  "http://www.w3.org/2001/XMLSchema-instance",
+		Name:      name,
+		NumIssues: len(books),
+		Books:     books,
+	}
+	data, err := xml.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling reading list: %w", err)
+	}
+	if err := os.WriteFile(longPath(listPath), append([]byte(xml.Header), data...), 0644); err != nil {
+		return 0, fmt.Errorf("error writing reading list: %w", err)
+	}
+	return len(books), nil
+}
+
+// readingListEntry describes a CBZ from its ComicInfo.xml. Books without
+// series metadata are listed under their title, as one-shots.
+func readingListEntry(book string, listDir string, logger *log.Logger) (readingListBook, error) {
+	zipReader, err := zip.OpenReader(longPath(book))
+	if err != nil {
+		return readingListBook{}, fmt.Errorf("error opening CBZ file: %w", err)
+	}
+	defer zipReader.Close()
+
+	var comicInfo ComicInfo
+	if f := findZipEntry(zipReader.File, "ComicInfo.xml"); f != nil {
+		if err := readZipXML(f, &comicInfo); err != nil {
+			logger.Printf("Warning: %s: invalid ComicInfo.xml: %v", book, err)
+		}
+	}
+
+	baseName := strings.TrimSuffix(filepath.Base(book), filepath.Ext(book))
+	entry := readingListBook{
+		Series: firstNonEmpty(comicInfo.Series, comicInfo.Title, baseName),
+		Number: firstNonEmpty(comicInfo.Number, "1"),
+		volume: comicInfo.Volume,
+	}
+	entry.number, _ = strconv.ParseFloat(entry.Number, 64)
+	if comicInfo.Volume > 0 {
+		entry.Volume = strconv.Itoa(comicInfo.Volume)
+	}
+	if comicInfo.Year > 0 {
+		entry.Year = strconv.Itoa(comicInfo.Year)
+	}
+	if rel, err := filepath.Rel(listDir, book); err == nil {
+		entry.FileName = filepath.ToSlash(rel)
+	}
+	return entry, nil
+}
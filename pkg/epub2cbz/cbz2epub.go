@@ -0,0 +1,447 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// comicPage is a page image of a CBZ or of a folder of images
+type comicPage struct {
+	name string // path in the archive or the folder
+	open func() (io.ReadCloser, error)
+}
+
+// epubPage is a page written to a fixed-layout EPUB
+type epubPage struct {
+	id        string
+	page      string // XHTML document, relative to the OPF
+	image     string // image, relative to the OPF
+	mediaType string
+}
+
+// comicRoles are the ComicInfo credits written as EPUB creators, with their
+// MARC relator code. The main creators are dc:creator, the others dc:contributor.
+var comicRoles = []struct {
+	field   func(*ComicInfo) string
+	code    string
+	element string
+}{
+	{func(c *ComicInfo) string { return c.Writer }, "aut", "creator"},
+	{func(c *ComicInfo) string { return c.Penciller }, "art", "creator"},
+	{func(c *ComicInfo) string { return c.Inker }, "ctb", "contributor"},
+	{func(c *ComicInfo) string { return c.Colorist }, "clr", "contributor"},
+	{func(c *ComicInfo) string { return c.Letterer }, "ctb", "contributor"},
+	{func(c *ComicInfo) string { return c.CoverArtist }, "cov", "contributor"},
+	{func(c *ComicInfo) string { return c.Editor }, "edt", "contributor"},
+	{func(c *ComicInfo) string { return c.Translator }, "trl", "contributor"},
+}
+
+// ComicToEPUB makes a fixed-layout EPUB 3 of a CBZ or of a folder of images,
+// with the metadata of its ComicInfo.xml: the reverse of the conversion. The
+// EPUB is written to target, or next to the source when empty, and read from
+// right to left with rtl or for manga marked YesAndRightToLeft. It returns
+// the path of the EPUB. The warnings are logged to logger, nil for the
+// standard logger.
+func ComicToEPUB(source string, target string, rtl bool, logger *log.Logger) (string, error) {
+	pages, info, closeComic, err := openComic(source, loggerOrDefault(logger))
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %w", source, err)
+	}
+	defer closeComic()
+	if len(pages) == 0 {
+		return "", fmt.Errorf("error reading %s: no images found", source)
+	}
+
+	name := strings.TrimRight(source, `/\`)
+	if strings.EqualFold(filepath.Ext(name), ".cbz") {
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	if target == "" {
+		target = name + ".epub"
+	}
+	if info.Title == "" && info.Series == "" {
+		info.Title = filepath.Base(name)
+	}
+	if err := checkOutputPath(target, []string{source}); err != nil {
+		return "", err
+	}
+
+	if err := writeFixedLayoutEPUB(target, pages, info, rtl || info.Manga == "YesAndRightToLeft"); err != nil {
+		return "", fmt.Errorf("error writing %s: %w", target, err)
+	}
+	return target, nil
+}
+
+// openComic returns the pages of a CBZ or of a folder of images in reading
+// order, and its ComicInfo.xml, empty when missing. The returned function
+// closes the archive.
+func openComic(source string, logger *log.Logger) ([]comicPage, *ComicInfo, func(), error) {
+	info := &ComicInfo{}
+	stat, err := os.Stat(longPath(source))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var pages []comicPage
+	if !stat.IsDir() {
+		reader, err := zip.OpenReader(longPath(source))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error opening CBZ file: %w", err)
+		}
+		for _, f := range reader.File {
+			if isImageName(f.Name) && !isHiddenPath(f.Name) {
+				pages = append(pages, comicPage{name: f.Name, open: f.Open})
+			}
+		}
+		if f := findZipEntry(reader.File, "ComicInfo.xml"); f != nil {
+			if err := readZipXML(f, info); err != nil {
+				logger.Printf("Warning: %s: invalid ComicInfo.xml: %v", source, err)
+			}
+		}
+		sortComicPages(pages)
+		return pages, info, func() { reader.Close() }, nil
+	}
+
+	err = filepath.WalkDir(longPath(source), func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(longPath(source), p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if d.IsDir() {
+			if name != "." && isHiddenPath(name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isImageName(name) && !isHiddenPath(name) {
+			pages = append(pages, comicPage{name: name, open: func() (io.ReadCloser, error) { return os.Open(p) }})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error reading directory: %w", err)
+	}
+	if data, err := os.ReadFile(longPath(filepath.Join(source, "ComicInfo.xml"))); err == nil {
+		if err := xml.Unmarshal(data, info); err != nil {
+			logger.Printf("Warning: %s: invalid ComicInfo.xml: %v", source, err)
+		}
+	}
+	sortComicPages(pages)
+	return pages, info, func() {}, nil
+}
+
+// isHiddenPath reports whether a path is in a hidden file or folder, like
+// the __MACOSX folder and the ._ files of archives made on macOS
+func isHiddenPath(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") || segment == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// sortComicPages sorts pages by path, with their numbers in numeric order
+func sortComicPages(pages []comicPage) {
+	slices.SortStableFunc(pages, func(a, b comicPage) int { return compareNatural(a.name, b.name) })
+}
+
+// compareNatural compares two names ignoring case, with their numbers in
+// numeric order, so "page2.jpg" comes before "page10.jpg"
+func compareNatural(a string, b string) int {
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			i, j := 0, 0
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			x, y := strings.TrimLeft(a[:i], "0"), strings.TrimLeft(b[:j], "0")
+			if c := cmp.Or(cmp.Compare(len(x), len(y)), strings.Compare(x, y)); c != 0 {
+				return c
+			}
+			a, b = a[i:], b[j:]
+			continue
+		}
+		ra, sizeA := utf8.DecodeRuneInString(a)
+		rb, sizeB := utf8.DecodeRuneInString(b)
+		if c := cmp.Compare(unicode.ToLower(ra), unicode.ToLower(rb)); c != 0 {
+			return c
+		}
+		a, b = a[sizeA:], b[sizeB:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+// isDigit reports whether a byte is an ASCII digit
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// writeFixedLayoutEPUB writes the pages of a comic as a pre-paginated EPUB 3,
+// one image per page sized to the image
+func writeFixedLayoutEPUB(target string, pages []comicPage, info *ComicInfo, rtl bool) error {
+	output, err := createOutput(target)
+	if err != nil {
+		return err
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			output.abort()
+		}
+	}()
+	buffer := bufio.NewWriterSize(output, outputBufferSize)
+	zipw := zip.NewWriter(buffer)
+
+	// The mimetype entry comes first and uncompressed, readers identify EPUB files by it
+	entries := []struct {
+		name string
+		data string
+	}{
+		{"mimetype", "application/epub+zip"},
+		{"META-INF/container.xml", `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`},
+	}
+	for _, entry := range entries {
+		if err := writeEPUBEntry(zipw, entry.name, []byte(entry.data), zip.Store); err != nil {
+			return err
+		}
+	}
+
+	written := make([]epubPage, 0, len(pages))
+	for i, page := range pages {
+		data, err := readComicPage(page)
+		if err != nil {
+			return err
+		}
+		mediaType := sniffImageType(data)
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if mediaType == "" || err != nil {
+			return fmt.Errorf("error reading %s: not a supported image", page.name)
+		}
+		p := epubPage{
+			id:        "page" + strconv.Itoa(i),
+			page:      normalizeImageName(".xhtml", i, len(pages)),
+			image:     "images/" + normalizeImageName(imageExtensions[mediaType], i, len(pages)),
+			mediaType: mediaType,
+		}
+		if err := writeEPUBEntry(zipw, "OEBPS/"+p.image, data, zip.Store); err != nil {
+			return err
+		}
+		document := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml">
+<head>
+<title>Page %d</title>
+<meta name="viewport" content="width=%d, height=%d"/>
+<style>html, body { margin: 0; padding: 0; } img { display: block; width: 100%%; height: 100%%; }</style>
+</head>
+<body><img src="%s" alt=""/></body>
+</html>
+`, i+1, config.Width, config.Height, p.image)
+		if err := writeEPUBEntry(zipw, "OEBPS/"+p.page, []byte(document), zip.Deflate); err != nil {
+			return err
+		}
+		written = append(written, p)
+	}
+
+	if err := writeEPUBEntry(zipw, "OEBPS/nav.xhtml", []byte(epubNav(written, info)), zip.Deflate); err != nil {
+		return err
+	}
+	if err := writeEPUBEntry(zipw, "OEBPS/content.opf", []byte(epubPackage(written, info, rtl)), zip.Deflate); err != nil {
+		return err
+	}
+
+	if err := zipw.Close(); err != nil {
+		return fmt.Errorf("error closing ZIP writer: %w", err)
+	}
+	if err := buffer.Flush(); err != nil {
+		return fmt.Errorf("error writing ZIP file: %w", err)
+	}
+	if err := output.commit(); err != nil {
+		return err
+	}
+	completed = true
+	return nil
+}
+
+// readComicPage reads the image of a page
+func readComicPage(page comicPage) ([]byte, error) {
+	r, err := page.open()
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", page.name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", page.name, err)
+	}
+	return data, nil
+}
+
+// writeEPUBEntry writes an entry of an EPUB
+func writeEPUBEntry(zipw *zip.Writer, name string, data []byte, method uint16) error {
+	w, err := zipw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Now()})
+	if err != nil {
+		return fmt.Errorf("error creating %s in ZIP: %w", name, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("error writing %s to ZIP: %w", name, err)
+	}
+	return nil
+}
+
+// epubNav returns the navigation document of the EPUB: the bookmarks of the
+// ComicInfo pages, or the first page under the title of the book
+func epubNav(pages []epubPage, info *ComicInfo) string {
+	var entries strings.Builder
+	if info.Pages != nil {
+		for _, page := range info.Pages.Page {
+			if page.Bookmark != "" && page.Image >= 0 && page.Image < len(pages) {
+				fmt.Fprintf(&entries, "      <li><a href=\"%s\">%s</a></li>\n", pages[page.Image].page, xmlText(page.Bookmark))
+			}
+		}
+	}
+	title := xmlText(firstNonEmpty(info.Title, info.Series))
+	if entries.Len() == 0 {
+		fmt.Fprintf(&entries, "      <li><a href=\"%s\">%s</a></li>\n", pages[0].page, title)
+	}
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head>
+<title>%s</title>
+</head>
+<body>
+  <nav epub:type="toc" id="toc">
+    <ol>
+%s    </ol>
+  </nav>
+</body>
+</html>
+`, title, entries.String())
+}
+
+// epubPackage returns the OPF of the EPUB, its metadata mapped from ComicInfo
+func epubPackage(pages []epubPage, info *ComicInfo, rtl bool) string {
+	var metadata strings.Builder
+	element := func(name string, value string, attrs string) {
+		if strings.TrimSpace(value) != "" {
+			fmt.Fprintf(&metadata, "    <dc:%s%s>%s</dc:%s>\n", name, attrs, xmlText(strings.TrimSpace(value)), name)
+		}
+	}
+	element("identifier", epubIdentifier(), ` id="book-id"`)
+	if isbn := bookGTIN([]string{info.GTIN}); isbn != "" {
+		element("identifier", isbnURN+isbn, "")
+	}
+	title := info.Title
+	if title == "" {
+		title = strings.TrimSpace(info.Series + " " + info.Number)
+	}
+	element("title", title, "")
+	element("language", firstNonEmpty(info.LanguageISO, "und"), "")
+	creators := 0
+	for _, role := range comicRoles {
+		for _, name := range strings.Split(role.field(info), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				creators++
+				id := fmt.Sprintf("creator%d", creators)
+				element(role.element, name, fmt.Sprintf(` id="%s"`, id))
+				fmt.Fprintf(&metadata, "    <meta refines=\"#%s\" property=\"role\" scheme=\"marc:relators\">%s</meta>\n", id, role.code)
+			}
+		}
+	}
+	element("publisher", info.Publisher, "")
+	element("description", info.Summary, "")
+	for _, genre := range strings.Split(info.Genre, ",") {
+		element("subject", genre, "")
+	}
+	element("date", comicInfoDate(info), "")
+	if info.Series != "" {
+		// EPUB 3 collections, and the Calibre metadata most readers still use
+		fmt.Fprintf(&metadata, "    <meta property=\"belongs-to-collection\" id=\"series\">%s</meta>\n", xmlText(info.Series))
+		fmt.Fprintf(&metadata, "    <meta refines=\"#series\" property=\"collection-type\">series</meta>\n")
+		if info.Number != "" {
+			fmt.Fprintf(&metadata, "    <meta refines=\"#series\" property=\"group-position\">%s</meta>\n", xmlText(info.Number))
+		}
+		fmt.Fprintf(&metadata, "    <meta name=\"calibre:series\" content=\"%s\"/>\n", xmlText(info.Series))
+		if _, err := strconv.ParseFloat(info.Number, 64); err == nil {
+			fmt.Fprintf(&metadata, "    <meta name=\"calibre:series_index\" content=\"%s\"/>\n", xmlText(info.Number))
+		}
+	}
+	fmt.Fprintf(&metadata, "    <meta property=\"dcterms:modified\">%s</meta>\n", time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	fmt.Fprintf(&metadata, "    <meta property=\"rendition:layout\">pre-paginated</meta>\n")
+	fmt.Fprintf(&metadata, "    <meta property=\"rendition:spread\">landscape</meta>\n")
+	fmt.Fprintf(&metadata, "    <meta name=\"cover\" content=\"img0\"/>\n")
+
+	var manifest, spine strings.Builder
+	fmt.Fprintf(&manifest, "    <item id=\"nav\" href=\"nav.xhtml\" media-type=\"application/xhtml+xml\" properties=\"nav\"/>\n")
+	for i, page := range pages {
+		properties := ""
+		if i == 0 {
+			properties = ` properties="cover-image"`
+		}
+		fmt.Fprintf(&manifest, "    <item id=\"img%d\" href=\"%s\" media-type=\"%s\"%s/>\n", i, page.image, page.mediaType, properties)
+		fmt.Fprintf(&manifest, "    <item id=\"%s\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", page.id, page.page)
+		fmt.Fprintf(&spine, "    <itemref idref=\"%s\"/>\n", page.id)
+	}
+	direction := "ltr"
+	if rtl {
+		direction = "rtl"
+	}
+
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="book-id" prefix="rendition: http://www.idpf.org/vocab/rendition/#">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+%s  </metadata>
+  <manifest>
+%s  </manifest>
+  <spine page-progression-direction="%s">
+%s  </spine>
+</package>
+`, metadata.String(), manifest.String(), direction, spine.String())
+}
+
+// epubIdentifier returns a random UUID identifying a new EPUB
+func epubIdentifier() string {
+	var id [16]byte
+	rand.Read(id[:])
+	id[6] = id[6]&0x0f | 0x40 // version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// xmlText escapes a text for XML content and attribute values
+func xmlText(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
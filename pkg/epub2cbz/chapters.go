@@ -0,0 +1,583 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// chapter is a chapter of a book, starting at a page of the spine
+type chapter struct {
+	Title string
+	Page  int // first spine page
+	Image int // first image of the CBZ, set once the images are written
+
+	Volume int // volume number, for the volumes of an omnibus
+}
+
+// ncxNavPoint is an entry of an EPUB 2 NCX table of contents
+type ncxNavPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Children []ncxNavPoint `xml:"navPoint"`
+}
+
+// tocEntry is an entry of the table of contents of a book
+type tocEntry struct {
+	Title string
+	Page  int // spine page the entry points to
+	Level int // nesting level, 0 for top-level entries
+}
+
+// readTOC reads the table of contents, from the EPUB 3 navigation document
+// or the EPUB 2 NCX when the navigation document has no usable chapters.
+// Entries pointing outside of the spine are dropped.
+func readTOC(index archiveIndex, pkg *Package, opfPath string, pages []string) []tocEntry {
+	pageIndex := make(map[string]int, len(pages))
+	for i, page := range pages {
+		pageIndex[page] = i
+	}
+
+	var entries []tocEntry
+	add := func(docHref string, title string, href string, level int) {
+		href, _, _ = strings.Cut(href, "#")
+		title = strings.Join(strings.Fields(title), " ")
+		if href == "" || title == "" {
+			return
+		}
+		if page, ok := pageIndex[resolveImagePath(docHref, href)]; ok {
+			entries = append(entries, tocEntry{Title: title, Page: page, Level: level})
+		}
+	}
+
+	for _, item := range pkg.Manifest.Items {
+		if !hasProperty(item.Properties, "nav") {
+			continue
+		}
+		navHref := resolveImagePath(opfPath, item.Href)
+		if content, err := readArchiveFile(index, navHref); err == nil {
+			for _, entry := range navEntries(content) {
+				add(navHref, entry.Title, entry.href, entry.Level)
+			}
+		}
+	}
+
+	if tocChapters(entries) == nil && pkg.Spine.Toc != "" {
+		entries = nil
+		for _, item := range pkg.Manifest.Items {
+			if item.ID != pkg.Spine.Toc {
+				continue
+			}
+			ncxHref := resolveImagePath(opfPath, item.Href)
+			content, err := readArchiveFile(index, ncxHref)
+			if err != nil {
+				break
+			}
+			var ncx struct {
+				NavPoints []ncxNavPoint `xml:"navMap>navPoint"`
+			}
+			if err := xml.Unmarshal(content, &ncx); err != nil {
+				break
+			}
+			var walk func(points []ncxNavPoint, level int)
+			walk = func(points []ncxNavPoint, level int) {
+				for _, point := range points {
+					add(ncxHref, point.Label, point.Content.Src, level)
+					walk(point.Children, level+1)
+				}
+			}
+			walk(ncx.NavPoints, 0)
+		}
+	}
+	return entries
+}
+
+// tocChapters returns the chapters of a table of contents. Entries pointing
+// to the same page as a previous one, like sections of a chapter, are
+// dropped. A table of contents with less than two chapters is not usable and
+// nil is returned.
+func tocChapters(entries []tocEntry) []chapter {
+	var chapters []chapter
+	seen := make(map[int]bool)
+	for _, entry := range entries {
+		if !seen[entry.Page] {
+			seen[entry.Page] = true
+			chapters = append(chapters, chapter{Title: entry.Title, Page: entry.Page})
+		}
+	}
+	if len(chapters) < 2 {
+		return nil
+	}
+	return chapters
+}
+
+// volumeTitle matches the titles of volume entries, like "Vol. 2" or "Tome 3"
+var volumeTitle = regexp.MustCompile(`(?i)\b(?:vol(?:ume)?\.?|tome|band|book)\s*(\d+)`)
+
+// tocVolumes returns the volumes of an omnibus from its table of contents:
+// the top-level entries named like volumes, or holding nested chapters. The
+// volume number comes from the title, or from the position of the entry.
+// Less than two volumes make a single book and nil is returned.
+func tocVolumes(entries []tocEntry) []chapter {
+	var volumes []chapter
+	for i, entry := range entries {
+		if entry.Level != 0 {
+			continue
+		}
+		match := volumeTitle.FindStringSubmatch(entry.Title)
+		nested := i+1 < len(entries) && entries[i+1].Level > 0
+		if match == nil && !nested {
+			continue
+		}
+		number := len(volumes) + 1
+		if match != nil {
+			number, _ = strconv.Atoi(match[1])
+		}
+		if len(volumes) > 0 && volumes[len(volumes)-1].Page >= entry.Page {
+			continue
+		}
+		volumes = append(volumes, chapter{Title: entry.Title, Page: entry.Page, Volume: number})
+	}
+	if len(volumes) < 2 {
+		return nil
+	}
+	return volumes
+}
+
+// navEntries returns the links of the "toc" nav element of an EPUB 3
+// navigation document, with their nesting level in the lists. The href
+// field holds the link target, relative to the document.
+func navEntries(content []byte) []navEntry {
+	var entries []navEntry
+	tokenizer := html.NewTokenizer(bytes.NewReader(content))
+	inTOC := false
+	depth := 0
+	var href string
+	var text strings.Builder
+	inLink := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return entries
+		case html.StartTagToken:
+			name, _ := tokenizer.TagName()
+			attrs := tagAttrs(tokenizer)
+			switch {
+			case string(name) == "nav" && hasProperty(attrs["epub:type"], "toc"):
+				inTOC = true
+			case string(name) == "ol" && inTOC:
+				depth++
+			case string(name) == "a" && inTOC:
+				inLink, href = true, attrs["href"]
+				text.Reset()
+			}
+		case html.TextToken:
+			if inLink {
+				text.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch {
+			case string(name) == "a" && inLink:
+				inLink = false
+				entries = append(entries, navEntry{tocEntry: tocEntry{Title: text.String(), Level: max(depth-1, 0)}, href: href})
+			case string(name) == "ol" && inTOC:
+				depth--
+			case string(name) == "nav" && inTOC:
+				return entries
+			}
+		}
+	}
+}
+
+// navEntry is a link of a navigation document, before its target is resolved
+type navEntry struct {
+	tocEntry
+	href string
+}
+
+// pageChapterTitle returns the chapter starting on a page, marked with an
+// epub:type of "chapter" or a main heading. The title comes from the title
+// or aria-label attributes of the chapter element, or from the heading text.
+func pageChapterTitle(content []byte) (string, bool) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(content))
+	marked, title := false, ""
+	var heading strings.Builder
+	inHeading := false
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if text := strings.Join(strings.Fields(heading.String()), " "); title == "" && text != "" {
+				title = text
+			}
+			if !marked && title == "" {
+				return "", false
+			}
+			return title, true
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			attrs := tagAttrs(tokenizer)
+			if hasProperty(attrs["epub:type"], "chapter") && !marked {
+				marked = true
+				title = firstNonEmpty(attrs["title"], attrs["aria-label"])
+			}
+			switch string(name) {
+			case "h1", "h2":
+				inHeading = heading.Len() == 0
+			}
+		case html.TextToken:
+			if inHeading {
+				heading.Write(tokenizer.Text())
+			}
+		case html.EndTagToken:
+			switch name, _ := tokenizer.TagName(); string(name) {
+			case "h1", "h2":
+				inHeading = false
+			}
+		}
+	}
+}
+
+// headingChapters returns the chapters found on the pages, given the title
+// detected on each page. Books with a heading on most pages use them as page
+// titles, not chapters, and nil is returned like for less than two chapters.
+func headingChapters(titles []string, found []bool) []chapter {
+	var chapters []chapter
+	for page, ok := range found {
+		if ok {
+			title := titles[page]
+			if title == "" {
+				title = fmt.Sprintf("Chapter %d", len(chapters)+1)
+			}
+			chapters = append(chapters, chapter{Title: title, Page: page})
+		}
+	}
+	if len(chapters) < 2 || len(chapters) > len(found)/2 {
+		return nil
+	}
+	return chapters
+}
+
+// filenameChapters detects chapters from the names of the first image of
+// each page, when the page number resets ("ch1/09.jpg" then "ch2/01.jpg") or
+// the images move to another folder
+func filenameChapters(firstImages []string) []chapter {
+	var chapters []chapter
+	previousDir, previousNumber := "", -1
+	for page, image := range firstImages {
+		if image == "" {
+			continue
+		}
+		dir := path.Dir(image)
+		number := trailingNumber(strings.TrimSuffix(path.Base(image), path.Ext(image)))
+		start := len(chapters) == 0 ||
+			dir != previousDir ||
+			(number >= 0 && previousNumber > 1 && number <= 1)
+		if start {
+			chapters = append(chapters, chapter{Title: fmt.Sprintf("Chapter %d", len(chapters)+1), Page: page})
+		}
+		previousDir, previousNumber = dir, number
+	}
+	if len(chapters) < 2 {
+		return nil
+	}
+	return chapters
+}
+
+// trailingNumber returns the number ending a name, or -1 without one
+func trailingNumber(name string) int {
+	end := len(name)
+	start := end
+	for start > 0 && name[start-1] >= '0' && name[start-1] <= '9' {
+		start--
+	}
+	if start == end {
+		return -1
+	}
+	number, err := strconv.Atoi(name[start:end])
+	if err != nil {
+		return -1
+	}
+	return number
+}
+
+// tagAttrs returns the attributes of the current tag of a tokenizer
+func tagAttrs(tokenizer *html.Tokenizer) map[string]string {
+	attrs := make(map[string]string)
+	for {
+		key, val, more := tokenizer.TagAttr()
+		if len(key) > 0 {
+			attrs[string(key)] = string(val)
+		}
+		if !more {
+			return attrs
+		}
+	}
+}
+
+// hasProperty reports whether a space separated list of properties, like
+// the properties attribute of OPF items or epub:type, contains a value
+func hasProperty(properties string, value string) bool {
+	for _, property := range strings.Fields(properties) {
+		if property == value {
+			return true
+		}
+	}
+	return false
+}
+
+// readArchiveFile reads a file of an EPUB
+func readArchiveFile(index archiveIndex, name string) ([]byte, error) {
+	r, err := findAndOpenFile(index, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// chapterImages sets the first image of each chapter, from the first image
+// reference of its page and the number of images written before each
+// reference. Chapters left without images are dropped.
+func chapterImages(chapters []chapter, pageStart []int, written []int) []chapter {
+	var result []chapter
+	for _, c := range chapters {
+		c.Image = written[pageStart[c.Page]]
+		if c.Image >= written[len(written)-1] {
+			break
+		}
+		if len(result) > 0 && result[len(result)-1].Image == c.Image {
+			// The previous chapter has no image of its own
+			result = result[:len(result)-1]
+		}
+		result = append(result, c)
+	}
+	if len(result) < 2 {
+		return nil
+	}
+	return result
+}
+
+// addPageLayout lists the pages written in ComicInfo.xml with the size of
+// their image, so readers can lay out the book without decoding the pages.
+// The page of index cover is marked as the cover, none when it is negative.
+func addPageLayout(info *ComicInfo, layout []ComicPageInfo, cover int) {
+	if len(layout) == 0 {
+		return
+	}
+	pages := slices.Clone(layout)
+	slices.SortFunc(pages, func(a, b ComicPageInfo) int { return cmp.Compare(a.Image, b.Image) })
+	if i := slices.IndexFunc(pages, func(page ComicPageInfo) bool { return page.Image == cover }); i >= 0 {
+		pages[i].Type = PageTypeFrontCover
+	}
+	markDoublePages(pages)
+	info.Pages = &ArrayOfComicPageInfo{Page: pages}
+}
+
+// spreadWidthRatio is the width, relative to the typical page, from which a
+// page is a spread of two pages
+const spreadWidthRatio = 1.75
+
+// markDoublePages flags the spreads of a book, so readers show them alone in
+// two-page mode: landscape pages of a portrait book, and pages about twice
+// as wide as the typical page, which catches the spreads of landscape books
+func markDoublePages(pages []ComicPageInfo) {
+	var widths, heights []int
+	for _, page := range pages {
+		if page.ImageWidth > 0 && page.ImageHeight > 0 {
+			widths = append(widths, page.ImageWidth)
+			heights = append(heights, page.ImageHeight)
+		}
+	}
+	if len(widths) == 0 {
+		return
+	}
+	slices.Sort(widths)
+	slices.Sort(heights)
+	typicalWidth, typicalHeight := widths[len(widths)/2], heights[len(heights)/2]
+	portrait := typicalHeight > typicalWidth
+	for i, page := range pages {
+		if page.ImageWidth == 0 || page.ImageHeight == 0 {
+			continue
+		}
+		wide := float64(page.ImageWidth) >= spreadWidthRatio*float64(typicalWidth)
+		pages[i].DoublePage = wide || (portrait && page.ImageWidth > page.ImageHeight)
+	}
+}
+
+// addBookmarks bookmarks the first page of each chapter in ComicInfo.xml,
+// on the page listed by addPageLayout when there is one
+func addBookmarks(info *ComicInfo, chapters []chapter) {
+	if len(chapters) == 0 {
+		return
+	}
+	if info.Pages == nil {
+		info.Pages = &ArrayOfComicPageInfo{}
+	}
+	for _, c := range chapters {
+		i := slices.IndexFunc(info.Pages.Page, func(page ComicPageInfo) bool { return page.Image == c.Image })
+		if i < 0 {
+			info.Pages.Page = append(info.Pages.Page, ComicPageInfo{Image: c.Image, Bookmark: c.Title})
+		} else if info.Pages.Page[i].Bookmark == "" {
+			info.Pages.Page[i].Bookmark = c.Title
+		}
+	}
+}
+
+// splitChapters splits a converted book in one archive per chapter, named
+// "<name> - 01 - <title>.cbz" next to it, and removes the whole book. Each
+// archive gets the metadata of the book with the chapter as title and number.
+func splitChapters(bookPath string, stats *conversionStats, opts Options) ([]string, error) {
+	base := strings.TrimSuffix(bookPath, filepath.Ext(bookPath))
+	width := max(2, len(strconv.Itoa(len(stats.Chapters))))
+	return splitBook(bookPath, stats.Entries, stats.Chapters, func(i int, c chapter) (string, *ComicInfo) {
+		name := fmt.Sprintf("%s - %0*d - %s.cbz", base, width, i+1, safePathComponent(c.Title, opts))
+		return name, chapterComicInfo(stats.ComicInfo, c, i+1, len(stats.Chapters))
+	})
+}
+
+// splitVolumes splits a converted omnibus in one archive per volume, named
+// "<name> - Vol. 01.cbz" next to it, and removes the whole book. Each archive
+// gets the metadata of the book with its volume number and title.
+func splitVolumes(bookPath string, stats *conversionStats, opts Options) ([]string, error) {
+	base := strings.TrimSuffix(bookPath, filepath.Ext(bookPath))
+	width := max(2, len(strconv.Itoa(stats.Volumes[len(stats.Volumes)-1].Volume)))
+	return splitBook(bookPath, stats.Entries, stats.Volumes, func(i int, c chapter) (string, *ComicInfo) {
+		name := fmt.Sprintf("%s - Vol. %0*d.cbz", base, width, c.Volume)
+		return name, volumeComicInfo(stats.ComicInfo, c, len(stats.Volumes))
+	})
+}
+
+// splitBook splits a converted book in one archive per part, each part
+// running until the next one, and removes the whole book. Images are copied
+// without recompression, part returns the name and metadata of each archive.
+func splitBook(bookPath string, entries map[int]string, parts []chapter, part func(i int, c chapter) (string, *ComicInfo)) ([]string, error) {
+	reader, err := zip.OpenReader(longPath(bookPath))
+	if err != nil {
+		return nil, fmt.Errorf("error opening CBZ file: %w", err)
+	}
+	defer reader.Close()
+	// Images are taken by page index, the reading order: generated pages are
+	// written last, and names kept from the EPUB may sort differently
+	files := make(map[string]*zip.File, len(reader.File))
+	for _, f := range reader.File {
+		files[f.Name] = f
+	}
+	pageIndexes := slices.Sorted(maps.Keys(entries))
+
+	var outputs []string
+	for i, c := range parts {
+		// Pages before the first part, like the cover, belong to it
+		var images []*zip.File
+		for _, index := range pageIndexes {
+			if (i > 0 && index < c.Image) || (i+1 < len(parts) && index >= parts[i+1].Image) {
+				continue
+			}
+			if f := files[entries[index]]; f != nil {
+				images = append(images, f)
+			}
+		}
+		name, info := part(i, c)
+		if err := writeChapter(name, images, info); err != nil {
+			return outputs, err
+		}
+		outputs = append(outputs, name)
+	}
+
+	reader.Close()
+	if err := os.Remove(longPath(bookPath)); err != nil {
+		return outputs, fmt.Errorf("error removing %s: %w", bookPath, err)
+	}
+	return outputs, nil
+}
+
+// chapterComicInfo returns the metadata of a chapter of a book. The number
+// of the book becomes the volume, unless the book already has one.
+func chapterComicInfo(book *ComicInfo, c chapter, number int, count int) *ComicInfo {
+	info := &ComicInfo{}
+	if book != nil {
+		*info = *book
+	}
+	if info.Volume == 0 {
+		info.Volume, _ = strconv.Atoi(info.Number)
+	}
+	if info.Series == "" {
+		info.Series = info.Title
+	}
+	info.Title = c.Title
+	info.Number = strconv.Itoa(number)
+	info.Count = count
+	info.Pages = nil
+	return info
+}
+
+// volumeComicInfo returns the metadata of a volume of an omnibus, numbered
+// by its volume in the series of the book
+func volumeComicInfo(book *ComicInfo, c chapter, count int) *ComicInfo {
+	info := &ComicInfo{}
+	if book != nil {
+		*info = *book
+	}
+	if info.Series == "" {
+		info.Series = info.Title
+	}
+	if info.Format == FormatOmnibus {
+		info.Format = FormatDigital
+	}
+	info.Title = c.Title
+	info.Volume = c.Volume
+	info.Number = strconv.Itoa(c.Volume)
+	info.Count = count
+	info.Pages = nil
+	return info
+}
+
+// writeChapter writes an archive with the images of a chapter and its metadata
+func writeChapter(name string, images []*zip.File, info *ComicInfo) (err error) {
+	output, err := createOutput(name)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			output.abort()
+		}
+	}()
+
+	zipw := zip.NewWriter(output)
+	for _, image := range images {
+		if err := zipw.Copy(image); err != nil {
+			return fmt.Errorf("error writing %s: %w", name, err)
+		}
+	}
+	data, err := xml.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling ComicInfo: %w", err)
+	}
+	w, err := zipw.CreateHeader(&zip.FileHeader{Name: "ComicInfo.xml", Method: zip.Deflate, Modified: images[0].Modified})
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	if _, err := w.Write(append([]byte(xml.Header), data...)); err != nil {
+		return fmt.Errorf("error writing %s: %w", name, err)
+	}
+	if err := zipw.Close(); err != nil {
+		return fmt.Errorf("error finalizing %s: %w", name, err)
+	}
+	return output.commit()
+}
@@ -0,0 +1,151 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestSplitChaptersContentsPage splits a book with a generated contents
+// page: the page is written last in the book but belongs after the cover,
+// in the first chapter, and each chapter keeps its own images
+func TestSplitChaptersContentsPage(t *testing.T) {
+	titles := []string{"", "Arrival", "", "", "Departure", "", "", ""}
+	epubPath := writeChapteredEPUB(t, titles)
+	conv, err := NewConverter(Options{TOCPage: true, SplitChapters: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conv.Close()
+	bookPath := filepath.Join(t.TempDir(), "book.cbz")
+	if err := conv.ConvertFile(context.Background(), epubPath, bookPath); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Dir(bookPath)
+	first := imageEntries(t, filepath.Join(dir, "book - 01 - Arrival.cbz"))
+	second := imageEntries(t, filepath.Join(dir, "book - 02 - Departure.cbz"))
+	// Cover, contents page and the three pages of the first chapter
+	if len(first) != 5 || len(second) != 4 {
+		t.Fatalf("chapters have %d and %d pages, want 5 and 4: %v %v", len(first), len(second), first, second)
+	}
+	pages := append(slices.Clone(first), second...)
+	if !slices.IsSorted(pages) {
+		t.Errorf("pages out of reading order: %v %v", first, second)
+	}
+	if _, err := os.Stat(bookPath); !os.IsNotExist(err) {
+		t.Errorf("whole book %s not removed", bookPath)
+	}
+}
+
+// TestSkipExistingSplitChapters converts a book split in chapters again with
+// -skip-existing: its parts are the existing output, the whole book is gone
+func TestSkipExistingSplitChapters(t *testing.T) {
+	epubPath := writeChapteredEPUB(t, []string{"", "Arrival", "", "", "Departure", "", "", ""})
+	bookPath := filepath.Join(t.TempDir(), "book.cbz")
+	for i, existing := range []string{ExistingOverwrite, ExistingSkip} {
+		conv, err := NewConverter(Options{SplitChapters: true, Existing: existing})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conv.ConvertFile(context.Background(), epubPath, bookPath)
+		conv.Close()
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && !IsSkipped(err) {
+			t.Errorf("second conversion returned %v, want skipped", err)
+		}
+	}
+}
+
+// imageEntries returns the names of the images of an archive, in the order
+// they are stored
+func imageEntries(t *testing.T, path string) []string {
+	t.Helper()
+	reader, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	var names []string
+	for _, f := range reader.File {
+		if isImageName(f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+// writeChapteredEPUB writes an EPUB of one line art image per page to a
+// temporary directory, a page starting a chapter of the table of contents
+// when it has a title
+func writeChapteredEPUB(t *testing.T, titles []string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zipw := zip.NewWriter(&buf)
+	write := func(name string, data []byte) {
+		w, err := zipw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("mimetype", []byte("application/epub+zip"))
+	write("META-INF/container.xml", []byte(`<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`))
+
+	var manifest, spine, navMap bytes.Buffer
+	for i, title := range titles {
+		name := fmt.Sprintf("images/%03d.png", i)
+		write("OEBPS/"+name, sampleLineArt(t, i))
+		write(fmt.Sprintf("OEBPS/page%03d.xhtml", i), fmt.Appendf(nil, `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Page %d</title></head>
+<body><img src="%s" alt=""/></body></html>`, i+1, name))
+		if title != "" {
+			fmt.Fprintf(&navMap, "    <navPoint id=\"nav%03d\"><navLabel><text>%s</text></navLabel><content src=\"page%03d.xhtml\"/></navPoint>\n", i, title, i)
+		}
+		fmt.Fprintf(&manifest, "    <item id=\"page%03d\" href=\"page%03d.xhtml\" media-type=\"application/xhtml+xml\"/>\n", i, i)
+		fmt.Fprintf(&manifest, "    <item id=\"image%03d\" href=\"%s\" media-type=\"image/png\"/>\n", i, name)
+		fmt.Fprintf(&spine, "    <itemref idref=\"page%03d\"/>\n", i)
+	}
+	write("OEBPS/toc.ncx", fmt.Appendf(nil, `<?xml version="1.0" encoding="UTF-8"?>
+<ncx xmlns="http://www.daisy.org/z3986/2005/ncx/" version="2005-1">
+  <navMap>
+%s  </navMap>
+</ncx>`, navMap.String()))
+	write("OEBPS/content.opf", fmt.Appendf(nil, `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>Chapters</dc:title>
+    <dc:identifier id="id">urn:uuid:5e1d2c3b-4a5f-4e6d-9c8b-7a6f5e4d3c2b</dc:identifier>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+    <item id="ncx" href="toc.ncx" media-type="application/x-dtbncx+xml"/>
+%s  </manifest>
+  <spine toc="ncx">
+%s  </spine>
+</package>`, manifest.String(), spine.String()))
+
+	if err := zipw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "chapters.epub")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
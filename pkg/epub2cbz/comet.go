@@ -0,0 +1,134 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metadata files written in the archives
+const (
+	MetadataComicInfo = "comicinfo" // ComicInfo.xml, read by most readers
+	MetadataCoMet     = "comet"     // CoMet.xml
+	MetadataACBF      = "acbf"      // Advanced Comic Book Format, book.acbf
+)
+
+// validateMetadataFormats checks the comma-separated metadata files given
+// on the command line
+func validateMetadataFormats(formats string) error {
+	if formats == "" {
+		return nil
+	}
+	for _, format := range strings.Split(formats, ",") {
+		switch strings.TrimSpace(format) {
+		case MetadataComicInfo, MetadataCoMet, MetadataACBF:
+		default:
+			return fmt.Errorf("invalid metadata format %q (expected %s, %s or %s)", format, MetadataComicInfo, MetadataCoMet, MetadataACBF)
+		}
+	}
+	return nil
+}
+
+// writesMetadata reports whether the archives get a metadata file, ComicInfo.xml
+// alone when the options name none
+func (opts Options) writesMetadata(format string) bool {
+	if opts.Metadata == "" {
+		return format == MetadataComicInfo
+	}
+	return slices.ContainsFunc(strings.Split(opts.Metadata, ","), func(f string) bool {
+		return strings.TrimSpace(f) == format
+	})
+}
+
+// coMet is a CoMet.xml document (CoMet 1.1). Its lists are the ", "
+// separated values of ComicInfo.
+type coMet struct {
+	XMLName          xml.Name `xml:"comet"`
+	Namespace        string   `xml:"xmlns:comet,attr"`
+	SchemaNamespace  string   `xml:"xmlns:xsi,attr"`
+	SchemaLocation   string   `xml:"xsi:schemaLocation,attr"`
+	Title            string   `xml:"title"`
+	Description      string   `xml:"description,omitempty"`
+	Series           string   `xml:"series,omitempty"`
+	Issue            int      `xml:"issue,omitempty"`
+	Volume           int      `xml:"volume,omitempty"`
+	Publisher        string   `xml:"publisher,omitempty"`
+	Date             string   `xml:"date,omitempty"`
+	Genres           []string `xml:"genre"`
+	Characters       []string `xml:"character"`
+	Format           string   `xml:"format,omitempty"`
+	Language         string   `xml:"language,omitempty"`
+	Rating           string   `xml:"rating,omitempty"`
+	Pages            int      `xml:"pages,omitempty"`
+	Writers          []string `xml:"writer"`
+	Pencillers       []string `xml:"penciller"`
+	Editors          []string `xml:"editor"`
+	CoverDesigners   []string `xml:"coverDesigner"`
+	Letterers        []string `xml:"letterer"`
+	Inkers           []string `xml:"inker"`
+	Colorists        []string `xml:"colorist"`
+	ReadingDirection string   `xml:"readingDirection,omitempty"`
+}
+
+// createCoMet builds the CoMet.xml document matching a ComicInfo. CoMet
+// issues are whole numbers, fractional numbers are left out.
+func createCoMet(info *ComicInfo, pages int) *coMet {
+	list := func(values string) []string {
+		var items []string
+		for _, value := range strings.Split(values, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				items = append(items, value)
+			}
+		}
+		return items
+	}
+	comet := &coMet{
+		Namespace:       "http://www.denvog.com/comet/",
+		SchemaNamespace: "http://www.w3.org/2001/XMLSchema-instance",
+		SchemaLocation:  "http://www.denvog.com http://www.denvog.com/comet/comet.xsd",
+		Title:           firstNonEmpty(info.Title, info.Series),
+		Description:     info.Summary,
+		Series:          info.Series,
+		Volume:          info.Volume,
+		Publisher:       info.Publisher,
+		Genres:          list(info.Genre),
+		Characters:      list(info.Characters),
+		Format:          info.Format,
+		Language:        info.LanguageISO,
+		Pages:           pages,
+		Writers:         list(info.Writer),
+		Pencillers:      list(info.Penciller),
+		Editors:         list(info.Editor),
+		CoverDesigners:  list(info.CoverArtist),
+		Letterers:       list(info.Letterer),
+		Inkers:          list(info.Inker),
+		Colorists:       list(info.Colorist),
+	}
+	if info.Manga == "YesAndRightToLeft" {
+		comet.ReadingDirection = "rtl"
+	}
+	comet.Issue, _ = strconv.Atoi(strings.TrimSpace(info.Number))
+	if info.AgeRating != "Unknown" {
+		comet.Rating = info.AgeRating
+	}
+	comet.Date = comicInfoDate(info)
+	return comet
+}
+
+// writeXMLEntry marshals a document into a ZIP entry with an XML declaration
+func writeXMLEntry(zipw *zip.Writer, name string, document any, modTime time.Time) error {
+	data, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := zipw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append([]byte(xml.Header), data...))
+	return err
+}
@@ -0,0 +1,125 @@
+package epub2cbz
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// comicBookInfoTime is the lastModified format written by ComicTagger
+const comicBookInfoTime = "2006-01-02 15:04:05.000000"
+
+// applyComicTaggerConventions rewrites a ComicInfo with the conventions
+// ComicTagger uses, so tagging the CBZ afterwards merges with our values
+// instead of reporting conflicts
+func applyComicTaggerConventions(info *ComicInfo, metadata Metadata) {
+	// Credits list every person, separated by ", ", all of them as writers
+	// and pencillers when the EPUB gives no roles
+	if len(metadata.Creator) > 0 && !metadata.hasCreditRoles() {
+		creators := strings.Join(metadata.Creator, ", ")
+		info.Writer = creators
+		info.Penciller = creators
+	}
+
+	// ComicTagger leaves unknown values out, an explicit Unknown is a conflict
+	if info.BlackAndWhite == "Unknown" {
+		info.BlackAndWhite = ""
+	}
+	if info.AgeRating == "Unknown" {
+		info.AgeRating = ""
+	}
+	if info.Manga == "Unknown" {
+		info.Manga = ""
+	}
+
+	info.Notes = fmt.Sprintf("Tagged with epub2cbz %s using info from EPUB metadata.", Version())
+	if note := alternateTitlesNote(metadata); note != "" {
+		info.Notes += " " + note
+	}
+}
+
+// comicBookCredit is a credit of the ComicBookInfo format
+type comicBookCredit struct {
+	Person  string `json:"person"`
+	Role    string `json:"role"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// comicBookInfoData holds the ComicBookInfo/1.0 fields
+type comicBookInfoData struct {
+	Series           string            `json:"series,omitempty"`
+	Title            string            `json:"title,omitempty"`
+	Publisher        string            `json:"publisher,omitempty"`
+	PublicationMonth int               `json:"publicationMonth,omitempty"`
+	PublicationYear  int               `json:"publicationYear,omitempty"`
+	Issue            string            `json:"issue,omitempty"`
+	NumberOfIssues   int               `json:"numberOfIssues,omitempty"`
+	Volume           int               `json:"volume,omitempty"`
+	Genre            string            `json:"genre,omitempty"`
+	Language         string            `json:"language,omitempty"`
+	Comments         string            `json:"comments,omitempty"`
+	Credits          []comicBookCredit `json:"credits,omitempty"`
+}
+
+// comicBookInfo is the ComicBookInfo JSON document stored in the ZIP comment
+type comicBookInfo struct {
+	AppID        string            `json:"appID"`
+	LastModified string            `json:"lastModified"`
+	Data         comicBookInfoData `json:"ComicBookInfo/1.0"`
+}
+
+// createComicBookInfo builds the ComicBookInfo comment matching a ComicInfo,
+// so readers of either format see the same values
+func createComicBookInfo(info *ComicInfo, modified time.Time) ([]byte, error) {
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	cbi := comicBookInfo{
+		AppID:        "epub2cbz/" + Version(),
+		LastModified: modified.Format(comicBookInfoTime),
+		Data: comicBookInfoData{
+			Series:           info.Series,
+			Title:            info.Title,
+			Publisher:        info.Publisher,
+			PublicationMonth: info.Month,
+			PublicationYear:  info.Year,
+			Issue:            info.Number,
+			NumberOfIssues:   info.Count,
+			Volume:           info.Volume,
+			Genre:            info.Genre,
+			Language:         info.LanguageISO,
+			Comments:         info.Summary,
+		},
+	}
+
+	roles := []struct {
+		role   string
+		people string
+	}{
+		{"Writer", info.Writer},
+		{"Penciller", info.Penciller},
+		{"Inker", info.Inker},
+		{"Colorist", info.Colorist},
+		{"Letterer", info.Letterer},
+		{"Cover", info.CoverArtist},
+		{"Editor", info.Editor},
+		{"Translator", info.Translator},
+	}
+	for _, r := range roles {
+		for _, person := range strings.Split(r.people, ",") {
+			if person = strings.TrimSpace(person); person != "" {
+				cbi.Data.Credits = append(cbi.Data.Credits, comicBookCredit{Person: person, Role: r.role})
+			}
+		}
+	}
+
+	data, err := json.Marshal(cbi)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling ComicBookInfo: %w", err)
+	}
+	if len(data) > 0xffff {
+		return nil, fmt.Errorf("error writing ComicBookInfo: %d bytes do not fit in a ZIP comment", len(data))
+	}
+	return data, nil
+}
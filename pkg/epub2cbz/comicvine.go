@@ -0,0 +1,215 @@
+package epub2cbz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// comicVineAPI is the base URL of the ComicVine API
+const comicVineAPI = "https://comicvine.gamespot.com/api"
+
+// comicVineInterval is the delay between two ComicVine requests, which
+// blocks clients going faster than about one request per second
+const comicVineInterval = time.Second
+
+// comicVineClient looks up books on ComicVine. Series are searched once per
+// run, the books of a batch often belong to the same ones.
+type comicVineClient struct {
+	key    string
+	client *http.Client
+
+	throttle sync.Mutex
+	last     time.Time // time of the last request
+
+	mutex   sync.Mutex
+	volumes map[string][]comicVineVolume // search results by series name
+}
+
+// comicVineVolume is a ComicVine volume, the series of ComicInfo
+type comicVineVolume struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	StartYear string `json:"start_year"`
+}
+
+// comicVineName is a named ComicVine resource, like a character or a team
+type comicVineName struct {
+	Name string `json:"name"`
+}
+
+// comicVineIssue holds the issue fields copied to ComicInfo
+type comicVineIssue struct {
+	ID          int             `json:"id"`
+	Deck        string          `json:"deck"`
+	Description string          `json:"description"`
+	URL         string          `json:"site_detail_url"`
+	Characters  []comicVineName `json:"character_credits"`
+	Teams       []comicVineName `json:"team_credits"`
+	StoryArcs   []comicVineName `json:"story_arc_credits"`
+}
+
+// newComicVineClient returns a ComicVine client using an API key, or nil
+// without key
+func newComicVineClient(key string) *comicVineClient {
+	if key == "" {
+		return nil
+	}
+	return &comicVineClient{
+		key:     key,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		volumes: make(map[string][]comicVineVolume),
+	}
+}
+
+// get calls a ComicVine resource and decodes its results
+func (c *comicVineClient) get(resource string, params url.Values, results any) error {
+	c.throttle.Lock()
+	if wait := comicVineInterval - time.Since(c.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	c.last = time.Now()
+	c.throttle.Unlock()
+
+	params.Set("api_key", c.key)
+	params.Set("format", "json")
+	req, err := http.NewRequest(http.MethodGet, comicVineAPI+"/"+resource+"/?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	// ComicVine rejects requests without a user agent of their own
+	req.Header.Set("User-Agent", "epub2cbz/"+Version())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		// The error holds the URL, and the URL the key
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("error querying ComicVine %s: %w", resource, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error querying ComicVine %s: %s", resource, resp.Status)
+	}
+
+	var response struct {
+		Error   string          `json:"error"`
+		Status  int             `json:"status_code"`
+		Results json.RawMessage `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return fmt.Errorf("error decoding ComicVine %s: %w", resource, err)
+	}
+	if response.Status != 1 {
+		return fmt.Errorf("error querying ComicVine %s: %s", resource, response.Error)
+	}
+	return json.Unmarshal(response.Results, results)
+}
+
+// findVolume returns the ComicVine volume of a series: the one named like
+// it, started the closest before the year of the book when it is known
+func (c *comicVineClient) findVolume(series string, year int) (comicVineVolume, bool, error) {
+	key := strings.ToLower(strings.TrimSpace(series))
+	c.mutex.Lock()
+	volumes, ok := c.volumes[key]
+	c.mutex.Unlock()
+	if !ok {
+		params := url.Values{
+			"query":      {series},
+			"resources":  {"volume"},
+			"field_list": {"id,name,start_year"},
+			"limit":      {"20"},
+		}
+		if err := c.get("search", params, &volumes); err != nil {
+			return comicVineVolume{}, false, err
+		}
+		c.mutex.Lock()
+		c.volumes[key] = volumes
+		c.mutex.Unlock()
+	}
+
+	var best comicVineVolume
+	found := false
+	for _, volume := range volumes {
+		if !strings.EqualFold(strings.TrimSpace(volume.Name), strings.TrimSpace(series)) {
+			continue
+		}
+		start, _ := strconv.Atoi(volume.StartYear)
+		if year > 0 && start > year {
+			continue
+		}
+		bestStart, _ := strconv.Atoi(best.StartYear)
+		if !found || (year > 0 && start > bestStart) {
+			best, found = volume, true
+		}
+	}
+	return best, found, nil
+}
+
+// findIssue returns the issue of a volume by number, with its details
+func (c *comicVineClient) findIssue(volume comicVineVolume, number string) (*comicVineIssue, bool, error) {
+	var issues []comicVineIssue
+	params := url.Values{
+		"filter":     {fmt.Sprintf("volume:%d,issue_number:%s", volume.ID, number)},
+		"field_list": {"id"},
+	}
+	if err := c.get("issues", params, &issues); err != nil || len(issues) == 0 {
+		return nil, false, err
+	}
+
+	var issue comicVineIssue
+	params = url.Values{"field_list": {"id,deck,description,site_detail_url,character_credits,team_credits,story_arc_credits"}}
+	if err := c.get(fmt.Sprintf("issue/4000-%d", issues[0].ID), params, &issue); err != nil {
+		return nil, false, err
+	}
+	return &issue, true, nil
+}
+
+// enrich fills the empty Summary, Characters, Teams and StoryArc fields of
+// a ComicInfo with the ones of its issue on ComicVine, found by series (or
+// title) and number, and adds the issue page to Web. It reports whether the
+// issue was found.
+func (c *comicVineClient) enrich(info *ComicInfo) (bool, error) {
+	series := firstNonEmpty(info.Series, info.Title)
+	number := strings.TrimSpace(info.Number)
+	if number == "" && info.Volume > 0 {
+		number = strconv.Itoa(info.Volume)
+	}
+	if series == "" || number == "" {
+		return false, nil
+	}
+	volume, ok, err := c.findVolume(series, info.Year)
+	if err != nil || !ok {
+		return false, err
+	}
+	issue, ok, err := c.findIssue(volume, number)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	names := func(resources []comicVineName) string {
+		var list []string
+		for _, resource := range resources {
+			list = append(list, resource.Name)
+		}
+		return strings.Join(list, ", ")
+	}
+	fill := func(dst *string, value string) {
+		if *dst == "" {
+			*dst = value
+		}
+	}
+	fill(&info.Summary, firstNonEmpty(descriptionText(issue.Description), issue.Deck))
+	fill(&info.Characters, names(issue.Characters))
+	fill(&info.Teams, names(issue.Teams))
+	fill(&info.StoryArc, names(issue.StoryArcs))
+	info.addWeb(issue.URL)
+	return true, nil
+}
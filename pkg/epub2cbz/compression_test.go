@@ -0,0 +1,149 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// benchmarkPages is the number of pages of the sample EPUB, every fourth
+// page being a PNG line art page and the others JPEG scans
+const benchmarkPages = 24
+
+// BenchmarkCompression converts a sample EPUB with every image stored, then
+// deflated, reporting the size of the CBZ along with the time so the cost of
+// deflate can be weighed against the bytes it saves
+func BenchmarkCompression(b *testing.B) {
+	epubPath := writeSampleEPUB(b, benchmarkPages)
+	info, err := os.Stat(epubPath)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, compression := range []string{CompressionStore, CompressionDeflate} {
+		b.Run(compression, func(b *testing.B) {
+			conv, err := NewConverter(Options{Compression: compression})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conv.Close()
+
+			b.SetBytes(info.Size())
+			var stats Stats
+			for b.Loop() {
+				if stats, err = conv.ConvertTo(context.Background(), epubPath, io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(stats.OutputBytes), "cbz-bytes")
+		})
+	}
+}
+
+// writeSampleEPUB writes an EPUB of generated pages to a temporary directory
+// and returns its path
+func writeSampleEPUB(tb testing.TB, pages int) string {
+	tb.Helper()
+	var buf bytes.Buffer
+	zipw := zip.NewWriter(&buf)
+	write := func(name string, method uint16, data []byte) {
+		w, err := zipw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	write("mimetype", zip.Store, []byte("application/epub+zip"))
+	write("META-INF/container.xml", zip.Deflate, []byte(`<?xml version="1.0"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>`))
+
+	var manifest, spine bytes.Buffer
+	random := rand.New(rand.NewSource(1))
+	for i := range pages {
+		name, mediaType, data := fmt.Sprintf("images/%03d.jpg", i), "image/jpeg", sampleScan(tb, random)
+		if i%4 == 3 {
+			name, mediaType, data = fmt.Sprintf("images/%03d.png", i), "image/png", sampleLineArt(tb, i)
+		}
+		write("OEBPS/"+name, zip.Store, data)
+		write(fmt.Sprintf("OEBPS/page%03d.xhtml", i), zip.Deflate, fmt.Appendf(nil, `<?xml version="1.0" encoding="UTF-8"?>
+<html xmlns="http://www.w3.org/1999/xhtml"><head><title>Page %d</title></head>
+<body><img src="%s" alt=""/></body></html>`, i+1, name))
+		fmt.Fprintf(&manifest, "    <item id=\"page%03d\" href=\"page%03d.xhtml\" media-type=\"application/xhtml+xml\"/>\n", i, i)
+		fmt.Fprintf(&manifest, "    <item id=\"image%03d\" href=\"%s\" media-type=\"%s\"/>\n", i, name, mediaType)
+		fmt.Fprintf(&spine, "    <itemref idref=\"page%03d\"/>\n", i)
+	}
+	write("OEBPS/content.opf", zip.Deflate, fmt.Appendf(nil, `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="2.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:title>Benchmark</dc:title>
+    <dc:identifier id="id">urn:uuid:9b0c5d7e-2f7a-4c1e-8d5b-0e6f3a1c2b4d</dc:identifier>
+    <dc:language>en</dc:language>
+  </metadata>
+  <manifest>
+%s  </manifest>
+  <spine>
+%s  </spine>
+</package>`, manifest.String(), spine.String()))
+
+	if err := zipw.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	path := filepath.Join(tb.TempDir(), "sample.epub")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// sampleScan returns a JPEG page with shading and grain, like a scanned
+// page: deflate saves little on it
+func sampleScan(tb testing.TB, random *rand.Rand) []byte {
+	img := image.NewGray(image.Rect(0, 0, 800, 1200))
+	for y := range 1200 {
+		for x := range 800 {
+			img.SetGray(x, y, color.Gray{Y: uint8((x+y)/8 + random.Intn(32))})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// sampleLineArt returns a PNG page of flat panels and lines, like digital
+// line art: deflate still finds some redundancy after PNG filtering
+func sampleLineArt(tb testing.TB, seed int) []byte {
+	img := image.NewGray(image.Rect(0, 0, 800, 1200))
+	for y := range 1200 {
+		for x := range 800 {
+			shade := uint8(255)
+			if x%200 < 4 || y%300 < 4 || (x+y+seed*7)%97 == 0 {
+				shade = 0
+			}
+			img.SetGray(x, y, color.Gray{Y: shade})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,280 @@
+package epub2cbz
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Converter converts EPUB files to CBZ archives with the same options. Its
+// conversions share the I/O and CPU worker limits, the cache, the report and
+// the notifications, and it is safe for concurrent use. Close saves the cache
+// and the report once the conversions are done.
+type Converter struct {
+	opts Options
+}
+
+// NewConverter checks the options and prepares the state shared by the
+// conversions. Policies left empty get the defaults of the command line.
+func NewConverter(opts Options) (*Converter, error) {
+	if opts.Compression == "" {
+		opts.Compression = CompressionAuto
+	}
+	if opts.Sanitize == "" {
+		opts.Sanitize = SanitizeReplace
+	}
+	if opts.WatermarkStyle == "" {
+		opts.WatermarkStyle = WatermarkCorner
+	}
+	if opts.SplitOrder == "" {
+		opts.SplitOrder = SplitOrderLTR
+	}
+	if opts.KindleDevice == "" {
+		opts.KindleDevice = KindlePaperwhite
+	}
+	if opts.Jobs == 0 {
+		opts.Jobs = runtime.NumCPU()
+	}
+	if err := validateOptions(opts); err != nil {
+		return nil, err
+	}
+	mappings, err := loadMappings(opts.MappingsFile)
+	if err != nil {
+		return nil, err
+	}
+	opts.limits = newWorkerLimits(opts.IOWorkers, opts.CPUWorkers)
+	opts.mappings = mappings
+	opts.comicVine = newComicVineClient(opts.ComicVineKey)
+	opts.manga = newMangaClient(opts.MangaMetadata)
+	if opts.CacheFile != "" {
+		if opts.cache, err = loadConversionCache(opts.CacheFile); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ReportFile != "" {
+		if opts.report, err = newBatchReport(opts.ReportFile); err != nil {
+			return nil, err
+		}
+	}
+	opts.notifier = newNotifier(opts.Webhook, opts.Ntfy, opts.Email, opts.logger())
+	if opts.MetricsAddr != "" {
+		opts.metrics = startMetrics(opts.MetricsAddr, opts.logger())
+		opts.printf("Serving metrics on http://%s/metrics\n", opts.MetricsAddr)
+	}
+	return &Converter{opts: opts}, nil
+}
+
+// Close saves the cache and writes the end of the report
+func (c *Converter) Close() error {
+	var errs []error
+	if c.opts.cache != nil {
+		errs = append(errs, c.opts.cache.save())
+	}
+	if c.opts.report != nil {
+		errs = append(errs, c.opts.report.close())
+	}
+	return errors.Join(errs...)
+}
+
+// ConvertFile converts the EPUB file src to the CBZ file dst, named after
+// the EPUB when dst is empty. Once ctx is canceled, the conversion stops and
+// returns the error of ctx.
+func (c *Converter) ConvertFile(ctx context.Context, src string, dst string) error {
+	opts := c.opts
+	opts.ctx = ctx
+	return processFile(src, dst, opts)
+}
+
+// Stats are the measures of a conversion
+type Stats struct {
+	Pages       int   // pages of the spine
+	Images      int   // images written to the CBZ
+	ImageBytes  int64 // uncompressed size of the written images
+	OutputBytes int64 // size of the CBZ
+
+	// Time spent in each stage. Page parsing and image fetching run on several
+	// workers, their durations add up the time of every worker.
+	Spine time.Duration // opening the EPUB and resolving the spine
+	Parse time.Duration // reading pages and extracting image references
+	Fetch time.Duration // reading and compressing images
+	Write time.Duration // writing entries to the archive
+}
+
+// ConvertTo converts the EPUB file src to a CBZ archive written to w, without
+// the files written next to an output like PDFs and sidecars, and returns
+// the measures of the conversion
+func (c *Converter) ConvertTo(ctx context.Context, src string, w io.Writer) (Stats, error) {
+	opts := c.opts
+	opts.ctx = ctx
+	stats, err := convertEPUB(src, w, opts, time.Time{}, newFileLogger(src, opts.logger()))
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{
+		Pages: stats.Pages, Images: stats.Images, ImageBytes: stats.ImageBytes, OutputBytes: stats.OutputBytes,
+		Spine: stats.Spine, Parse: stats.Parse, Fetch: stats.Fetch, Write: stats.Write,
+	}, nil
+}
+
+// OutputPath returns the file a book is converted to from an output path
+// given on the command line: a file, empty to write next to the EPUB, a
+// remote directory ending with a slash, or the root of the library with a
+// Layout, whose directories are created. Generated names follow
+// ChapterNaming.
+func (c *Converter) OutputPath(src string, output string) (string, error) {
+	opts := c.opts
+	// Only generated names follow the chapter naming, not an explicit output file
+	generatedName := output == "" || (IsRemoteURL(output) && strings.HasSuffix(output, "/"))
+
+	// An object is converted next to itself by default
+	if output == "" && isObjectURL(src) {
+		output = src[:strings.LastIndex(src, "/")+1]
+	}
+
+	// With a library layout, the output argument is the library root
+	var err error
+	if opts.Layout != "" {
+		root := output
+		if root == "" {
+			root = filepath.Dir(src)
+		}
+		if output, err = layoutOutputPath(root, src, opts); err != nil {
+			return "", err
+		}
+		if err := createOutputDir(output); err != nil {
+			return "", fmt.Errorf("error creating output directory: %w", err)
+		}
+	} else if IsRemoteURL(output) && strings.HasSuffix(output, "/") {
+		// A remote directory receives the CBZ named after the EPUB
+		output = remoteOutputPath(output, src, opts)
+	}
+
+	if opts.Layout == "" && opts.ChapterNaming != "" && generatedName {
+		if output == "" {
+			output = defaultOutputPath(src, opts)
+		}
+		return namedOutputPath(output, src, opts)
+	}
+	return output, nil
+}
+
+// ConvertDirectory converts the EPUB files of src, and of its subdirectories
+// with Recursive, to the same structure in dst or next to them when dst is
+// empty. Jobs books are converted in parallel. It returns the books that
+// failed, and an error when the directory could not be converted at all.
+func (c *Converter) ConvertDirectory(ctx context.Context, src string, dst string) ([]string, error) {
+	opts := c.opts
+	opts.ctx = ctx
+	failed, err := processDirectory(src, dst, opts)
+	if err == nil && opts.notifier != nil {
+		opts.notifier.batchDone(src)
+	}
+	return failed, err
+}
+
+// ConvertManifest converts the books listed by a CSV manifest, with their
+// destinations and metadata corrections. It returns the books that failed,
+// and an error when the manifest could not be read.
+func (c *Converter) ConvertManifest(ctx context.Context, manifest string) ([]string, error) {
+	jobs, err := readManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	opts := c.opts
+	opts.ctx = ctx
+	failed := processManifest(jobs, opts)
+	if opts.notifier != nil {
+		opts.notifier.batchDone(manifest)
+	}
+	return failed, nil
+}
+
+// Watch converts the EPUB files of src, then the ones added or modified once
+// unchanged for the settle delay, until ctx is canceled. The books processed
+// are recorded in the database db, WatchDatabaseName in src when empty.
+func (c *Converter) Watch(ctx context.Context, src string, dst string, settle time.Duration, db string) error {
+	if db == "" {
+		db = filepath.Join(src, WatchDatabaseName)
+	}
+	err := watchDirectory(ctx, src, dst, c.opts, settle, db)
+	if c.opts.notifier != nil {
+		c.opts.notifier.batchDone(src)
+	}
+	return err
+}
+
+// ConvertFile converts a single EPUB file, see Converter.ConvertFile
+func ConvertFile(ctx context.Context, src string, dst string, opts Options) error {
+	c, err := NewConverter(opts)
+	if err != nil {
+		return err
+	}
+	return errors.Join(c.ConvertFile(ctx, src, dst), c.Close())
+}
+
+// canceled returns the error of the context of the conversion once it is canceled
+func (opts Options) canceled() error {
+	if opts.ctx == nil {
+		return nil
+	}
+	return opts.ctx.Err()
+}
+
+// validateOptions checks the options of a run, before any conversion
+func validateOptions(opts Options) error {
+	if opts.Jobs < 0 {
+		return fmt.Errorf("number of parallel jobs cannot be negative")
+	}
+	if opts.PageJobs < 0 {
+		return fmt.Errorf("number of page jobs cannot be negative")
+	}
+	if opts.PageOffset < 0 {
+		return fmt.Errorf("page offset cannot be negative")
+	}
+	if opts.MaxOpen < 0 {
+		return fmt.Errorf("maximum number of open files cannot be negative")
+	}
+	if opts.IOWorkers < 0 || opts.CPUWorkers < 0 {
+		return fmt.Errorf("number of I/O and CPU workers cannot be negative")
+	}
+	for _, err := range []error{
+		validateSanitizePolicy(opts.Sanitize),
+		validateCompressionPolicy(opts.Compression),
+		validateWatermarkStyle(opts.WatermarkStyle),
+		validateSplitOrder(opts.SplitOrder),
+		validateKindleDevice(opts.KindleDevice),
+		validateTitlePage(opts.TitlePage),
+		validateLayout(opts.Layout),
+		validateNaming(opts.ChapterNaming),
+		validateOverrides(opts.Overrides),
+		validateFilenamePattern(opts.ParseFilename),
+		validateMangaProvider(opts.MangaMetadata),
+		validateMetadataFormats(opts.Metadata),
+		validateExistingPolicy(opts.Existing),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if opts.KeepStructure && (opts.TitlePage != "" || opts.TOCPage || opts.PageOffset != 0) {
+		return fmt.Errorf("-keep-structure cannot be combined with -title-page, -toc-page or -page-offset")
+	}
+	if opts.SplitChapters && opts.SplitVolumes {
+		return fmt.Errorf("-split-chapters and -split-volumes cannot be combined")
+	}
+	if opts.PDFOnly && (opts.SplitChapters || opts.SplitVolumes) {
+		return fmt.Errorf("-pdf-only cannot be combined with -split-chapters or -split-volumes")
+	}
+	if opts.ExtractDir && (opts.PDFOnly || opts.SplitChapters || opts.SplitVolumes) {
+		return fmt.Errorf("-extract-dir cannot be combined with -pdf-only, -split-chapters or -split-volumes")
+	}
+	if opts.CalibreAdd && opts.Calibre == "" {
+		return fmt.Errorf("-calibre-add requires -from-calibre")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// coverQuality is the quality of covers converted to JPEG
+const coverQuality = 90
+
+// epubCover returns the cover image of an EPUB: the image declared as cover
+// by the manifest, or the first image of the first pages
+func epubCover(index archiveIndex) (*zip.File, error) {
+	pkg, opfPath, err := readPackage(index)
+	if err != nil {
+		return nil, err
+	}
+	if cover := declaredCover(pkg, opfPath); cover != "" {
+		if f, ok := index.lookup(cover); ok {
+			return f, nil
+		}
+	}
+	pages := spinePages(pkg, opfPath)
+	logger := log.New(io.Discard, "", 0)
+	for _, page := range pages[:min(len(pages), 3)] {
+		for _, src := range readPage(index, page, false, logger).images {
+			if f, ok := index.lookup(src); ok {
+				return f, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no cover found")
+}
+
+// ExtractCover writes the cover image of an EPUB to target, or next to the EPUB
+// as "<name>.cover.<ext>" when target is empty. A target without extension
+// gets the one of the image; a .jpg or .png target in another format gets
+// the image converted.
+func ExtractCover(epubPath string, target string) (string, error) {
+	reader, err := zip.OpenReader(longPath(epubPath))
+	if err != nil {
+		return "", fmt.Errorf("error opening EPUB file: %w", err)
+	}
+	defer reader.Close()
+	cover, err := epubCover(newArchiveIndex(reader.File))
+	if err != nil {
+		return "", err
+	}
+	r, err := cover.Open()
+	if err != nil {
+		return "", fmt.Errorf("error reading cover: %w", err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("error reading cover: %w", err)
+	}
+
+	ext := imageExtension(sniffImageType(data), cover.Name)
+	if target == "" {
+		target = strings.TrimSuffix(epubPath, filepath.Ext(epubPath)) + ".cover"
+	}
+	switch want := strings.ToLower(path.Ext(target)); {
+	case want == "" || want == ".cover":
+		target += ext
+	case want == ".jpeg" && ext == ".jpg", want == ext:
+	case want == ".jpg" || want == ".jpeg" || want == ".png":
+		if data, err = convertCover(data, want); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported cover format %s, the cover is a %s image", want, ext)
+	}
+
+	if err := os.WriteFile(longPath(target), data, 0644); err != nil {
+		return "", fmt.Errorf("error writing cover: %w", err)
+	}
+	return target, nil
+}
+
+// convertCover encodes a cover image as JPEG or PNG
+func convertCover(data []byte, ext string) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding cover: %w", err)
+	}
+	var buf bytes.Buffer
+	if ext == ".png" {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: coverQuality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error encoding cover: %w", err)
+	}
+	return buf.Bytes(), nil
+}
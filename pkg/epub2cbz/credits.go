@@ -0,0 +1,65 @@
+package epub2cbz
+
+import (
+	"slices"
+	"strings"
+)
+
+// credit is a dc:creator or dc:contributor with its MARC relator code
+type credit struct {
+	Name        string
+	Role        string // MARC relator code like "aut" or "ill", empty when not given
+	ID          string
+	Contributor bool // dc:contributor rather than dc:creator
+}
+
+// marcRoles maps MARC relator codes onto the ComicInfo credit fields
+var marcRoles = map[string]func(info *ComicInfo) *string{
+	"aut": func(info *ComicInfo) *string { return &info.Writer },
+	"wat": func(info *ComicInfo) *string { return &info.Writer },
+	"art": func(info *ComicInfo) *string { return &info.Penciller },
+	"ill": func(info *ComicInfo) *string { return &info.Penciller },
+	"clr": func(info *ComicInfo) *string { return &info.Colorist },
+	"cov": func(info *ComicInfo) *string { return &info.CoverArtist },
+	"edt": func(info *ComicInfo) *string { return &info.Editor },
+	"trl": func(info *ComicInfo) *string { return &info.Translator },
+}
+
+// resolveCreditRoles gives the credits without opf:role attribute the role
+// of their EPUB 3 <meta refines="#id" property="role">
+func (m *Metadata) resolveCreditRoles() {
+	for i, c := range m.Credits {
+		if c.Role == "" && c.ID != "" {
+			c.Role = getFirst(m.Refines[c.ID]["role"])
+		}
+		m.Credits[i].Role = strings.ToLower(c.Role)
+	}
+}
+
+// hasCreditRoles reports whether a credit has a known role, in which case
+// the roles are trusted rather than guessed
+func (m Metadata) hasCreditRoles() bool {
+	return slices.ContainsFunc(m.Credits, func(c credit) bool {
+		_, ok := marcRoles[c.Role]
+		return ok
+	})
+}
+
+// applyCreditRoles fills the ComicInfo credits from the roles of the EPUB,
+// several people of a role being separated by ", ". Creators without a
+// role are writers.
+func applyCreditRoles(info *ComicInfo, metadata Metadata) {
+	for _, c := range metadata.Credits {
+		field, ok := marcRoles[c.Role]
+		if !ok && c.Role == "" && !c.Contributor {
+			field, ok = marcRoles["aut"], true
+		}
+		if !ok {
+			continue
+		}
+		people := field(info)
+		if !slices.Contains(strings.Split(*people, ", "), c.Name) {
+			*people = strings.TrimPrefix(*people+", "+c.Name, ", ")
+		}
+	}
+}
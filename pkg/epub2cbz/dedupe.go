@@ -0,0 +1,204 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// dedupeMinImageSize ignores the spacers and logos shared by unrelated books
+const dedupeMinImageSize = 4096
+
+// bookFingerprint identifies the content of an EPUB or a CBZ
+type bookFingerprint struct {
+	path     string
+	metadata string            // normalized series and number, or title
+	images   map[imageKey]bool // images larger than dedupeMinImageSize
+}
+
+// imageKey identifies an image by the CRC-32 and size recorded in the
+// archive, which are identical in an EPUB and in the CBZ converted from it
+// as long as images are not recompressed, and are read without decompressing
+type imageKey struct {
+	crc  uint32
+	size uint64
+}
+
+// findBooks lists the .epub and .cbz files of a directory
+func findBooks(dir string, recursive bool) ([]string, error) {
+	var books []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".epub", ".cbz":
+			books = append(books, path)
+		}
+		return nil
+	})
+	sort.Strings(books)
+	return books, err
+}
+
+// fingerprintBook reads the metadata and the image keys of a book
+func fingerprintBook(book string, logger *log.Logger) (*bookFingerprint, error) {
+	zipReader, err := zip.OpenReader(longPath(book))
+	if err != nil {
+		return nil, fmt.Errorf("error opening archive: %w", err)
+	}
+	defer zipReader.Close()
+
+	var info *ComicInfo
+	if strings.EqualFold(filepath.Ext(book), ".epub") {
+		pkg, _, err := readPackage(newArchiveIndex(zipReader.File))
+		if err != nil {
+			return nil, err
+		}
+		info = createComicInfo(pkg.Metadata)
+	} else {
+		info = &ComicInfo{}
+		if f := findZipEntry(zipReader.File, "ComicInfo.xml"); f != nil {
+			if err := readZipXML(f, info); err != nil {
+				logger.Printf("Warning: %s: invalid ComicInfo.xml: %v", book, err)
+			}
+		}
+	}
+
+	fingerprint := &bookFingerprint{path: book, images: make(map[imageKey]bool)}
+	if info.Series != "" && info.Number != "" {
+		fingerprint.metadata = fmt.Sprintf("%s #%s", strings.ToLower(info.Series), padNumber(info.Number, 3))
+	} else if info.Title != "" {
+		fingerprint.metadata = strings.ToLower(info.Title)
+	}
+	for _, f := range zipReader.File {
+		if f.UncompressedSize64 < dedupeMinImageSize || !isImageName(f.Name) {
+			continue
+		}
+		fingerprint.images[imageKey{crc: f.CRC32, size: f.UncompressedSize64}] = true
+	}
+	return fingerprint, nil
+}
+
+// isImageName reports whether an archive entry has an image extension
+func isImageName(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	if ext == ".jpeg" {
+		return true
+	}
+	for _, known := range imageExtensions {
+		if ext == known {
+			return true
+		}
+	}
+	return false
+}
+
+// duplicatePair is two books found to be the same, with the reasons
+type duplicatePair struct {
+	a, b    *bookFingerprint
+	reasons []string
+}
+
+// Duplicate is two books of a library that are probably the same
+type Duplicate struct {
+	A, B    string
+	Reasons []string
+}
+
+// FindDuplicates reports the EPUB and CBZ files of dir that share their
+// images or their metadata, before a conversion doubles the size of the
+// library. Threshold is the share of the images of the smaller book found in
+// the other one, between 0 and 1. It also returns the number of books read;
+// the ones that can't be read are logged to logger, nil for the standard
+// logger, and left out.
+func FindDuplicates(dir string, recursive bool, threshold float64, logger *log.Logger) ([]Duplicate, int, error) {
+	logger = loggerOrDefault(logger)
+	if threshold <= 0 || threshold > 1 {
+		return nil, 0, fmt.Errorf("invalid threshold %g, it must be between 0 and 1", threshold)
+	}
+	books, err := findBooks(dir, recursive)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading directory: %w", err)
+	}
+
+	var fingerprints []*bookFingerprint
+	for _, book := range books {
+		fingerprint, err := fingerprintBook(book, logger)
+		if err != nil {
+			logger.Printf("Error reading %s: %v", book, err)
+			continue
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	var duplicates []Duplicate
+	for _, pair := range findDuplicates(fingerprints, threshold) {
+		duplicates = append(duplicates, Duplicate{A: pair.a.path, B: pair.b.path, Reasons: pair.reasons})
+	}
+	return duplicates, len(fingerprints), nil
+}
+
+// findDuplicates compares the books sharing at least one image or their
+// metadata. Books are the same when most images of the smaller one are in
+// the other, or when they have the same metadata and about the same number
+// of images: a different edition of the same volume is still a duplicate.
+func findDuplicates(books []*bookFingerprint, threshold float64) []duplicatePair {
+	type pairKey struct{ a, b int }
+	shared := make(map[pairKey]int)
+	owners := make(map[imageKey][]int)
+	for i, book := range books {
+		for key := range book.images {
+			for _, j := range owners[key] {
+				shared[pairKey{j, i}]++
+			}
+			owners[key] = append(owners[key], i)
+		}
+	}
+	byMetadata := make(map[string][]int)
+	for i, book := range books {
+		if book.metadata == "" {
+			continue
+		}
+		for _, j := range byMetadata[book.metadata] {
+			if _, ok := shared[pairKey{j, i}]; !ok {
+				shared[pairKey{j, i}] = 0
+			}
+		}
+		byMetadata[book.metadata] = append(byMetadata[book.metadata], i)
+	}
+
+	var duplicates []duplicatePair
+	for pair, count := range shared {
+		a, b := books[pair.a], books[pair.b]
+		smaller, larger := min(len(a.images), len(b.images)), max(len(a.images), len(b.images))
+		var reasons []string
+		if smaller > 0 && float64(count)/float64(smaller) >= threshold {
+			reasons = append(reasons, fmt.Sprintf("%d%% of images shared", count*100/smaller))
+		}
+		if a.metadata != "" && a.metadata == b.metadata && larger > 0 && float64(smaller)/float64(larger) >= threshold {
+			reasons = append(reasons, fmt.Sprintf("same metadata (%s), %d and %d images", a.metadata, len(a.images), len(b.images)))
+		}
+		if len(reasons) > 0 {
+			duplicates = append(duplicates, duplicatePair{a: a, b: b, reasons: reasons})
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].a.path != duplicates[j].a.path {
+			return duplicates[i].a.path < duplicates[j].a.path
+		}
+		return duplicates[i].b.path < duplicates[j].b.path
+	})
+	return duplicates
+}
@@ -0,0 +1,241 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math/bits"
+	"reflect"
+	"strings"
+)
+
+// diffMaxDistance is the number of differing bits of two perceptual hashes
+// below which two images show the same page
+const diffMaxDistance = 10
+
+// diffPage is a page of a book compared by DiffBooks
+type diffPage struct {
+	name    string // image path in the archive
+	file    *zip.File
+	key     imageKey
+	hash    uint64 // perceptual hash, computed for the pages without exact match
+	matched bool
+}
+
+// BookDiff is the comparison of an EPUB and of the CBZ converted from it
+type BookDiff struct {
+	EPUBPages, CBZPages int      // number of pages of each book
+	Identical, Similar  int      // pages matched exactly and by perceptual hash
+	OnlyInEPUB          []string // pages of the EPUB without match, as "number: name"
+	OnlyInCBZ           []string // pages of the CBZ without match, as "number: name"
+	Metadata            []string // metadata differing, as "Field: EPUB value, CBZ value"
+}
+
+// Different reports whether pages or metadata differ between the books
+func (d *BookDiff) Different() bool {
+	return len(d.OnlyInEPUB) > 0 || len(d.OnlyInCBZ) > 0 || len(d.Metadata) > 0
+}
+
+// DiffBooks compares the pages and the metadata of an EPUB and of a CBZ, to
+// check a conversion before deleting the EPUB. With perceptual, the pages
+// without an exact copy are matched by perceptual hash, for recompressed
+// images. The invalid metadata is logged to logger, nil for the standard
+// logger.
+func DiffBooks(epubPath string, cbzPath string, perceptual bool, logger *log.Logger) (*BookDiff, error) {
+	epubReader, err := zip.OpenReader(longPath(epubPath))
+	if err != nil {
+		return nil, fmt.Errorf("error opening EPUB file: %w", err)
+	}
+	defer epubReader.Close()
+	epubPages, epubInfo, err := epubDiffPages(epubReader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", epubPath, err)
+	}
+
+	cbzReader, err := zip.OpenReader(longPath(cbzPath))
+	if err != nil {
+		return nil, fmt.Errorf("error opening CBZ file: %w", err)
+	}
+	defer cbzReader.Close()
+	var cbzPages []*diffPage
+	for _, f := range cbzReader.File {
+		if isImageName(f.Name) {
+			cbzPages = append(cbzPages, &diffPage{name: f.Name, file: f, key: imageKey{crc: f.CRC32, size: f.UncompressedSize64}})
+		}
+	}
+	cbzInfo := &ComicInfo{}
+	if f := findZipEntry(cbzReader.File, "ComicInfo.xml"); f != nil {
+		if err := readZipXML(f, cbzInfo); err != nil {
+			loggerOrDefault(logger).Printf("Warning: %s: invalid ComicInfo.xml: %v", cbzPath, err)
+		}
+	}
+
+	diff := &BookDiff{EPUBPages: len(epubPages), CBZPages: len(cbzPages)}
+	diff.Identical = matchExactPages(epubPages, cbzPages)
+	if perceptual {
+		diff.Similar = matchSimilarPages(epubPages, cbzPages)
+	}
+	diff.OnlyInEPUB = unmatchedPages(epubPages)
+	diff.OnlyInCBZ = unmatchedPages(cbzPages)
+	diff.Metadata = comicInfoDifferences(epubInfo, cbzInfo)
+	return diff, nil
+}
+
+// unmatchedPages lists the pages without match in the other book
+func unmatchedPages(pages []*diffPage) []string {
+	var unmatched []string
+	for i, page := range pages {
+		if !page.matched {
+			unmatched = append(unmatched, fmt.Sprintf("%d: %s", i+1, page.name))
+		}
+	}
+	return unmatched
+}
+
+// epubDiffPages returns the images of an EPUB in reading order, and its
+// metadata as written in ComicInfo.xml
+func epubDiffPages(reader *zip.ReadCloser) ([]*diffPage, *ComicInfo, error) {
+	index := newArchiveIndex(reader.File)
+	pkg, opfPath, err := readPackage(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pages []*diffPage
+	logger := log.New(io.Discard, "", 0)
+	for _, href := range spinePages(pkg, opfPath) {
+		for _, src := range readPage(index, href, false, logger).images {
+			if f, ok := index.lookup(src); ok {
+				pages = append(pages, &diffPage{name: src, file: f, key: imageKey{crc: f.CRC32, size: f.UncompressedSize64}})
+			}
+		}
+	}
+	return pages, createComicInfo(pkg.Metadata), nil
+}
+
+// matchExactPages matches the pages of two books holding the same image
+// bytes, each page matching at most one page of the other book
+func matchExactPages(a []*diffPage, b []*diffPage) int {
+	byKey := make(map[imageKey][]*diffPage)
+	for _, page := range b {
+		byKey[page.key] = append(byKey[page.key], page)
+	}
+	matched := 0
+	for _, page := range a {
+		if candidates := byKey[page.key]; len(candidates) > 0 {
+			page.matched, candidates[0].matched = true, true
+			byKey[page.key] = candidates[1:]
+			matched++
+		}
+	}
+	return matched
+}
+
+// matchSimilarPages matches the pages left of two books whose perceptual
+// hashes are close, pairing each page with the closest page of the other
+func matchSimilarPages(a []*diffPage, b []*diffPage) int {
+	var left []*diffPage
+	for _, page := range b {
+		if !page.matched && hashPage(page) {
+			left = append(left, page)
+		}
+	}
+	matched := 0
+	for _, page := range a {
+		if page.matched || !hashPage(page) {
+			continue
+		}
+		var best *diffPage
+		bestDistance := diffMaxDistance + 1
+		for _, candidate := range left {
+			if distance := bits.OnesCount64(page.hash ^ candidate.hash); !candidate.matched && distance < bestDistance {
+				best, bestDistance = candidate, distance
+			}
+		}
+		if best != nil {
+			page.matched, best.matched = true, true
+			matched++
+		}
+	}
+	return matched
+}
+
+// hashPage computes the perceptual hash of a page, and reports whether its
+// image could be decoded
+func hashPage(page *diffPage) bool {
+	r, err := page.file.Open()
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return false
+	}
+	page.hash = differenceHash(img)
+	return true
+}
+
+// differenceHash is a perceptual hash of an image: the image is reduced to
+// 9x8 gray cells, and each bit tells whether a cell is brighter than the one
+// on its right. It survives recompression and resizing.
+func differenceHash(img image.Image) uint64 {
+	bounds := img.Bounds()
+	var cells [8][9]uint32
+	for row := range 8 {
+		for col := range 9 {
+			// Cells are averaged on a 4x4 grid of samples
+			var sum uint32
+			for sy := range 4 {
+				for sx := range 4 {
+					x := bounds.Min.X + (col*4+sx)*bounds.Dx()/36
+					y := bounds.Min.Y + (row*4+sy)*bounds.Dy()/32
+					r, g, b, _ := img.At(x, y).RGBA()
+					sum += (299*r + 587*g + 114*b) / 1000
+				}
+			}
+			cells[row][col] = sum
+		}
+	}
+	var hash uint64
+	for row := range 8 {
+		for col := range 8 {
+			hash <<= 1
+			if cells[row][col] > cells[row][col+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// comicInfoDifferences lists the text and number fields of the metadata of
+// an EPUB missing or different in the ComicInfo of a CBZ, as "Field: a, b"
+// lines. Fields only found in the CBZ, like the inferred format, were added
+// by the conversion and are not differences.
+func comicInfoDifferences(a *ComicInfo, b *ComicInfo) []string {
+	var differences []string
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := va.Type()
+	for i := 0; i < t.NumField(); i++ {
+		var x, y string
+		switch t.Field(i).Type.Kind() {
+		case reflect.String:
+			x, y = va.Field(i).String(), vb.Field(i).String()
+		case reflect.Int:
+			if va.Field(i).Int() != 0 {
+				x = fmt.Sprint(va.Field(i).Int())
+			}
+			if vb.Field(i).Int() != 0 {
+				y = fmt.Sprint(vb.Field(i).Int())
+			}
+		default:
+			continue
+		}
+		if strings.TrimSpace(x) != "" && strings.TrimSpace(x) != strings.TrimSpace(y) {
+			differences = append(differences, fmt.Sprintf("%s: %q, %q", t.Field(i).Name, x, y))
+		}
+	}
+	return differences
+}
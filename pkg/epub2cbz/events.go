@@ -0,0 +1,123 @@
+package epub2cbz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status of a book once processed
+const (
+	StatusConverted = "converted"
+	StatusSkipped   = "skipped"
+	StatusFailed    = "failed"
+)
+
+// Events follow the books of a batch, for progress bars and records of the
+// conversions. Every function may be nil; they are called from the
+// goroutines converting the books, in parallel.
+type Events struct {
+	BatchStart func(books int)         // a directory or manifest starts with this number of books
+	FileStart  func(source string)     // a book starts being converted
+	Page       func()                  // a page was written to an archive
+	FileDone   func(result FileResult) // a book was converted, skipped or failed
+}
+
+// FileResult is the outcome of a book
+type FileResult struct {
+	Source      string
+	Destination string
+	Status      string        // StatusConverted, StatusSkipped or StatusFailed
+	Pages       int           // pages written to the archive
+	Bytes       int64         // size of the archive
+	Warnings    []string      // warnings logged during the conversion
+	Duration    time.Duration // time spent on the book
+	Err         error         // why the book was skipped or failed
+}
+
+// newFileResult returns the outcome of a book from the result of processFile
+func newFileResult(epubPath string, outputPath string, stats *conversionStats, warnings []string, duration time.Duration, err error) FileResult {
+	result := FileResult{Source: epubPath, Destination: outputPath, Status: StatusConverted, Warnings: warnings, Duration: duration, Err: err}
+	switch {
+	case IsSkipped(err):
+		result.Status = StatusSkipped
+	case err != nil:
+		result.Status = StatusFailed
+	case stats != nil:
+		result.Pages, result.Bytes = stats.Images, stats.OutputBytes
+	}
+	return result
+}
+
+func (e Events) batchStart(books int) {
+	if e.BatchStart != nil {
+		e.BatchStart(books)
+	}
+}
+
+func (e Events) fileStart(source string) {
+	if e.FileStart != nil {
+		e.FileStart(source)
+	}
+}
+
+func (e Events) page() {
+	if e.Page != nil {
+		e.Page()
+	}
+}
+
+// fileFailed reports a book that failed before its conversion started
+func (e Events) fileFailed(source string, destination string, err error) {
+	if e.FileDone != nil {
+		e.FileDone(FileResult{Source: source, Destination: destination, Status: StatusFailed, Err: err})
+	}
+}
+
+// logger returns the logger of the warnings and errors of the conversions
+func (opts Options) logger() *log.Logger {
+	return loggerOrDefault(opts.Logger)
+}
+
+// loggerOrDefault returns logger, or the standard logger when nil
+func loggerOrDefault(logger *log.Logger) *log.Logger {
+	if logger == nil {
+		return log.Default()
+	}
+	return logger
+}
+
+// printf writes a message of the conversions to Output
+func (opts Options) printf(format string, args ...any) {
+	if opts.Output != nil {
+		fmt.Fprintf(opts.Output, format, args...)
+	}
+}
+
+// warningRecorder keeps the warnings logged for a file, passing every
+// message on to the log
+type warningRecorder struct {
+	out      io.Writer
+	mutex    sync.Mutex
+	warnings []string
+}
+
+func (w *warningRecorder) Write(message []byte) (int, error) {
+	if _, warning, ok := bytes.Cut(message, []byte("Warning: ")); ok {
+		w.mutex.Lock()
+		w.warnings = append(w.warnings, strings.TrimSpace(string(warning)))
+		w.mutex.Unlock()
+	}
+	return w.out.Write(message)
+}
+
+// list returns the warnings recorded so far
+func (w *warningRecorder) list() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.warnings
+}
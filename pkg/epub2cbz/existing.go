@@ -0,0 +1,97 @@
+package epub2cbz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Policies for outputs that already exist
+const (
+	ExistingOverwrite = "overwrite" // convert again, replacing the output
+	ExistingSkip      = "skip"      // keep the output, skipping the book
+	ExistingIfNewer   = "if-newer"  // convert again when the EPUB is more recent than the output
+)
+
+// validateExistingPolicy checks the policy for existing outputs, empty
+// meaning ExistingOverwrite
+func validateExistingPolicy(policy string) error {
+	switch policy {
+	case "", ExistingOverwrite, ExistingSkip, ExistingIfNewer:
+		return nil
+	}
+	return fmt.Errorf("invalid policy for existing outputs %q (expected %s, %s or %s)", policy, ExistingOverwrite, ExistingSkip, ExistingIfNewer)
+}
+
+// existingOutput returns the file written last by a conversion when it is
+// there, or "" when the book was not converted: the PDF replacing the CBZ
+// with -pdf-only, the folder extracted from it with -extract-dir, or the first
+// part of a book split with -split-chapters or -split-volumes
+func existingOutput(outputPath string, opts Options) (string, error) {
+	base := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	target := outputPath
+	switch {
+	case opts.ExtractDir:
+		target = base
+	case opts.PDFOnly:
+		target = base + ".pdf"
+	}
+	if _, err := os.Stat(longPath(target)); !errors.Is(err, os.ErrNotExist) {
+		return target, err
+	}
+	if !opts.SplitChapters && !opts.SplitVolumes {
+		return "", nil
+	}
+
+	// A split book is replaced by its parts, "<name> - 01 - <title>.cbz" or
+	// "<name> - Vol. 01.cbz", found in name order
+	dir, prefix := filepath.Dir(outputPath), filepath.Base(base)+" - "
+	entries, err := os.ReadDir(longPath(dir))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		part, ok := strings.CutPrefix(entry.Name(), prefix)
+		if ok && strings.HasSuffix(part, ".cbz") && (strings.HasPrefix(part, "Vol. ") || unicode.IsDigit(rune(part[0]))) {
+			return filepath.Join(dir, entry.Name()), nil
+		}
+	}
+	return "", nil
+}
+
+// checkExisting applies the policy for existing outputs, returning a
+// skippedError when the output of a book is kept. Remote outputs are always
+// written.
+func checkExisting(epubPath string, outputPath string, opts Options) error {
+	if opts.Existing == "" || opts.Existing == ExistingOverwrite || IsRemoteURL(outputPath) {
+		return nil
+	}
+	target, err := existingOutput(outputPath, opts)
+	if err != nil {
+		return fmt.Errorf("error checking output %s: %w", outputPath, err)
+	}
+	if target == "" {
+		return nil
+	}
+	info, err := os.Stat(longPath(target))
+	if err != nil {
+		return fmt.Errorf("error checking output %s: %w", target, err)
+	}
+	if opts.Existing == ExistingIfNewer {
+		modTime, err := sourceModTime(epubPath)
+		if err != nil {
+			return fmt.Errorf("error reading EPUB modification time: %w", err)
+		}
+		if modTime.After(info.ModTime()) {
+			return nil
+		}
+		return &skippedError{fmt.Sprintf("%s is up to date", target)}
+	}
+	return &skippedError{fmt.Sprintf("%s already exists", target)}
+}
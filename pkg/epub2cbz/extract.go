@@ -0,0 +1,71 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// extractCBZ writes the entries of a converted CBZ, its pages and
+// ComicInfo.xml, into a folder named after it, and removes the CBZ. Entry
+// times are kept when modTime is set.
+func extractCBZ(cbzPath string, modTime time.Time) (string, error) {
+	dir := strings.TrimSuffix(cbzPath, filepath.Ext(cbzPath))
+	reader, err := zip.OpenReader(longPath(cbzPath))
+	if err != nil {
+		return "", fmt.Errorf("error opening CBZ file: %w", err)
+	}
+	defer reader.Close()
+
+	for _, f := range reader.File {
+		// Entries keeping their EPUB path must stay inside the folder
+		if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+			return "", fmt.Errorf("error extracting %s: invalid entry name", f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(longPath(filepath.Dir(target)), 0755); err != nil {
+			return "", fmt.Errorf("error creating output directory: %w", err)
+		}
+		if err := extractEntry(f, target); err != nil {
+			return "", err
+		}
+		if !modTime.IsZero() {
+			if err := os.Chtimes(longPath(target), modTime, modTime); err != nil {
+				return "", fmt.Errorf("error setting modification time of %s: %w", target, err)
+			}
+		}
+	}
+	reader.Close()
+	if err := os.Remove(longPath(cbzPath)); err != nil {
+		return "", fmt.Errorf("error removing CBZ file: %w", err)
+	}
+	return dir, nil
+}
+
+// extractEntry copies an archive entry to a file
+func extractEntry(f *zip.File, target string) error {
+	r, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", f.Name, err)
+	}
+	defer r.Close()
+	w, err := os.Create(longPath(target))
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", target, err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return fmt.Errorf("error writing %s: %w", target, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", target, err)
+	}
+	return nil
+}
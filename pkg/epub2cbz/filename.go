@@ -0,0 +1,104 @@
+package epub2cbz
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// filenameFields are the placeholders of a -parse-filename template, with
+// the text they match
+var filenameFields = map[string]string{
+	"series": `.+?`,
+	"title":  `.+?`,
+	"volume": `\d+`,
+	"number": `\d+(?:\.\d+)?`,
+	"year":   `\d{4}`,
+	"*":      `.*?`, // ignored text, like scan group tags
+}
+
+// filenamePlaceholder matches the placeholders of a template, "{series}"
+var filenamePlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// compileFilenamePattern turns a template like "{series} v{volume} - {title}"
+// into a regexp matching whole file names without extension. Literal text
+// is matched ignoring case.
+func compileFilenamePattern(template string) (*regexp.Regexp, error) {
+	var pattern strings.Builder
+	pattern.WriteString(`(?i)^`)
+	seen := make(map[string]bool)
+	last := 0
+	for _, match := range filenamePlaceholder.FindAllStringSubmatchIndex(template, -1) {
+		name := strings.ToLower(template[match[2]:match[3]])
+		expr, ok := filenameFields[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s} in file name template (expected series, title, volume, number, year or *)", name)
+		}
+		if seen[name] && name != "*" {
+			return nil, fmt.Errorf("placeholder {%s} given twice in file name template", name)
+		}
+		seen[name] = true
+		pattern.WriteString(regexp.QuoteMeta(template[last:match[0]]))
+		if name == "*" {
+			pattern.WriteString(expr)
+		} else {
+			fmt.Fprintf(&pattern, `(?P<%s>%s)`, name, expr)
+		}
+		last = match[1]
+	}
+	if len(seen) == 0 || (len(seen) == 1 && seen["*"]) {
+		return nil, fmt.Errorf("file name template %q has no placeholder", template)
+	}
+	pattern.WriteString(regexp.QuoteMeta(template[last:]))
+	pattern.WriteString(`$`)
+	return regexp.Compile(pattern.String())
+}
+
+// validateFilenamePattern checks the file name template given on the command line
+func validateFilenamePattern(template string) error {
+	if template == "" {
+		return nil
+	}
+	_, err := compileFilenamePattern(template)
+	return err
+}
+
+// parseFilenameMetadata fills the metadata missing from the OPF with the
+// values read from the EPUB file name by a template. The metadata of the
+// EPUB always wins; file names not matching the template are ignored.
+func parseFilenameMetadata(epubPath string, template string, metadata Metadata) Metadata {
+	if template == "" {
+		return metadata
+	}
+	pattern, err := compileFilenamePattern(template)
+	if err != nil {
+		return metadata
+	}
+	baseName := strings.TrimSuffix(filepath.Base(epubPath), filepath.Ext(epubPath))
+	match := pattern.FindStringSubmatch(baseName)
+	if match == nil {
+		return metadata
+	}
+
+	fill := func(dst *[]string, value string) {
+		if value = strings.TrimSpace(value); value != "" && len(*dst) == 0 {
+			*dst = []string{value}
+		}
+	}
+	for i, name := range pattern.SubexpNames() {
+		switch name {
+		case "series":
+			fill(&metadata.Series, match[i])
+		case "title":
+			fill(&metadata.Title, match[i])
+		case "volume":
+			fill(&metadata.Volume, formatSeriesIndex(match[i]))
+		case "number":
+			fill(&metadata.Number, formatSeriesIndex(match[i]))
+		case "year":
+			fill(&metadata.Date, match[i])
+		}
+	}
+	return metadata
+}
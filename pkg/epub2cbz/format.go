@@ -0,0 +1,49 @@
+package epub2cbz
+
+import "regexp"
+
+// ComicInfo formats inferred from the books
+const (
+	FormatDigital = "Digital"
+	FormatOmnibus = "Omnibus"
+	FormatOneShot = "One-Shot"
+	FormatTPB     = "TPB"
+	FormatAnnual  = "Annual"
+)
+
+// omnibusPages is the number of pages above which a book is an omnibus
+const omnibusPages = 600
+
+// formatKeywords recognize the format of a book from its title or series,
+// the first match wins
+var formatKeywords = []struct {
+	pattern *regexp.Regexp
+	format  string
+}{
+	{regexp.MustCompile(`(?i)\bomnibus\b`), FormatOmnibus},
+	{regexp.MustCompile(`(?i)\bone[- ]?shot\b`), FormatOneShot},
+	{regexp.MustCompile(`(?i)\b(?:tpb|trade paperback)\b`), FormatTPB},
+	{regexp.MustCompile(`(?i)\bannual\b`), FormatAnnual},
+}
+
+// inferFormat guesses the format of a book: from keywords of its title,
+// series or EPUB 3 collections, then omnibus for books holding several
+// volumes or many pages, and digital otherwise since every EPUB is a digital
+// edition. A book outside of any series is not assumed to be a one-shot.
+func inferFormat(info *ComicInfo, collections []collectionMeta, pages int, volumes int) string {
+	names := []string{info.Title, info.Series}
+	for _, collection := range collections {
+		names = append(names, collection.Name)
+	}
+	for _, keyword := range formatKeywords {
+		for _, name := range names {
+			if keyword.pattern.MatchString(name) {
+				return keyword.format
+			}
+		}
+	}
+	if volumes > 1 || pages > omnibusPages {
+		return FormatOmnibus
+	}
+	return FormatDigital
+}
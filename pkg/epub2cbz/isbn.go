@@ -0,0 +1,78 @@
+package epub2cbz
+
+import "strings"
+
+// isbnURN is the prefix of ISBN identifiers in EPUB 3, which EPUB 2 gives
+// as opf:scheme="ISBN" instead
+const isbnURN = "urn:isbn:"
+
+// isISBNURN reports whether an identifier is an ISBN URN
+func isISBNURN(identifier string) bool {
+	return len(identifier) >= len(isbnURN) && strings.EqualFold(identifier[:len(isbnURN)], isbnURN)
+}
+
+// isbn13 returns an ISBN as the 13 digits of its EAN, converting ISBN-10,
+// or an empty string when the checksum is wrong
+func isbn13(isbn string) string {
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return r
+		case r == 'x' || r == 'X':
+			return 'X'
+		case r == '-' || r == ' ':
+			return -1
+		}
+		return '?'
+	}, isbn)
+
+	switch len(digits) {
+	case 10:
+		sum := 0
+		for i, d := range digits {
+			value := int(d - '0')
+			if d == 'X' && i == 9 {
+				value = 10
+			} else if d < '0' || d > '9' {
+				return ""
+			}
+			sum += (10 - i) * value
+		}
+		if sum%11 != 0 {
+			return ""
+		}
+		digits = "978" + digits[:9]
+		return digits + string(rune('0'+eanCheckDigit(digits)))
+	case 13:
+		if strings.ContainsAny(digits, "X?") || int(digits[12]-'0') != eanCheckDigit(digits[:12]) {
+			return ""
+		}
+		return digits
+	}
+	return ""
+}
+
+// eanCheckDigit computes the check digit of the first 12 digits of an EAN-13
+func eanCheckDigit(digits string) int {
+	sum := 0
+	for i, d := range digits {
+		sum += int(d-'0') * (1 + 2*(i%2))
+	}
+	return (10 - sum%10) % 10
+}
+
+// bookGTIN returns the GTIN of a book, the EAN-13 of its first ISBN
+// identifier: an ISBN URN, or bare ISBN-13 digits
+func bookGTIN(identifiers []string) string {
+	for _, identifier := range identifiers {
+		if isISBNURN(identifier) {
+			identifier = identifier[len(isbnURN):]
+		} else if !strings.HasPrefix(identifier, "978") && !strings.HasPrefix(identifier, "979") {
+			continue
+		}
+		if gtin := isbn13(identifier); gtin != "" {
+			return gtin
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package epub2cbz
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// kindleMaxSize is the largest document the Send to Kindle email service accepts
+const kindleMaxSize = 50 << 20
+
+// kindleQuality is the JPEG quality of the pages fitted to a Kindle device
+const kindleQuality = 90
+
+// Kindle device profiles the pages sent to Kindle are fitted to
+const (
+	KindleNone       = "none"       // send the pages as converted
+	KindleBasic      = "basic"      // Kindle, 1072x1448 grayscale
+	KindlePaperwhite = "paperwhite" // Kindle Paperwhite and Oasis, 1264x1680 grayscale
+	KindleScribe     = "scribe"     // Kindle Scribe, 1860x2480 grayscale
+	KindleColorsoft  = "colorsoft"  // Kindle Colorsoft, 1264x1680 in color
+)
+
+// kindleProfile is the screen of a Kindle device
+type kindleProfile struct {
+	width  int
+	height int
+	color  bool
+}
+
+var kindleProfiles = map[string]kindleProfile{
+	KindleBasic:      {1072, 1448, false},
+	KindlePaperwhite: {1264, 1680, false},
+	KindleScribe:     {1860, 2480, false},
+	KindleColorsoft:  {1264, 1680, true},
+}
+
+// validateKindleDevice checks the Kindle device given on the command line
+func validateKindleDevice(device string) error {
+	if _, ok := kindleProfiles[device]; ok || device == KindleNone {
+		return nil
+	}
+	return fmt.Errorf("invalid Kindle device %q (expected %s, %s, %s, %s or %s)", device, KindleBasic, KindlePaperwhite, KindleScribe, KindleColorsoft, KindleNone)
+}
+
+// fit shrinks a page to the screen of the device, keeping its proportions,
+// and converts it to grayscale for the devices without color. Pages are
+// never enlarged, the ones already fitting are kept as they are.
+func (profile kindleProfile) fit(data []byte) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %w", err)
+	}
+	bounds := src.Bounds()
+	scale := min(1, float64(profile.width)/float64(bounds.Dx()), float64(profile.height)/float64(bounds.Dy()))
+	if scale == 1 && (profile.color || isGrayImage(src)) {
+		return data, nil
+	}
+	size := image.Rect(0, 0, max(1, int(float64(bounds.Dx())*scale)), max(1, int(float64(bounds.Dy())*scale)))
+	var dst draw.Image = image.NewRGBA(size)
+	if !profile.color {
+		dst = image.NewGray(size)
+	}
+	// Transparent pixels are shown over white, like readers display pages
+	draw.Draw(dst, size, image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, size, src, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: kindleQuality}); err != nil {
+		return nil, fmt.Errorf("error encoding page: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// sendToKindle emails a converted book to a Send to Kindle address. The
+// service does not accept CBZ files, the pages are sent as a PDF instead.
+// The SMTP sender must be in the approved list of the Amazon account. The
+// pages are fitted to the device, unless it is KindleNone.
+func sendToKindle(address string, device string, cbzPath string, info *ComicInfo) error {
+	if IsRemoteURL(cbzPath) {
+		return fmt.Errorf("error sending to Kindle: remote outputs are not supported")
+	}
+	var fit func([]byte) ([]byte, error)
+	if profile, ok := kindleProfiles[device]; ok {
+		fit = profile.fit
+	}
+	var document bytes.Buffer
+	if err := writePDF(cbzPath, &document, info, fit); err != nil {
+		return fmt.Errorf("error sending to Kindle: %w", err)
+	}
+	if document.Len() > kindleMaxSize {
+		return fmt.Errorf("error sending to Kindle: %s is larger than the %d MB accepted", FormatBytes(int64(document.Len())), kindleMaxSize>>20)
+	}
+
+	baseName := strings.TrimSuffix(filepath.Base(cbzPath), filepath.Ext(cbzPath))
+	attachment := emailAttachment{name: baseName + ".pdf", contentType: "application/pdf", data: document.Bytes()}
+	if err := sendEmail(address, pdfTitle(cbzPath, info), "Sent by epub2cbz.", attachment); err != nil {
+		return fmt.Errorf("error sending to Kindle: %w", err)
+	}
+	return nil
+}
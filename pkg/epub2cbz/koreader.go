@@ -0,0 +1,69 @@
+package epub2cbz
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// koreaderSidecar returns the metadata file KOReader reads for a book, in the
+// "<name>.sdr" folder next to it
+func koreaderSidecar(bookPath string) string {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(bookPath)), ".")
+	dir := strings.TrimSuffix(bookPath, filepath.Ext(bookPath)) + ".sdr"
+	return filepath.Join(dir, "metadata."+ext+".lua")
+}
+
+// writeKOReaderMetadata writes the sidecar metadata of a converted book, so
+// KOReader shows its title, series and authors. An existing sidecar is left
+// untouched, it holds the reading progress.
+func writeKOReaderMetadata(bookPath string, info *ComicInfo) error {
+	sidecar := koreaderSidecar(bookPath)
+	if _, err := os.Stat(longPath(sidecar)); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	var props strings.Builder
+	addProp := func(name string, value string) {
+		if value != "" {
+			fmt.Fprintf(&props, "        [%s] = %s,\n", luaString(name), luaString(value))
+		}
+	}
+	addProp("title", firstNonEmpty(info.Title, info.Series))
+	// Authors are separated by new lines in KOReader
+	var authors []string
+	for _, name := range strings.Split(info.Writer, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			authors = append(authors, name)
+		}
+	}
+	addProp("authors", strings.Join(authors, "\n"))
+	addProp("series", info.Series)
+	if number, err := strconv.ParseFloat(strings.TrimSpace(info.Number), 64); err == nil {
+		fmt.Fprintf(&props, "        [\"series_index\"] = %s,\n", strconv.FormatFloat(number, 'f', -1, 64))
+	}
+	addProp("language", info.LanguageISO)
+	addProp("description", info.Summary)
+	addProp("keywords", strings.ReplaceAll(info.Genre, ", ", "\n"))
+
+	// custom_props is what the book information dialog edits and displays
+	content := "-- " + filepath.Base(sidecar) + "\nreturn {\n" +
+		"    [\"doc_props\"] = {\n" + props.String() + "    },\n" +
+		"    [\"custom_props\"] = {\n" + props.String() + "    },\n" +
+		"}\n"
+	if err := os.MkdirAll(longPath(filepath.Dir(sidecar)), 0755); err != nil {
+		return fmt.Errorf("error creating KOReader sidecar: %w", err)
+	}
+	if err := os.WriteFile(longPath(sidecar), []byte(content), 0644); err != nil {
+		return fmt.Errorf("error writing KOReader sidecar: %w", err)
+	}
+	return nil
+}
+
+// luaString quotes a string as a Lua literal
+func luaString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(s) + `"`
+}
@@ -0,0 +1,242 @@
+package epub2cbz
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A layout names the output of a book from its metadata, for library servers
+// that expect a given folder structure. It returns the path components of
+// the output relative to the library root, without the .cbz extension.
+type layout func(info *ComicInfo, baseName string) []string
+
+// layouts are the values accepted by -layout
+var layouts = map[string]layout{
+	"kapowarr":  mylarLayout,
+	"kavita":    kavitaLayout,
+	"komga":     komgaLayout,
+	"mylar":     mylarLayout,
+	"tachiyomi": tachiyomiLayout,
+}
+
+// A naming names the output file of a book from its metadata, keeping the
+// folders of the layout or of the source structure. Number is the chapter.
+type naming func(info *ComicInfo, baseName string) string
+
+// namings are the values accepted by -chapter-naming
+var namings = map[string]naming{
+	"mangadex": mangadexNaming,
+}
+
+// validateLayout checks that a layout given on the command line is known
+func validateLayout(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := layouts[name]; !ok {
+		return fmt.Errorf("invalid layout %q (expected one of %s)", name, knownNames(layouts))
+	}
+	return nil
+}
+
+// validateNaming checks that a chapter naming given on the command line is known
+func validateNaming(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := namings[name]; !ok {
+		return fmt.Errorf("invalid chapter naming %q (expected one of %s)", name, knownNames(namings))
+	}
+	return nil
+}
+
+// knownNames lists the keys of a registry for error messages
+func knownNames[T any](registry map[string]T) string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// layoutOutputPath returns the output path of an EPUB under a library root,
+// organized with the layout of the options
+func layoutOutputPath(root string, epubPath string, opts Options) (string, error) {
+	metadata, err := readEPUBMetadata(epubPath, opts)
+	if err != nil {
+		return "", err
+	}
+	baseName := strings.TrimSuffix(filepath.Base(epubPath), filepath.Ext(epubPath))
+	overrides, err := bookOverrides(epubPath, opts)
+	if err != nil {
+		return "", err
+	}
+	info := createComicInfo(metadata)
+	applyOverrides(info, overrides)
+	parts := layouts[opts.Layout](info, baseName)
+	if opts.ChapterNaming != "" {
+		parts[len(parts)-1] = namings[opts.ChapterNaming](info, baseName)
+	}
+
+	for i, part := range parts {
+		parts[i] = safePathComponent(part, opts)
+	}
+	if IsRemoteURL(root) {
+		return joinRemotePath(root, parts...) + ".cbz", nil
+	}
+	return filepath.Join(root, filepath.Join(parts...)) + ".cbz", nil
+}
+
+// namedOutputPath renames the file of an output path with the chapter naming
+// of the options, keeping its directory
+func namedOutputPath(outputPath string, epubPath string, opts Options) (string, error) {
+	metadata, err := readEPUBMetadata(epubPath, opts)
+	if err != nil {
+		return "", err
+	}
+	baseName := strings.TrimSuffix(filepath.Base(epubPath), filepath.Ext(epubPath))
+	overrides, err := bookOverrides(epubPath, opts)
+	if err != nil {
+		return "", err
+	}
+	info := createComicInfo(metadata)
+	applyOverrides(info, overrides)
+	name := namings[opts.ChapterNaming](info, baseName)
+	dir := outputPath[:len(outputPath)-len(filepath.Base(outputPath))]
+	return dir + safePathComponent(name, opts) + ".cbz", nil
+}
+
+// safePathComponent sanitizes a name built from metadata, which must never
+// create unexpected directories whatever the sanitize policy
+func safePathComponent(name string, opts Options) string {
+	separators := strings.NewReplacer("/", "_", `\`, "_")
+	return sanitizeFileName(separators.Replace(name), opts.Sanitize)
+}
+
+// komgaLayout writes "Series/Series #NN.cbz", which Komga groups by folder
+// and orders by the number found in the file name
+func komgaLayout(info *ComicInfo, baseName string) []string {
+	series := firstNonEmpty(info.Series, info.Title, baseName)
+	switch {
+	case info.Number != "":
+		return []string{series, series + " #" + padNumber(info.Number, 2)}
+	case info.Volume > 0:
+		return []string{series, fmt.Sprintf("%s #%02d", series, info.Volume)}
+	}
+	return []string{series, baseName}
+}
+
+// kavitaLayout writes "Series/Series Vol.X Ch.Y.cbz", the markers parsed by
+// Kavita. Books of a series without number go to the Specials folder, and
+// books without series are one-shots named after their title.
+func kavitaLayout(info *ComicInfo, baseName string) []string {
+	format := strings.ToLower(strings.ReplaceAll(info.Format, " ", ""))
+	if info.Series == "" || format == "one-shot" || format == "oneshot" {
+		title := firstNonEmpty(info.Title, info.Series, baseName)
+		return []string{title, title}
+	}
+
+	series := strings.TrimSpace(info.Series)
+	number := strings.TrimSpace(info.Number)
+	if format == "special" || (number == "" && info.Volume == 0) {
+		return []string{series, "Specials", firstNonEmpty(info.Title, baseName)}
+	}
+
+	name := series
+	if info.Volume > 0 {
+		name += fmt.Sprintf(" Vol.%d", info.Volume)
+	}
+	if number != "" {
+		name += " Ch." + number
+	}
+	return []string{series, name}
+}
+
+// mylarLayout writes "Series (Year)/Series v01 #001 (Year).cbz", the folder
+// and file patterns matched by Mylar and Kapowarr to monitor issues
+func mylarLayout(info *ComicInfo, baseName string) []string {
+	series := firstNonEmpty(info.Series, info.Title, baseName)
+	year := ""
+	if info.Year > 0 {
+		year = fmt.Sprintf(" (%d)", info.Year)
+	}
+
+	name := series
+	if info.Volume > 0 {
+		name += fmt.Sprintf(" v%02d", info.Volume)
+	}
+	if number := strings.TrimSpace(info.Number); number != "" {
+		name += " #" + padNumber(number, 3)
+	} else if info.Volume == 0 && series != baseName {
+		// Without number the title tells the books of a series apart
+		name = baseName
+	}
+	return []string{series + year, name + year}
+}
+
+// tachiyomiLayout writes "Series/Vol.1 Ch.3.cbz", one archive per chapter in
+// the series folder, the local source format of Tachiyomi and Mihon. The
+// details.json of the folder is written after the conversion.
+func tachiyomiLayout(info *ComicInfo, baseName string) []string {
+	series := firstNonEmpty(info.Series, info.Title, baseName)
+	number := strings.TrimSpace(info.Number)
+	if number == "" && info.Volume == 0 {
+		return []string{series, firstNonEmpty(info.Title, baseName)}
+	}
+
+	var name []string
+	if info.Volume > 0 {
+		name = append(name, fmt.Sprintf("Vol.%d", info.Volume))
+	}
+	if number != "" {
+		name = append(name, "Ch."+number)
+	}
+	return []string{series, strings.Join(name, " ")}
+}
+
+// mangadexNaming writes "Series - c001 (v01) [Group]", the chapter names of
+// MangaDex downloaders. The group is the scan information or the publisher.
+func mangadexNaming(info *ComicInfo, baseName string) string {
+	name := firstNonEmpty(info.Series, info.Title, baseName)
+	if number := strings.TrimSpace(info.Number); number != "" {
+		name += " - c" + padNumber(number, 3)
+		if info.Volume > 0 {
+			name += fmt.Sprintf(" (v%02d)", info.Volume)
+		}
+	} else if info.Volume > 0 {
+		name += fmt.Sprintf(" - v%02d", info.Volume)
+	}
+	if group := firstNonEmpty(info.ScanInformation, info.Publisher); group != "" {
+		name += " [" + group + "]"
+	}
+	return name
+}
+
+// padNumber pads the integer part of a book number with zeros, keeping any
+// fractional part (1.5 becomes 01.5); non numeric values are returned as is
+func padNumber(number string, width int) string {
+	integer, fraction, _ := strings.Cut(strings.TrimSpace(number), ".")
+	value, err := strconv.Atoi(integer)
+	if err != nil || value < 0 {
+		return number
+	}
+	padded := fmt.Sprintf("%0*d", width, value)
+	if fraction = strings.TrimRight(fraction, "0"); fraction != "" {
+		padded += "." + fraction
+	}
+	return padded
+}
+
+// firstNonEmpty returns the first of its arguments that is not empty
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,56 @@
+package epub2cbz
+
+// workerLimits bounds the disk-bound and CPU-bound work of every conversion
+// of a run separately, so extraction and recompression can be tuned on their
+// own instead of sharing the page workers. A nil *workerLimits limits nothing.
+type workerLimits struct {
+	io  chan struct{}
+	cpu chan struct{}
+}
+
+// newWorkerLimits creates the limits of a run, or returns nil when neither is set
+func newWorkerLimits(ioWorkers int, cpuWorkers int) *workerLimits {
+	if ioWorkers <= 0 && cpuWorkers <= 0 {
+		return nil
+	}
+	limits := &workerLimits{}
+	if ioWorkers > 0 {
+		limits.io = make(chan struct{}, ioWorkers)
+	}
+	if cpuWorkers > 0 {
+		limits.cpu = make(chan struct{}, cpuWorkers)
+	}
+	return limits
+}
+
+// doIO runs fn, which reads from disk, within the I/O limit
+func (l *workerLimits) doIO(fn func()) {
+	if l == nil || l.io == nil {
+		fn()
+		return
+	}
+	l.io <- struct{}{}
+	defer func() { <-l.io }()
+	fn()
+}
+
+// doCPU runs fn, which compresses or encodes, within the CPU limit
+func (l *workerLimits) doCPU(fn func()) {
+	if l == nil || l.cpu == nil {
+		fn()
+		return
+	}
+	l.cpu <- struct{}{}
+	defer func() { <-l.cpu }()
+	fn()
+}
+
+// imageWorkers returns the number of images prepared concurrently in a
+// conversion: enough to keep both the I/O and the CPU limits busy
+func imageWorkers(opts Options) int {
+	workers := pageWorkers(opts, opts.batch)
+	if opts.IOWorkers > 0 || opts.CPUWorkers > 0 {
+		workers = max(workers, opts.IOWorkers+opts.CPUWorkers)
+	}
+	return workers
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package epub2cbz
+
+// longPath returns the path unchanged, only Windows limits path lengths
+func longPath(path string) string {
+	return path
+}
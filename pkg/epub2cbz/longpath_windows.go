@@ -0,0 +1,35 @@
+//go:build windows
+
+package epub2cbz
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// maxPath is the length above which Win32 APIs reject paths without the
+// extended-length prefix (248 for directories, 260 for files)
+const maxPath = 248
+
+// longPath converts a path to its extended-length form (\\?\C:\... or
+// \\?\UNC\server\share\...) when it is too long for the legacy Win32 limit,
+// so deep library structures with long titles can still be created
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) {
+		return path
+	}
+
+	// A short relative path can still exceed the limit once joined to the
+	// working directory, so the limit applies to the absolute path
+	absPath, err := filepath.Abs(path)
+	if err != nil || len(absPath) < maxPath {
+		return path
+	}
+	// The extended-length prefix disables all normalization, so the path
+	// must be clean and use backslashes only
+	absPath = filepath.Clean(absPath)
+	if strings.HasPrefix(absPath, `\\`) {
+		return `\\?\UNC\` + absPath[2:]
+	}
+	return `\\?\` + absPath
+}
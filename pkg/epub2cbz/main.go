@@ -0,0 +1,2255 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/unicode/norm"
+)
+
+type Container struct {
+	Rootfiles struct {
+		Rootfile []struct {
+			FullPath  string `xml:"full-path,attr"`
+			MediaType string `xml:"media-type,attr"`
+		} `xml:"rootfile"`
+	} `xml:"rootfiles"`
+}
+
+type Package struct {
+	Metadata Metadata `xml:"metadata"`
+	Manifest struct {
+		Items []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"item"`
+	} `xml:"manifest"`
+	Spine struct {
+		Toc       string `xml:"toc,attr"`                        // NCX table of contents of EPUB 2
+		Direction string `xml:"page-progression-direction,attr"` // reading direction: ltr, rtl or default
+		Itemrefs  []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+type Metadata struct {
+	Identifier  []string
+	Title       []string
+	Language    []string
+	Creator     []string
+	Publisher   []string
+	Date        []string
+	Rights      []string
+	Description []string
+	Series      []string
+	SeriesID    []string
+	Number      []string
+	Volume      []string // only read from file names, the OPF has no volume
+	Subject     []string
+
+	// Meta holds <meta name="..." content="..."/> pairs (calibre and custom
+	// publisher metadata), keyed by name, and the EPUB 3 <meta property="...">
+	// values keyed by property. The first occurrence of a name wins.
+	Meta map[string]string
+
+	// TitleAttrs holds the id, xml:lang and opf:file-as attributes of each
+	// title, and Refines the EPUB 3 <meta refines="#id" property="...">
+	// values by id then property, to find the other forms of the title
+	TitleAttrs []titleAttrs
+	Refines    map[string]map[string][]string
+
+	// Credits are the creators and contributors with their roles
+	Credits []credit
+
+	// Collections are the EPUB 3 belongs-to-collection metas, by id and name
+	Collections []collectionMeta
+
+	// Direction is the page-progression-direction of the spine, copied
+	// from the package as the reading direction is book metadata
+	Direction string
+}
+
+// titleAttrs are the attributes of a dc:title element
+type titleAttrs struct {
+	ID     string
+	Lang   string
+	FileAs string
+}
+
+// collectionMeta is an EPUB 3 belongs-to-collection meta
+type collectionMeta struct {
+	ID   string
+	Name string
+}
+
+// dcNamespaces lists the Dublin Core namespaces found in real OPF files,
+// including the OEB 1.x one used by some OPF 2.0 publishers
+var dcNamespaces = map[string]bool{
+	"http://purl.org/dc/elements/1.1/": true,
+	"http://purl.org/dc/elements/1.1":  true,
+	"http://purl.org/dc/elements/1.0/": true,
+	"http://purl.org/dc/elements/1.0":  true,
+	"dc":                               true, // undeclared "dc:" prefix
+}
+
+// UnmarshalXML decodes the OPF metadata element. Elements are matched on
+// their local name, case-insensitively, so that prefixed packages, OEB
+// style <dc-metadata> wrappers and capitalized names (dc:Title) all decode.
+func (m *Metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if strings.EqualFold(t.Name.Local, "meta") {
+				m.addMeta(t.Attr)
+				// EPUB 3 metas hold their value as text, and may refine another element
+				if property := xmlAttr(t.Attr, "property"); property != "" {
+					var value string
+					if err := d.DecodeElement(&value, &t); err != nil {
+						return err
+					}
+					if refines := xmlAttr(t.Attr, "refines"); refines != "" {
+						m.addRefine(refines, property, strings.TrimSpace(value))
+					} else if property == "belongs-to-collection" && strings.TrimSpace(value) != "" {
+						m.Collections = append(m.Collections, collectionMeta{ID: xmlAttr(t.Attr, "id"), Name: strings.TrimSpace(value)})
+						m.addMeta([]xml.Attr{{Name: xml.Name{Local: "name"}, Value: property}, {Name: xml.Name{Local: "content"}, Value: value}})
+					} else {
+						m.addMeta([]xml.Attr{{Name: xml.Name{Local: "name"}, Value: property}, {Name: xml.Name{Local: "content"}, Value: value}})
+					}
+				}
+				continue
+			}
+			if !dcNamespaces[t.Name.Space] {
+				// Descend into wrappers like <dc-metadata> and <x-metadata>
+				continue
+			}
+			var value string
+			if err := d.DecodeElement(&value, &t); err != nil {
+				return err
+			}
+			name := strings.ToLower(t.Name.Local)
+			if value = strings.TrimSpace(value); name == "title" && value != "" {
+				m.TitleAttrs = append(m.TitleAttrs, titleAttrs{ID: xmlAttr(t.Attr, "id"), Lang: xmlAttr(t.Attr, "lang"), FileAs: xmlAttr(t.Attr, "file-as")})
+			}
+			if (name == "creator" || name == "contributor") && value != "" {
+				m.Credits = append(m.Credits, credit{Name: value, Role: xmlAttr(t.Attr, "role"), ID: xmlAttr(t.Attr, "id"), Contributor: name == "contributor"})
+			}
+			if name == "identifier" && strings.EqualFold(xmlAttr(t.Attr, "scheme"), "isbn") && !isISBNURN(value) {
+				// Keep the EPUB 2 scheme of ISBNs with the value
+				value = isbnURN + value
+			}
+			m.add(name, value)
+		case xml.EndElement:
+			if t.Name == start.Name {
+				m.addCollectionSeries()
+				m.addCalibreSeries()
+				m.resolveCreditRoles()
+				return nil
+			}
+		}
+	}
+}
+
+// addCollectionSeries sets the series and number from the EPUB 3
+// belongs-to-collection metas, when the package has no dc:series. The
+// collection typed "series" wins over untyped ones, "set" collections being
+// groups like box sets rather than series.
+func (m *Metadata) addCollectionSeries() {
+	var series *collectionMeta
+	for i := range m.Collections {
+		kind := getFirst(m.Refines[m.Collections[i].ID]["collection-type"])
+		if kind == "series" {
+			series = &m.Collections[i]
+			break
+		}
+		if kind == "" && series == nil {
+			series = &m.Collections[i]
+		}
+	}
+	if series == nil {
+		return
+	}
+	if len(m.Series) == 0 {
+		m.Series = []string{series.Name}
+	}
+	if position := getFirst(m.Refines[series.ID]["group-position"]); position != "" && len(m.Number) == 0 {
+		m.Number = []string{formatSeriesIndex(position)}
+	}
+}
+
+// addCalibreSeries sets the series and number from the calibre:series and
+// calibre:series_index metas Calibre writes in the EPUBs it produces, when
+// the package has no other series. Fractional indices like 1.5 are kept.
+func (m *Metadata) addCalibreSeries() {
+	if series := m.Meta["calibre:series"]; series != "" && len(m.Series) == 0 {
+		m.Series = []string{series}
+	}
+	if index := m.Meta["calibre:series_index"]; index != "" && len(m.Number) == 0 {
+		m.Number = []string{formatSeriesIndex(index)}
+	}
+}
+
+// addMeta records the name/content pair of a <meta> element, if it has one
+func (m *Metadata) addMeta(attrs []xml.Attr) {
+	var name, content string
+	for _, attr := range attrs {
+		switch attr.Name.Local {
+		case "name":
+			name = strings.TrimSpace(attr.Value)
+		case "content":
+			content = strings.TrimSpace(attr.Value)
+		}
+	}
+	if name == "" || content == "" {
+		return
+	}
+	if m.Meta == nil {
+		m.Meta = make(map[string]string)
+	}
+	if _, exists := m.Meta[name]; !exists {
+		m.Meta[name] = content
+	}
+}
+
+// addRefine records the value of an EPUB 3 meta refining another element
+func (m *Metadata) addRefine(refines string, property string, value string) {
+	id := strings.TrimPrefix(strings.TrimSpace(refines), "#")
+	if id == "" || value == "" {
+		return
+	}
+	if m.Refines == nil {
+		m.Refines = make(map[string]map[string][]string)
+	}
+	if m.Refines[id] == nil {
+		m.Refines[id] = make(map[string][]string)
+	}
+	m.Refines[id][property] = append(m.Refines[id][property], value)
+}
+
+// xmlAttr returns the value of an attribute by local name, whatever its namespace
+func xmlAttr(attrs []xml.Attr, name string) string {
+	for _, attr := range attrs {
+		if attr.Name.Local == name {
+			return strings.TrimSpace(attr.Value)
+		}
+	}
+	return ""
+}
+
+// add stores a Dublin Core value under the field matching its element name
+func (m *Metadata) add(name string, value string) {
+	if value == "" {
+		return
+	}
+	switch name {
+	case "identifier":
+		m.Identifier = append(m.Identifier, value)
+	case "title":
+		m.Title = append(m.Title, value)
+	case "language":
+		m.Language = append(m.Language, value)
+	case "creator":
+		m.Creator = append(m.Creator, value)
+	case "publisher":
+		m.Publisher = append(m.Publisher, value)
+	case "date":
+		m.Date = append(m.Date, value)
+	case "rights":
+		m.Rights = append(m.Rights, value)
+	case "description":
+		m.Description = append(m.Description, value)
+	case "series":
+		m.Series = append(m.Series, value)
+	case "seriesid":
+		m.SeriesID = append(m.SeriesID, value)
+	case "number":
+		m.Number = append(m.Number, value)
+	case "subject":
+		m.Subject = append(m.Subject, value)
+	}
+}
+
+type XHTML struct {
+	Body struct {
+		Div struct {
+			Img struct {
+				Src string `xml:"src,attr"`
+			} `xml:"img"`
+		} `xml:"div"`
+	} `xml:"body"`
+}
+
+type ComicInfo struct {
+	XMLName             xml.Name              `xml:"ComicInfo"`
+	Title               string                `xml:"Title,omitempty"`
+	Series              string                `xml:"Series,omitempty"`
+	Number              string                `xml:"Number,omitempty"`
+	Count               int                   `xml:"Count,omitempty"`
+	Volume              int                   `xml:"Volume,omitempty"`
+	AlternateSeries     string                `xml:"AlternateSeries,omitempty"`
+	AlternateNumber     string                `xml:"AlternateNumber,omitempty"`
+	AlternateCount      int                   `xml:"AlternateCount,omitempty"`
+	Summary             string                `xml:"Summary,omitempty"`
+	Notes               string                `xml:"Notes,omitempty"`
+	Year                int                   `xml:"Year,omitempty"`
+	Month               int                   `xml:"Month,omitempty"`
+	Day                 int                   `xml:"Day,omitempty"`
+	Writer              string                `xml:"Writer,omitempty"`
+	Penciller           string                `xml:"Penciller,omitempty"`
+	Inker               string                `xml:"Inker,omitempty"`
+	Colorist            string                `xml:"Colorist,omitempty"`
+	Letterer            string                `xml:"Letterer,omitempty"`
+	CoverArtist         string                `xml:"CoverArtist,omitempty"`
+	Editor              string                `xml:"Editor,omitempty"`
+	Translator          string                `xml:"Translator,omitempty"`
+	Publisher           string                `xml:"Publisher,omitempty"`
+	Imprint             string                `xml:"Imprint,omitempty"`
+	Genre               string                `xml:"Genre,omitempty"`
+	Tags                string                `xml:"Tags,omitempty"`
+	Web                 string                `xml:"Web,omitempty"` // space separated URLs
+	PageCount           int                   `xml:"PageCount,omitempty"`
+	LanguageISO         string                `xml:"LanguageISO,omitempty"`
+	Format              string                `xml:"Format,omitempty"`
+	BlackAndWhite       string                `xml:"BlackAndWhite,omitempty"`
+	Manga               string                `xml:"Manga,omitempty"`
+	Characters          string                `xml:"Characters,omitempty"`
+	Teams               string                `xml:"Teams,omitempty"`
+	Locations           string                `xml:"Locations,omitempty"`
+	ScanInformation     string                `xml:"ScanInformation,omitempty"`
+	StoryArc            string                `xml:"StoryArc,omitempty"`
+	SeriesGroup         string                `xml:"SeriesGroup,omitempty"`
+	AgeRating           string                `xml:"AgeRating,omitempty"`
+	Pages               *ArrayOfComicPageInfo `xml:"Pages,omitempty"`
+	CommunityRating     string                `xml:"CommunityRating,omitempty"`
+	MainCharacterOrTeam string                `xml:"MainCharacterOrTeam,omitempty"`
+	Review              string                `xml:"Review,omitempty"`
+	GTIN                string                `xml:"GTIN,omitempty"`
+}
+
+// addWeb adds a URL to the space separated Web links of a ComicInfo
+func (info *ComicInfo) addWeb(url string) {
+	if url != "" && !slices.Contains(strings.Fields(info.Web), url) {
+		info.Web = strings.TrimSpace(info.Web + " " + url)
+	}
+}
+
+type ArrayOfComicPageInfo struct {
+	Page []ComicPageInfo `xml:"Page"`
+}
+
+// PageTypeFrontCover is the ComicInfo type of the cover page
+const PageTypeFrontCover = "FrontCover"
+
+type ComicPageInfo struct {
+	Image       int    `xml:"Image,attr"`
+	Type        string `xml:"Type,attr,omitempty"`
+	DoublePage  bool   `xml:"DoublePage,attr,omitempty"`
+	ImageSize   int64  `xml:"ImageSize,attr,omitempty"`
+	Key         string `xml:"Key,attr,omitempty"`
+	Bookmark    string `xml:"Bookmark,attr,omitempty"`
+	ImageWidth  int    `xml:"ImageWidth,attr,omitempty"`
+	ImageHeight int    `xml:"ImageHeight,attr,omitempty"`
+}
+
+// createComicInfo creates a ComicInfo.xml structure from OPF metadata
+func createComicInfo(metadata Metadata) *ComicInfo {
+	comicInfo := &ComicInfo{
+		Title:       getFirst(metadata.Title),
+		Series:      getFirst(metadata.Series),
+		Number:      getFirst(metadata.Number),
+		Publisher:   getFirst(metadata.Publisher),
+		LanguageISO: getFirst(metadata.Language),
+		Summary:     descriptionText(getFirst(metadata.Description)),
+		Genre:       strings.Join(metadata.Subject, ", "),
+		GTIN:        bookGTIN(metadata.Identifier),
+		Notes:       "Generated from EPUB metadata",
+	}
+
+	if note := alternateTitlesNote(metadata); note != "" {
+		comicInfo.Notes += ". " + note
+	}
+
+	comicInfo.Volume, _ = strconv.Atoi(getFirst(metadata.Volume))
+
+	// Extract year, month and day from date if possible
+	comicInfo.Year, comicInfo.Month, comicInfo.Day = parseDate(getFirst(metadata.Date))
+
+	// The spine direction tells right to left books, otherwise Manga is
+	// Yes if the series is in Japanese (simplified heuristic)
+	if metadata.Direction == "rtl" {
+		comicInfo.Manga = "YesAndRightToLeft"
+	} else if comicInfo.Series != "" {
+		// Check if the series title contains Japanese characters
+		if containsJapanese(comicInfo.Series) {
+			comicInfo.Manga = "Yes"
+		} else {
+			comicInfo.Manga = "No"
+		}
+	} else {
+		comicInfo.Manga = "Unknown"
+	}
+
+	// Map the credits by their MARC roles, or the creator to writer (or
+	// penciller if appropriate) when the EPUB gives no roles
+	creator := getFirst(metadata.Creator)
+	if metadata.hasCreditRoles() {
+		applyCreditRoles(comicInfo, metadata)
+	} else if creator != "" {
+		// For manga, often the creator is both writer and penciller
+		comicInfo.Writer = creator
+		comicInfo.Penciller = creator
+	}
+
+	// Set default values according to schema
+	if comicInfo.BlackAndWhite == "" {
+		comicInfo.BlackAndWhite = "Unknown"
+	}
+	if comicInfo.AgeRating == "" {
+		comicInfo.AgeRating = "Unknown"
+	}
+
+	return comicInfo
+}
+
+// getFirst returns the first element of a slice or an empty string if the slice is empty
+func getFirst(items []string) string {
+	if len(items) > 0 {
+		return items[0]
+	}
+	return ""
+}
+
+// containsJapanese checks if a string contains Japanese characters
+func containsJapanese(s string) bool {
+	for _, r := range s {
+		if (r >= 0x3040 && r <= 0x309F) || // Hiragana
+			(r >= 0x30A0 && r <= 0x30FF) || // Katakana
+			(r >= 0x4E00 && r <= 0x9FBF) { // Kanji
+			return true
+		}
+	}
+	return false
+}
+
+// isoDate matches the date part of an ISO 8601 date: "2020", "2020-05",
+// "2020-05-17" or "2020-05-17T00:00:00+00:00"
+var isoDate = regexp.MustCompile(`^(\d{4})(?:-(\d{2})(?:-(\d{2}))?)?(?:[T ]|$)`)
+
+// comicInfoDate returns the ISO 8601 date of a ComicInfo, as far as it
+// goes: "2019", "2019-03" or "2019-03-21", empty without year
+func comicInfoDate(info *ComicInfo) string {
+	if info.Year <= 0 {
+		return ""
+	}
+	date := fmt.Sprintf("%04d", info.Year)
+	if info.Month > 0 {
+		date += fmt.Sprintf("-%02d", info.Month)
+		if info.Day > 0 {
+			date += fmt.Sprintf("-%02d", info.Day)
+		}
+	}
+	return date
+}
+
+// parseDate returns the year, month and day of a dc:date, 0 for the parts
+// it does not give. The date part is read as written, without moving it to
+// another time zone. Calibre's placeholder for unknown dates, year 101, is
+// ignored.
+func parseDate(date string) (year int, month int, day int) {
+	match := isoDate.FindStringSubmatch(strings.TrimSpace(date))
+	if match == nil {
+		return 0, 0, 0
+	}
+	year, _ = strconv.Atoi(match[1])
+	month, _ = strconv.Atoi(match[2])
+	day, _ = strconv.Atoi(match[3])
+	if year <= 101 {
+		return 0, 0, 0
+	}
+	if month < 1 || month > 12 {
+		return year, 0, 0
+	}
+	if day < 1 || day > 31 {
+		day = 0
+	}
+	return year, month, day
+}
+
+// descriptionText returns the plain text of a dc:description, which
+// publishers and Calibre often write as escaped HTML. Paragraphs and line
+// breaks become new lines.
+func descriptionText(description string) string {
+	if !strings.Contains(description, "<") {
+		return strings.TrimSpace(html.UnescapeString(description))
+	}
+	var text strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(description))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			lines := strings.Split(text.String(), "\n")
+			for i, line := range lines {
+				lines[i] = strings.Join(strings.Fields(line), " ")
+			}
+			lines = slices.DeleteFunc(lines, func(line string) bool { return line == "" })
+			return strings.Join(lines, "\n")
+		case html.TextToken:
+			text.Write(tokenizer.Text())
+		case html.StartTagToken, html.EndTagToken, html.SelfClosingTagToken:
+			switch name, _ := tokenizer.TagName(); string(name) {
+			case "p", "br", "div", "li", "h1", "h2", "h3", "h4", "h5", "h6":
+				text.WriteByte('\n')
+			}
+		}
+	}
+}
+
+// hasMetadata checks if there is any useful metadata to include in ComicInfo.xml
+func hasMetadata(metadata Metadata) bool {
+	return len(metadata.Title) > 0 ||
+		len(metadata.Creator) > 0 ||
+		len(metadata.Credits) > 0 ||
+		len(metadata.Publisher) > 0 ||
+		len(metadata.Series) > 0 ||
+		len(metadata.Date) > 0 ||
+		len(metadata.Language) > 0 ||
+		len(metadata.Identifier) > 0 ||
+		len(metadata.Number) > 0 ||
+		len(metadata.Volume) > 0 ||
+		len(metadata.Subject) > 0 ||
+		len(metadata.Description) > 0
+}
+
+// Options holds the settings shared by every conversion of a run
+type Options struct {
+	Recursive bool   // process subdirectories recursively
+	Jobs      int    // number of files converted in parallel, 0 for one per CPU core
+	Sanitize  string // policy applied to generated output file names
+	Layout    string // library layout naming outputs from metadata, empty to keep source names
+
+	ChapterNaming string // naming of output files from their chapter metadata, empty to keep source names
+
+	Calibre    string // Calibre library whose metadata.opf files override the EPUB metadata
+	CalibreAdd bool   // add the converted CBZ to the Calibre library as a new format
+
+	Kindle       string // Send to Kindle address receiving each converted book
+	KindleDevice string // Kindle device profile the pages sent to Kindle are fitted to
+
+	PDF     bool // also write the pages as a PDF next to each CBZ
+	PDFOnly bool // write the pages as a PDF instead of a CBZ
+
+	ExtractDir bool // write the pages and ComicInfo.xml into a folder instead of a CBZ
+
+	KOReader bool // write KOReader sidecar metadata next to outputs
+
+	SplitChapters bool   // write one archive per chapter instead of the whole book
+	SplitVolumes  bool   // write one archive per volume of an omnibus instead of the whole book
+	TOCPage       bool   // insert a contents page rendered from the chapters after the cover
+	TitlePage     string // position of a title page rendered from the metadata, empty for none
+
+	Reverse         bool // write the pages in reverse spine order
+	NoCover         bool // drop the cover page
+	StripBackmatter bool // drop the back matter entries ending the table of contents and their pages
+
+	Watermark      string // text stamped on every page, empty for none
+	WatermarkStyle string // placement of the watermark: corner or diagonal
+
+	SplitSpreads bool   // cut landscape spreads in two pages
+	SplitOrder   string // order of the halves of a split spread: ltr or rtl
+
+	PageOffset    int  // number of the first page name, to continue the numbering of a previous book
+	KeepStructure bool // name images after their path in the EPUB instead of page numbers
+
+	Format string // ComicInfo format replacing the inferred one, empty to infer it
+
+	ThumbnailWidth  int // size of the cover thumbnails written next to outputs, 0 for none
+	ThumbnailHeight int
+
+	VerifySource bool // check the CRC of the images copied without decompressing them
+
+	Overrides map[string]string // ComicInfo values replacing the EPUB metadata, by element name
+
+	ParseFilename string // template of EPUB file names filling missing metadata, like "{series} v{volume}"
+
+	ComicVineKey  string // ComicVine API key enriching the metadata, empty to stay offline
+	MangaMetadata string // manga provider enriching the metadata: anilist, mangaupdates, or empty
+
+	PreserveTimes  bool // copy source modification times to the CBZ and its entries
+	StrictMetadata bool // fail instead of warning when ComicInfo.xml does not match the schema
+	ComicTagger    bool // follow the ComicTagger conventions and add a matching ComicBookInfo comment
+	ComicBookInfo  bool // add a ComicBookInfo comment matching ComicInfo.xml
+
+	Metadata string // metadata files written in archives, comma separated: comicinfo, comet, acbf; empty for comicinfo
+
+	Compression string // compression policy of image entries
+	PageJobs    int    // number of pages processed in parallel inside one conversion, 0 for automatic
+	MemoryLimit int64  // memory budget shared by parallel conversions in bytes, 0 for no limit
+
+	SpillThreshold int64 // entries larger than this are staged in temporary files, 0 to keep everything in memory
+
+	MaxOpen int // maximum number of EPUB archives open at the same time in directory mode, 0 for one per job
+
+	IOWorkers  int // images read from EPUBs at the same time in the whole run, 0 for no separate limit
+	CPUWorkers int // images compressed at the same time in the whole run, 0 for no separate limit
+
+	Existing string // policy for outputs that already exist: ExistingOverwrite (default), ExistingSkip or ExistingIfNewer
+
+	Verbosity int // messages shown: VerbosityQuiet, VerbosityNormal (default), VerbosityVerbose or VerbosityDebug
+
+	MappingsFile string // JSON file of the tables mapping publisher metadata onto ComicInfo enums, empty for the built-in tables
+	CacheFile    string // cache of the books converted, skipped by later runs, empty to disable it
+	ReportFile   string // CSV report with one row per book, empty for none
+
+	Webhook     string // URL receiving a JSON POST after each conversion and at the end of a batch
+	Ntfy        string // ntfy topic URL receiving the summary of a batch
+	Email       string // address receiving the summary of a batch
+	MetricsAddr string // address serving Prometheus metrics, empty for none
+
+	Output io.Writer   // messages of the conversions, like the archives written, nil to discard them
+	Logger *log.Logger // warnings and errors of the conversions, nil for the standard logger
+	Events Events      // functions following the books of a batch
+
+	batch     bool             // set when converting a directory, several files share the CPUs
+	readers   *readerCache     // limits and reuses the open EPUB archives
+	cache     *conversionCache // books already converted, nil when disabled
+	limits    *workerLimits    // bounds I/O and CPU work across the conversions of a run
+	notifier  *notifier        // reports conversions to webhooks, nil when disabled
+	metrics   *metrics         // conversion counters served to Prometheus, nil when disabled
+	report    *batchReport     // CSV report of the conversions, nil when disabled
+	ctx       context.Context  // cancels the conversions, nil when they cannot be canceled
+	mappings  enumMappings     // publisher vocabularies mapped onto ComicInfo enums
+	comicVine *comicVineClient // ComicVine lookups, nil when disabled
+	manga     *mangaClient     // manga provider lookups, nil when disabled
+}
+
+// Version returns the version of the application
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	// If build info is not available, return a default version
+	return "v1.0.0"
+}
+
+// processDirectory converts every EPUB found in sourceDir and returns the
+// files that failed, or an error when the directory cannot be converted
+func processDirectory(sourceDir string, outputDir string, opts Options) ([]string, error) {
+	opts.batch = true
+	if opts.MaxOpen > 0 {
+		opts.readers = newReaderCache(opts.MaxOpen)
+	} else {
+		opts.readers = newReaderCache(opts.Jobs)
+	}
+	defer opts.readers.close()
+
+	epubFiles, err := FindEPUBFiles(sourceDir, opts.Recursive)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory: %w", err)
+	}
+
+	if len(epubFiles) == 0 {
+		if opts.Recursive {
+			return nil, fmt.Errorf("no .epub files found in directory or subdirectories: %s", sourceDir)
+		}
+		return nil, fmt.Errorf("no .epub files found in directory: %s", sourceDir)
+	}
+
+	// Create output directory if specified
+	if outputDir != "" && !IsRemoteURL(outputDir) {
+		err := os.MkdirAll(longPath(outputDir), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("error creating output directory: %w", err)
+		}
+	}
+
+	// Compute every output path up front so collisions can be detected before
+	// any worker starts writing
+	var failed []string
+	var failedMutex sync.Mutex
+	outputPaths := make(map[string]string, len(epubFiles))
+	taken := make(map[string]string, len(epubFiles))
+	for _, path := range epubFiles {
+		finalOutputPath, err := directoryOutputPath(sourceDir, outputDir, path, opts)
+		if err != nil {
+			opts.logger().Printf("Error getting output path for %s: %v", path, err)
+			failed = append(failed, path)
+			continue
+		}
+		finalOutputPath = disambiguateOutputPath(finalOutputPath, taken, opts.logger())
+		taken[strings.ToLower(finalOutputPath)] = path
+		outputPaths[path] = finalOutputPath
+	}
+
+	// Books of a series converted together know how many volumes it has
+	counts := inferSeriesCounts(epubFiles, opts)
+
+	opts.Events.batchStart(len(outputPaths))
+
+	var wg sync.WaitGroup
+	// Limit the number of goroutines to the number of available CPUs or user-defined value
+	semaphore := make(chan struct{}, opts.Jobs)
+	// Large books also count against a memory budget, so several huge art books
+	// converted at the same time don't exhaust the memory
+	budget := newMemoryBudget(opts.MemoryLimit)
+
+	// Process each .epub file
+	for _, epubPath := range epubFiles {
+		finalOutputPath, ok := outputPaths[epubPath]
+		if !ok {
+			continue
+		}
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		var estimate int64
+		if opts.MemoryLimit > 0 {
+			var err error
+			estimate, err = estimateMemory(epubPath, opts)
+			if err != nil {
+				// processFile reports the error when it opens the file
+				estimate = 0
+			}
+			budget.acquire(estimate)
+		}
+
+		fileOpts := opts
+		if count, ok := counts[epubPath]; ok {
+			fileOpts.Overrides = withOverride(opts.Overrides, "Count", strconv.Itoa(count))
+		}
+
+		go func(path string, finalOutputPath string, opts Options) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			defer budget.release(estimate)
+
+			// Create corresponding output directory structure
+			err := createOutputDir(finalOutputPath)
+			if err != nil {
+				opts.logger().Printf("Error creating output directory structure for %s: %v", path, err)
+				opts.Events.fileFailed(path, finalOutputPath, err)
+			} else if err = processFile(path, finalOutputPath, opts); IsSkipped(err) {
+				opts.printf("Skipped %s: %v\n", path, err)
+				err = nil
+			} else if err != nil {
+				opts.logger().Printf("ERROR processing %s: %v", path, err)
+			}
+			if err != nil {
+				failedMutex.Lock()
+				failed = append(failed, path)
+				failedMutex.Unlock()
+			}
+		}(epubPath, finalOutputPath, fileOpts)
+	}
+
+	wg.Wait()
+	sort.Strings(failed)
+	return failed, nil
+}
+
+// FindEPUBFiles lists the .epub files of a directory, and of its subdirectories when recursive
+func FindEPUBFiles(sourceDir string, recursive bool) ([]string, error) {
+	var epubFiles []string
+
+	if recursive {
+		// Walk the directory recursively
+		err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && strings.HasSuffix(strings.ToLower(path), ".epub") {
+				epubFiles = append(epubFiles, path)
+			}
+			return nil
+		})
+		return epubFiles, err
+	}
+
+	// Only process files in the top-level directory (non-recursive)
+	entries, err := os.ReadDir(sourceDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(strings.ToLower(entry.Name()), ".epub") {
+			epubFiles = append(epubFiles, filepath.Join(sourceDir, entry.Name()))
+		}
+	}
+	return epubFiles, nil
+}
+
+// directoryOutputPath computes the output path of an EPUB found while processing a directory
+func directoryOutputPath(sourceDir string, outputDir string, path string, opts Options) (string, error) {
+	if opts.Layout == "" && opts.ChapterNaming != "" {
+		// Rename the file of the mirrored structure
+		mirrored := opts
+		mirrored.ChapterNaming = ""
+		outputPath, err := directoryOutputPath(sourceDir, outputDir, path, mirrored)
+		if err != nil {
+			return "", err
+		}
+		return namedOutputPath(outputPath, path, opts)
+	}
+
+	if opts.Layout != "" {
+		// Library layouts replace the source structure
+		root := outputDir
+		if root == "" {
+			root = sourceDir
+		}
+		return layoutOutputPath(root, path, opts)
+	}
+
+	if outputDir == "" {
+		// Use default naming in source directory
+		return defaultOutputPath(path, opts), nil
+	}
+
+	baseName := filepath.Base(defaultOutputPath(path, opts))
+	if IsRemoteURL(outputDir) {
+		if !opts.Recursive {
+			return joinRemotePath(outputDir, baseName), nil
+		}
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return "", err
+		}
+		return joinRemotePath(outputDir, filepath.ToSlash(filepath.Dir(relPath)), baseName), nil
+	}
+	if !opts.Recursive {
+		// Just put output in the output directory without subdirectory structure
+		return filepath.Join(outputDir, baseName), nil
+	}
+
+	// Generate output path preserving directory structure
+	relPath, err := filepath.Rel(sourceDir, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(outputDir, filepath.Dir(relPath), baseName), nil
+}
+
+// defaultOutputPath replaces the .epub extension of a path with .cbz,
+// sanitizing the resulting file name according to the options
+func defaultOutputPath(epubPath string, opts Options) string {
+	baseName := strings.TrimSuffix(filepath.Base(epubPath), filepath.Ext(epubPath))
+	return filepath.Join(filepath.Dir(epubPath), sanitizeFileName(baseName, opts.Sanitize)+".cbz")
+}
+
+// createOutputDir creates the directory of a local output path, remote
+// outputs create theirs when written
+func createOutputDir(outputPath string) error {
+	if IsRemoteURL(outputPath) {
+		return nil
+	}
+	return os.MkdirAll(longPath(filepath.Dir(outputPath)), 0755)
+}
+
+// checkOutputPath refuses an output path that designates one of the inputs,
+// including through a different case, a symbolic link or a hard link.
+// The temporary .part file written before the final rename is checked too.
+func checkOutputPath(outputPath string, inputs []string) error {
+	if IsRemoteURL(outputPath) {
+		for _, input := range inputs {
+			if outputPath == input {
+				return fmt.Errorf("output %s would overwrite input %s", outputPath, input)
+			}
+		}
+		return nil
+	}
+	for _, candidate := range []string{outputPath, outputPath + ".part"} {
+		absOutput, err := filepath.Abs(candidate)
+		if err != nil {
+			return fmt.Errorf("error resolving output path %s: %w", candidate, err)
+		}
+		outputInfo, statErr := os.Stat(longPath(candidate))
+
+		for _, input := range inputs {
+			absInput, err := filepath.Abs(input)
+			if err != nil {
+				return fmt.Errorf("error resolving input path %s: %w", input, err)
+			}
+			// Compare case-insensitively, the filesystem may not distinguish case
+			if strings.EqualFold(absOutput, absInput) {
+				return fmt.Errorf("output %s would overwrite input %s", candidate, input)
+			}
+			if statErr == nil {
+				if inputInfo, err := os.Stat(longPath(input)); err == nil && os.SameFile(outputInfo, inputInfo) {
+					return fmt.Errorf("output %s is the same file as input %s", candidate, input)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// disambiguateOutputPath appends a numeric suffix to an output path already
+// claimed by another input. Paths are compared case-insensitively since the
+// output may live on a case-insensitive filesystem.
+func disambiguateOutputPath(outputPath string, taken map[string]string, logger *log.Logger) string {
+	if _, exists := taken[strings.ToLower(outputPath)]; !exists {
+		return outputPath
+	}
+
+	base := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, filepath.Ext(outputPath))
+		if _, exists := taken[strings.ToLower(candidate)]; !exists {
+			logger.Printf("Warning: output %s is already used by %s, writing %s instead", outputPath, taken[strings.ToLower(outputPath)], candidate)
+			return candidate
+		}
+	}
+}
+
+// newFileLogger returns a logger prefixing every message of logger with the
+// converted file, so messages from parallel workers can be told apart
+func newFileLogger(epubPath string, logger *log.Logger) *log.Logger {
+	return log.New(logger.Writer(), logger.Prefix()+epubPath+": ", logger.Flags()|log.Lmsgprefix)
+}
+
+// archiveIndex maps the entry names of an EPUB to its files, so lookups
+// don't scan the whole archive for every page and image
+type archiveIndex struct {
+	names  map[string]*zip.File // by NFC name
+	folded map[string]*zip.File // by lowercase NFC name
+}
+
+// newArchiveIndex indexes the entries of an archive.
+// Names are normalized to NFC since names authored on macOS are often stored
+// decomposed (NFD) while the OPF and XHTML references are composed.
+func newArchiveIndex(files []*zip.File) archiveIndex {
+	index := archiveIndex{names: make(map[string]*zip.File, len(files)), folded: make(map[string]*zip.File, len(files))}
+	for _, f := range files {
+		name := norm.NFC.String(f.Name)
+		// Keep the first entry when an archive contains duplicates
+		if _, exists := index.names[name]; !exists {
+			index.names[name] = f
+		}
+		if _, exists := index.folded[strings.ToLower(name)]; !exists {
+			index.folded[strings.ToLower(name)] = f
+		}
+	}
+	return index
+}
+
+// lookup returns the entry referenced by an href from the EPUB. Hrefs are
+// URLs, so percent-encoded names like "page%201.jpg" are decoded, and names
+// differing only by case match too, as the EPUBs written on Windows often
+// reference their files with another case than the one stored.
+func (index archiveIndex) lookup(href string) (*zip.File, bool) {
+	names := []string{norm.NFC.String(href)}
+	if decoded, err := url.PathUnescape(href); err == nil && decoded != href {
+		names = append(names, norm.NFC.String(decoded))
+	}
+	for _, name := range names {
+		if f, ok := index.names[name]; ok {
+			return f, true
+		}
+	}
+	for _, name := range names {
+		if f, ok := index.folded[strings.ToLower(name)]; ok {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// readPackage finds the OPF file through container.xml and decodes it.
+// It returns the package and the path of the OPF inside the archive.
+func readPackage(index archiveIndex) (*Package, string, error) {
+	packages, err := readPackages(index)
+	if err != nil {
+		return nil, "", err
+	}
+	return packages[0].pkg, packages[0].path, nil
+}
+
+// packageFile is an OPF package of an EPUB and its path in the archive
+type packageFile struct {
+	pkg  *Package
+	path string
+}
+
+// readPackages reads the OPF packages listed by container.xml. Most EPUBs
+// have one; omnibus EPUBs may list one per volume. Packages sharing the
+// identifier of the first one are renditions of the same book, like a fixed
+// layout and a reflowable one, and only the first rendition is kept.
+func readPackages(index archiveIndex) ([]packageFile, error) {
+	// Find the vol.opf file
+	containerFile, err := findAndOpenFile(index, "META-INF/container.xml")
+	if err != nil {
+		return nil, fmt.Errorf("error finding container.xml: %w", err)
+	}
+	defer containerFile.Close()
+
+	var container Container
+	if err := xml.NewDecoder(containerFile).Decode(&container); err != nil {
+		return nil, fmt.Errorf("error decoding container.xml: %w", err)
+	}
+
+	var packages []packageFile
+	for _, rootfile := range container.Rootfiles.Rootfile {
+		if rootfile.FullPath == "" || (rootfile.MediaType != "" && rootfile.MediaType != "application/oebps-package+xml") {
+			continue
+		}
+		// Read vol.opf to get the metadata and pages
+		opfFile, err := findAndOpenFile(index, rootfile.FullPath)
+		if err != nil {
+			return nil, fmt.Errorf("error finding vol.opf: %w", err)
+		}
+		var pkg Package
+		err = xml.NewDecoder(opfFile).Decode(&pkg)
+		opfFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error decoding vol.opf: %w", err)
+		}
+		pkg.Metadata.Direction = pkg.Spine.Direction
+		if len(packages) > 0 && len(pkg.Metadata.Identifier) > 0 && len(packages[0].pkg.Metadata.Identifier) > 0 &&
+			pkg.Metadata.Identifier[0] == packages[0].pkg.Metadata.Identifier[0] {
+			continue
+		}
+		packages = append(packages, packageFile{pkg: &pkg, path: rootfile.FullPath})
+	}
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("vol.opf file not found in container")
+	}
+	return packages, nil
+}
+
+// spinePages returns the archive paths of the pages of a package spine
+func spinePages(pkg *Package, opfPath string) []string {
+	// Find hrefs of pages via spine
+	pageMap := make(map[string]string)
+	for _, item := range pkg.Manifest.Items {
+		pageMap[item.ID] = item.Href
+	}
+
+	var pages []string
+	for _, ref := range pkg.Spine.Itemrefs {
+		href, exists := pageMap[ref.IDRef]
+		if exists {
+			// Convert relative path to absolute path based on opfPath
+			absPath := filepath.Join(filepath.Dir(opfPath), href)
+			// Normalize path separators to forward slashes for ZIP/EPUB compatibility
+			absPath = filepath.ToSlash(absPath)
+			absPath = strings.TrimPrefix(absPath, "/")
+			pages = append(pages, absPath)
+		}
+	}
+	return pages
+}
+
+// readEPUBMetadata reads only the OPF metadata of an EPUB
+func readEPUBMetadata(epubPath string, opts Options) (Metadata, error) {
+	zipReader, closeEPUB, err := openEPUB(epubPath, opts)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("error opening EPUB file: %w", err)
+	}
+	defer closeEPUB()
+
+	pkg, _, err := readPackage(newArchiveIndex(zipReader.File))
+	if err != nil {
+		return Metadata{}, err
+	}
+	metadata := pkg.Metadata
+	if opts.Calibre != "" {
+		if metadata, err = mergeCalibreMetadata(epubPath, metadata); err != nil {
+			return Metadata{}, err
+		}
+	}
+	return parseFilenameMetadata(epubPath, opts.ParseFilename, metadata), nil
+}
+
+// findAndOpenFile searches for a file by name in the zip archive and returns an open reader.
+func findAndOpenFile(index archiveIndex, fileName string) (io.ReadCloser, error) {
+	f, ok := index.lookup(fileName)
+	if !ok {
+		return nil, fmt.Errorf("file not found in archive: %s", fileName)
+	}
+	return f.Open()
+}
+
+func processFile(epubPath string, outputPath string, opts Options) (err error) {
+	// Attribute every message to this file, conversions run in parallel in batch mode
+	logger := newFileLogger(epubPath, opts.logger())
+
+	// Report the outcome to the notification targets and metrics, whatever it is
+	var stats *conversionStats
+	if opts.notifier != nil {
+		defer func() { opts.notifier.fileDone(epubPath, outputPath, stats, err) }()
+	}
+	if opts.metrics != nil {
+		start := time.Now()
+		defer func() { opts.metrics.fileDone(epubPath, stats, time.Since(start), err) }()
+	}
+	if opts.report != nil {
+		defer func() { opts.report.fileDone(epubPath, outputPath, stats, opts, err) }()
+	}
+	opts.Events.fileStart(epubPath)
+	if opts.Events.FileDone != nil {
+		start := time.Now()
+		warnings := &warningRecorder{out: logger.Writer()}
+		logger.SetOutput(warnings)
+		defer func() {
+			opts.Events.FileDone(newFileResult(epubPath, outputPath, stats, warnings.list(), time.Since(start), err))
+		}()
+	}
+
+	// Validate input file
+	if !strings.EqualFold(filepath.Ext(epubPath), ".epub") {
+		return fmt.Errorf("input file must have .epub extension")
+	}
+	if err := opts.canceled(); err != nil {
+		return err
+	}
+
+	// Curated sidecar metadata replaces the EPUB metadata
+	if opts.Overrides, err = bookOverrides(epubPath, opts); err != nil {
+		return err
+	}
+
+	// Generate output path if not provided
+	if outputPath == "" {
+		outputPath = defaultOutputPath(epubPath, opts)
+	}
+
+	// Refuse to write over the source while reading it
+	if err := checkOutputPath(outputPath, []string{epubPath}); err != nil {
+		return err
+	}
+
+	// Keep the outputs already there, unless the policy replaces them
+	if err := checkExisting(epubPath, outputPath, opts); err != nil {
+		return err
+	}
+
+	// Skip books already converted with the same options, wherever the output went
+	var cacheKey string
+	if opts.cache != nil && !isObjectURL(epubPath) {
+		var err error
+		if cacheKey, err = opts.cache.key(epubPath, opts); err != nil {
+			return fmt.Errorf("error hashing EPUB file: %w", err)
+		}
+		if conversion, ok := opts.cache.lookup(cacheKey); ok {
+			return &skippedError{fmt.Sprintf("already converted to %s on %s", conversion.Output, conversion.Converted.Format(time.DateTime))}
+		}
+	}
+
+	// Modification time written on the output and its entries when requested
+	var modTime time.Time
+	if opts.PreserveTimes {
+		var err error
+		if modTime, err = sourceModTime(epubPath); err != nil {
+			return fmt.Errorf("error reading EPUB modification time: %w", err)
+		}
+	}
+
+	output, err := createOutput(outputPath)
+	if err != nil {
+		return err
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			output.abort()
+		}
+	}()
+
+	// A large write buffer cuts the number of syscalls, which matters on spinning disks
+	outputBuffer := bufio.NewWriterSize(output, outputBufferSize)
+	if stats, err = convertEPUB(epubPath, outputBuffer, opts, modTime, logger); err != nil {
+		return err
+	}
+	opts.verbosef(logger, "%d image(s) of %d page(s), %s of images; spine %v, parse %v, fetch %v, write %v",
+		stats.Images, stats.Pages, FormatBytes(stats.ImageBytes), stats.Spine.Round(time.Millisecond),
+		stats.Parse.Round(time.Millisecond), stats.Fetch.Round(time.Millisecond), stats.Write.Round(time.Millisecond))
+
+	// Commit explicitly so the timestamp is not overwritten by a later write
+	if err := outputBuffer.Flush(); err != nil {
+		return fmt.Errorf("error writing ZIP file: %w", err)
+	}
+	if err := output.commit(); err != nil {
+		return err
+	}
+	completed = true
+	if opts.PreserveTimes && !IsRemoteURL(outputPath) {
+		if err := os.Chtimes(longPath(outputPath), modTime, modTime); err != nil {
+			logger.Printf("Error setting modification time of %s: %v", outputPath, err)
+		}
+	}
+
+	if opts.CalibreAdd {
+		if err := addCalibreFormat(opts.Calibre, epubPath, outputPath); err != nil {
+			return err
+		}
+	}
+
+	// Chapters and volumes are only split once the whole book was delivered
+	split := opts.SplitChapters && len(stats.Chapters) > 0 && !IsRemoteURL(outputPath)
+	if opts.SplitChapters && !split {
+		logger.Printf("Warning: no chapters found or remote output, %s is not split", outputPath)
+	}
+	byVolume := opts.SplitVolumes && len(stats.Volumes) > 0 && !IsRemoteURL(outputPath)
+	switch {
+	case opts.SplitVolumes && !byVolume:
+		logger.Printf("Warning: no volumes found or remote output, %s is not split", outputPath)
+	case !opts.SplitVolumes && len(stats.Volumes) > 0:
+		logger.Printf("%s holds %d volumes, -split-volumes writes one CBZ per volume", outputPath, len(stats.Volumes))
+	}
+	split = split || byVolume
+
+	if opts.Layout == "tachiyomi" && stats.ComicInfo != nil && !IsRemoteURL(outputPath) {
+		if err := writeTachiyomiDetails(filepath.Dir(outputPath), stats.ComicInfo); err != nil {
+			logger.Print(err)
+		}
+	}
+
+	if opts.KOReader && !split && stats.ComicInfo != nil && !IsRemoteURL(outputPath) {
+		if err := writeKOReaderMetadata(outputPath, stats.ComicInfo); err != nil {
+			logger.Print(err)
+		}
+	}
+
+	if opts.Kindle != "" {
+		if err := sendToKindle(opts.Kindle, opts.KindleDevice, outputPath, stats.ComicInfo); err != nil {
+			return err
+		}
+	}
+
+	// The PDF is made from the CBZ, before a split removes it
+	pdfPath := ""
+	if opts.PDF || opts.PDFOnly {
+		if IsRemoteURL(outputPath) {
+			logger.Printf("Warning: remote output, no PDF written for %s", outputPath)
+		} else if pdfPath, err = savePDF(outputPath, stats.ComicInfo); err != nil {
+			return err
+		} else if !opts.PDFOnly {
+			opts.printf("PDF written to %s\n", pdfPath)
+		}
+	}
+
+	if split {
+		splitter, unit := splitChapters, "chapter(s)"
+		if byVolume {
+			splitter, unit = splitVolumes, "volume(s)"
+		}
+		partPaths, err := splitter(outputPath, stats, opts)
+		if err != nil {
+			return err
+		}
+		if opts.ThumbnailWidth > 0 {
+			for _, partPath := range partPaths {
+				if err := writeThumbnail(partPath, opts.ThumbnailWidth, opts.ThumbnailHeight); err != nil {
+					logger.Print(err)
+				}
+			}
+		}
+		if cacheKey != "" {
+			opts.cache.record(cacheKey, epubPath, partPaths[0])
+		}
+		opts.printf("Images extracted to %d %s from %s\n", len(partPaths), unit, outputPath)
+		return nil
+	}
+
+	if opts.ThumbnailWidth > 0 && !IsRemoteURL(outputPath) {
+		if err := writeThumbnail(outputPath, opts.ThumbnailWidth, opts.ThumbnailHeight); err != nil {
+			logger.Print(err)
+		}
+	}
+
+	if opts.PDFOnly && pdfPath != "" {
+		// An output named .pdf was replaced by the PDF made from it
+		if pdfPath != outputPath {
+			if err := os.Remove(longPath(outputPath)); err != nil {
+				return fmt.Errorf("error removing CBZ file: %w", err)
+			}
+		}
+		outputPath = pdfPath
+	}
+
+	if opts.ExtractDir {
+		if IsRemoteURL(outputPath) {
+			logger.Printf("Warning: remote output, %s is not extracted", outputPath)
+		} else if outputPath, err = extractCBZ(outputPath, modTime); err != nil {
+			return err
+		}
+	}
+
+	if cacheKey != "" {
+		opts.cache.record(cacheKey, epubPath, outputPath)
+	}
+
+	opts.printf("Images extracted to %s\n", outputPath)
+	return nil
+}
+
+// outputFile is the destination of a conversion, which only appears once committed
+type outputFile interface {
+	io.Writer
+	commit() error
+	abort()
+}
+
+// partFile writes a local output to a temporary .part file renamed on
+// commit, so a crash, a full disk or an error never leaves a truncated CBZ behind
+type partFile struct {
+	*os.File
+	path string
+}
+
+// createOutput creates the destination of a conversion, a local or a remote file
+func createOutput(outputPath string) (outputFile, error) {
+	if IsRemoteURL(outputPath) {
+		return createRemoteOutput(outputPath)
+	}
+	f, err := os.Create(longPath(outputPath + ".part"))
+	if err != nil {
+		return nil, fmt.Errorf("error creating ZIP file: %w", err)
+	}
+	return &partFile{File: f, path: outputPath}, nil
+}
+
+func (f *partFile) commit() error {
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing ZIP file: %w", err)
+	}
+	if err := os.Rename(longPath(f.Name()), longPath(f.path)); err != nil {
+		return fmt.Errorf("error moving ZIP file into place: %w", err)
+	}
+	return nil
+}
+
+func (f *partFile) abort() {
+	f.Close()
+	os.Remove(longPath(f.Name()))
+}
+
+// sourceModTime returns the modification time of an EPUB file or object
+func sourceModTime(epubPath string) (time.Time, error) {
+	if isObjectURL(epubPath) {
+		_, modTime, err := statObject(epubPath)
+		return modTime, err
+	}
+	info, err := os.Stat(longPath(epubPath))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// conversionStats describes a finished conversion
+type conversionStats struct {
+	Pages       int   // pages of the spine
+	Images      int   // images written to the CBZ
+	ImageBytes  int64 // uncompressed size of the written images
+	OutputBytes int64 // size of the CBZ
+
+	Formats map[string]int  // images written, by extension
+	Layout  []ComicPageInfo // size of each page written, for ComicInfo.xml
+	Entries map[int]string  // entry name of each page written, by page index
+
+	ComicInfo *ComicInfo // metadata written to the CBZ, nil when the EPUB has none
+	Chapters  []chapter  // chapters of the book, nil when none were found
+	Volumes   []chapter  // volumes of an omnibus, nil for a single volume
+
+	// Time spent in each stage. Page parsing and image fetching run on several
+	// workers, their durations add up the time of every worker.
+	Spine time.Duration // opening the EPUB and resolving the spine
+	Parse time.Duration // reading pages and extracting image references
+	Fetch time.Duration // reading and compressing images
+	Write time.Duration // writing entries to the archive
+}
+
+// convertEPUB converts an EPUB to a CBZ archive written to w
+func convertEPUB(epubPath string, w io.Writer, opts Options, modTime time.Time, logger *log.Logger) (*conversionStats, error) {
+	stats := &conversionStats{Formats: make(map[string]int), Entries: make(map[int]string)}
+	start := time.Now()
+
+	// Open the EPUB file
+	zipReader, closeEPUB, err := openEPUB(epubPath, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error opening EPUB file: %w", err)
+	}
+	defer closeEPUB()
+	index := newArchiveIndex(zipReader.File)
+
+	// 1-2. Read vol.opf to get the metadata and pages
+	packages, err := readPackages(index)
+	if err != nil {
+		return nil, err
+	}
+	pkg, volOPFPath := packages[0].pkg, packages[0].path
+	opts.verbosef(logger, "Package %s, %d rendition(s)", volOPFPath, len(packages))
+	metadata := pkg.Metadata
+	if opts.Calibre != "" {
+		if metadata, err = mergeCalibreMetadata(epubPath, metadata); err != nil {
+			logger.Printf("Warning: %v", err)
+		}
+	}
+	metadata = parseFilenameMetadata(epubPath, opts.ParseFilename, metadata)
+
+	// The spines of omnibus packages follow each other, one volume each
+	var pages []string
+	var volumes []chapter
+	for i, p := range packages {
+		if len(packages) > 1 {
+			title := fmt.Sprintf("Volume %d", i+1)
+			if len(p.pkg.Metadata.Title) > 0 {
+				title = p.pkg.Metadata.Title[0]
+			}
+			volumes = append(volumes, chapter{Title: title, Page: len(pages), Volume: i + 1})
+		}
+		pages = append(pages, spinePages(p.pkg, p.path)...)
+	}
+
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no pages found in spine")
+	}
+	stats.Pages = len(pages)
+	stats.Spine = time.Since(start)
+
+	// 3. Open each page and extract images
+	counter := &countingWriter{w: w}
+	zipw := zip.NewWriter(counter)
+	defer zipw.Close()
+
+	// The stages run concurrently: pages are parsed while the images of the
+	// previous pages are fetched, and written as soon as they are ready.
+	workers := pageWorkers(opts, opts.batch)
+	var parseTime, fetchTime atomic.Int64
+
+	// Chapters come from the table of contents, or are detected on the pages
+	// when there is no usable one
+	toc := readTOC(index, pkg, volOPFPath, pages)
+	chapters := tocChapters(toc)
+	if volumes == nil {
+		volumes = tocVolumes(toc)
+	}
+
+	// The cover and the back matter are dropped before any page is read,
+	// once the pages are in reading order
+	dropPages := func(first int, last int) {
+		pages = slices.Delete(pages, first, last+1)
+		chapters = dropChapters(chapters, first, last, len(pages))
+		volumes = dropChapters(volumes, first, last, len(pages))
+	}
+	if opts.Reverse {
+		slices.Reverse(pages)
+		chapters = reverseChapters(chapters, len(pages))
+		volumes = reverseChapters(volumes, len(pages))
+	}
+	if opts.StripBackmatter {
+		if start := backmatterStart(chapters); start > 0 {
+			dropPages(start, len(pages)-1)
+		}
+	}
+	if opts.NoCover && len(pages) > 1 {
+		if page := coverPage(index, pkg, volOPFPath, pages); page >= 0 {
+			dropPages(page, page)
+		}
+	}
+	stats.Pages = len(pages)
+	detectChapters := chapters == nil
+	opts.verbosef(logger, "%d page(s) in the spine, %d chapter(s) and %d volume(s) in the table of contents", len(pages), len(chapters), len(volumes))
+
+	// Page parsing: image references in spine order
+	parsedPages := orderedStage(sliceSource(pages), workers, func(i int, pageHref string) parsedPage {
+		defer addDuration(&parseTime, time.Now())
+		page := readPage(index, pageHref, detectChapters, logger)
+		opts.debugf(logger, "Page %s: %d image(s)", pageHref, len(page.images))
+		return page
+	})
+	refs := make(chan string)
+	totalRefs := make(chan int, 1)
+	// First image reference of each page, and chapter detected on it
+	pageStart := make([]int, len(pages))
+	firstImages := make([]string, len(pages))
+	titles := make([]string, len(pages))
+	found := make([]bool, len(pages))
+	go func() {
+		count, i := 0, 0
+		for page := range parsedPages {
+			pageStart[i], titles[i], found[i] = count, page.chapter, page.hasChapter
+			if len(page.images) > 0 {
+				firstImages[i] = page.images[0]
+			}
+			for _, src := range page.images {
+				refs <- src
+				count++
+			}
+			i++
+		}
+		close(refs)
+		totalRefs <- count
+	}()
+
+	// Image fetch: references are queued so parsing never waits for the
+	// slower image stage and the total is known early
+	images := orderedStage(unboundedQueue(refs), imageWorkers(opts), func(i int, src string) *preparedImage {
+		// A canceled conversion drains the pipeline without reading images
+		if opts.canceled() != nil {
+			return nil
+		}
+		defer addDuration(&fetchTime, time.Now())
+		image := prepareImage(index, src, opts, modTime, logger)
+		if image != nil {
+			image.src = src
+		}
+		return image
+	})
+
+	// Archive write: page names are padded after the number of the last page
+	total := <-totalRefs
+	stats.Parse = time.Duration(parseTime.Load())
+	// Generated pages get their slot in the page names now, they are
+	// rendered once every chapter is known
+	var inserted insertedPages
+	switch opts.TitlePage {
+	case TitlePageFirst:
+		inserted = append(inserted, 0)
+	case TitlePageSecond:
+		inserted = append(inserted, 1) // after the cover
+	}
+	// The contents page lists the chapters of the table of contents, the
+	// chapters detected on the pages are only known once the images are named
+	tocPage := opts.TOCPage && len(chapters) > 0
+	if tocPage {
+		inserted = append(inserted, 1)
+	}
+	imageIndex := 0
+	written := make([]int, 0, total+1) // images written before each reference
+	usedNames := make(map[string]bool)
+	splitSpreads := 0
+	for image := range images {
+		written = append(written, stats.Images)
+		if image != nil {
+			writeStart := time.Now()
+			name := normalizeImageName(image.ext, opts.PageOffset+inserted.nameIndex(imageIndex), opts.PageOffset+total+len(inserted))
+			if opts.KeepStructure {
+				name = structuredImageName(image.src, image.ext, usedNames)
+			}
+			if image.next != nil {
+				splitSpreads++
+			}
+			for half, part := 0, image; part != nil; half, part = half+1, part.next {
+				part.header.Name = name
+				if image.next != nil {
+					// The pages of a split spread share its place, as "page05a.jpg" and "page05b.jpg"
+					part.header.Name = strings.TrimSuffix(name, path.Ext(name)) + string(rune('a'+half)) + path.Ext(name)
+				}
+				size := int64(part.header.UncompressedSize64)
+				page := ComicPageInfo{Image: inserted.nameIndex(stats.Images), ImageSize: size, ImageWidth: part.width, ImageHeight: part.height}
+				if writePreparedImage(zipw, part, logger) {
+					stats.Layout = append(stats.Layout, page)
+					stats.Entries[page.Image] = part.header.Name
+					stats.Images++
+					opts.Events.page()
+					opts.debugf(logger, "Image %s written as %s, %dx%d, %d bytes, %s", part.src, part.header.Name, part.width, part.height, size, methodName(part.header.Method))
+					stats.ImageBytes += size
+					stats.Formats[part.ext]++
+				}
+			}
+			stats.Write += time.Since(writeStart)
+		}
+		imageIndex++
+	}
+	written = append(written, stats.Images)
+	stats.Fetch = time.Duration(fetchTime.Load())
+	if err := opts.canceled(); err != nil {
+		return nil, err
+	}
+	// Images that could not be read leave their page number unused, which
+	// some readers sort or count wrongly
+	if missing := imageIndex + splitSpreads - stats.Images; missing > 0 {
+		logger.Printf("Warning: %d image(s) missing, the page numbers have gaps", missing)
+	}
+
+	if detectChapters {
+		if chapters = headingChapters(titles, found); chapters == nil {
+			chapters = filenameChapters(firstImages)
+		}
+	}
+	stats.Chapters = chapterImages(chapters, pageStart, written)
+	stats.Volumes = chapterImages(volumes, pageStart, written)
+
+	if opts.TOCPage && !tocPage {
+		logger.Printf("Warning: no chapters in the table of contents, no contents page added")
+	} else if tocPage && len(stats.Chapters) == 0 {
+		logger.Printf("Warning: no chapters found, no contents page added, the page numbers have a gap")
+	}
+
+	// Generated pages move the images after them
+	pageNumbers := make([]int, len(stats.Chapters))
+	for i := range stats.Chapters {
+		stats.Chapters[i].Image = inserted.nameIndex(stats.Chapters[i].Image)
+		pageNumbers[i] = stats.Chapters[i].Image + 1
+	}
+	for i := range stats.Volumes {
+		stats.Volumes[i].Image = inserted.nameIndex(stats.Volumes[i].Image)
+	}
+	generated := 0
+	writePage := func(page []byte, err error) error {
+		if err != nil {
+			return err
+		}
+		name := normalizeImageName(".png", opts.PageOffset+inserted.pageIndex(generated), opts.PageOffset+total+len(inserted))
+		if err := writeGeneratedPage(zipw, name, page, modTime); err != nil {
+			return err
+		}
+		info := ComicPageInfo{Image: inserted.pageIndex(generated), ImageSize: int64(len(page))}
+		if config, _, err := image.DecodeConfig(bytes.NewReader(page)); err == nil {
+			info.ImageWidth, info.ImageHeight = config.Width, config.Height
+		}
+		stats.Layout = append(stats.Layout, info)
+		stats.Entries[info.Image] = name
+		generated++
+		stats.Images++
+		stats.Formats[".png"]++
+		return nil
+	}
+	if opts.TitlePage != "" {
+		info := createComicInfo(metadata)
+		applyOverrides(info, opts.Overrides)
+		width, height := coverSize(index, firstImage(firstImages))
+		if err := writePage(renderTitlePage(info, width, height)); err != nil {
+			return nil, err
+		}
+	}
+	if tocPage && len(stats.Chapters) > 0 {
+		width, height := coverSize(index, firstImage(firstImages))
+		if err := writePage(renderContentsPage(stats.Chapters, pageNumbers, width, height)); err != nil {
+			return nil, err
+		}
+	}
+
+	// An archive without images is useless and would be imported as a corrupt book
+	if stats.Images == 0 {
+		return nil, fmt.Errorf("no images extracted (%d image references found in %d pages); the EPUB may use vector SVG pages, be DRM protected or be a reflowable text book", total, len(pages))
+	}
+
+	writeStart := time.Now()
+	// Generate and add ComicInfo.xml to the ZIP if metadata exists
+	if hasMetadata(metadata) || len(opts.Overrides) > 0 || len(stats.Chapters) > 0 {
+		comicInfo := createComicInfo(metadata)
+		opts.mappings.apply(comicInfo, metadata)
+		if opts.ComicTagger {
+			applyComicTaggerConventions(comicInfo, metadata)
+		}
+		comicInfo.Format = firstNonEmpty(opts.Format, comicInfo.Format, inferFormat(comicInfo, metadata.Collections, stats.Images, len(stats.Volumes)))
+		applyOverrides(comicInfo, opts.Overrides)
+		if opts.comicVine != nil {
+			if found, err := opts.comicVine.enrich(comicInfo); err != nil {
+				logger.Printf("Warning: %v", err)
+			} else if !found {
+				logger.Printf("Warning: issue not found on ComicVine")
+			}
+		}
+		if opts.manga != nil {
+			if found, err := opts.manga.enrich(comicInfo); err != nil {
+				logger.Printf("Warning: %v", err)
+			} else if !found {
+				logger.Printf("Warning: series not found on %s", opts.MangaMetadata)
+			}
+		}
+		// The cover is the first image of the book, after a title page
+		// inserted before it
+		cover := -1
+		if !opts.NoCover {
+			cover = inserted.nameIndex(0)
+		}
+		addPageLayout(comicInfo, stats.Layout, cover)
+		addBookmarks(comicInfo, stats.Chapters)
+		stats.ComicInfo = comicInfo
+		if opts.writesMetadata(MetadataComicInfo) {
+			comicInfoXML, err := xml.MarshalIndent(comicInfo, "", "  ")
+			if err != nil {
+				logger.Printf("Error marshaling ComicInfo: %v", err)
+			} else {
+				// Add XML declaration to the beginning of the XML
+				comicInfoContent := xml.Header + string(comicInfoXML)
+
+				// Validate against the schema, strict readers ignore the whole file on a single invalid value
+				if problems := validateComicInfo([]byte(comicInfoContent)); len(problems) > 0 {
+					if opts.StrictMetadata {
+						return nil, fmt.Errorf("invalid ComicInfo.xml: %w", errors.Join(problems...))
+					}
+					for _, problem := range problems {
+						logger.Printf("Warning: invalid ComicInfo.xml: %v", problem)
+					}
+				}
+
+				// Create the ComicInfo.xml entry in the ZIP
+				comicInfoFile, err := zipw.CreateHeader(&zip.FileHeader{
+					Name:     "ComicInfo.xml",
+					Method:   zip.Deflate,
+					Modified: modTime,
+				})
+				if err != nil {
+					logger.Printf("Error creating ComicInfo.xml in ZIP: %v", err)
+				} else {
+					_, err = comicInfoFile.Write([]byte(comicInfoContent))
+					if err != nil {
+						logger.Printf("Error writing ComicInfo.xml to ZIP: %v", err)
+					}
+				}
+			}
+		}
+		if opts.writesMetadata(MetadataCoMet) {
+			if err := writeXMLEntry(zipw, "CoMet.xml", createCoMet(comicInfo, stats.Images), modTime); err != nil {
+				logger.Printf("Error writing CoMet.xml to ZIP: %v", err)
+			}
+		}
+		if opts.writesMetadata(MetadataACBF) {
+			if err := writeXMLEntry(zipw, acbfEntry, createACBF(comicInfo, stats.Entries, stats.Images, filepath.Base(epubPath)), modTime); err != nil {
+				logger.Printf("Error writing %s to ZIP: %v", acbfEntry, err)
+			}
+		}
+
+		// ComicTagger reads both formats, they must agree
+		if opts.ComicTagger || opts.ComicBookInfo {
+			cbi, err := createComicBookInfo(comicInfo, modTime)
+			if err != nil {
+				logger.Print(err)
+			} else if err := zipw.SetComment(string(cbi)); err != nil {
+				logger.Printf("Error writing ComicBookInfo to ZIP: %v", err)
+			}
+		}
+	}
+
+	if err := zipw.Close(); err != nil {
+		return nil, fmt.Errorf("error finalizing ZIP file: %w", err)
+	}
+	stats.Write += time.Since(writeStart)
+	stats.OutputBytes = counter.n
+	return stats, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// addDuration adds the time elapsed since start to total, for use with defer
+func addDuration(total *atomic.Int64, start time.Time) {
+	total.Add(int64(time.Since(start)))
+}
+
+// parsedPage is a page of the spine once read
+type parsedPage struct {
+	images     []string // images referenced by the page
+	chapter    string   // title of the chapter starting on the page
+	hasChapter bool     // set when a chapter starts on the page, possibly without title
+}
+
+// readPage reads a page of the spine and returns the images it references,
+// and the chapter starting on it when detectChapters is set
+func readPage(index archiveIndex, pageHref string, detectChapters bool, logger *log.Logger) parsedPage {
+	f, ok := index.lookup(pageHref)
+	if !ok {
+		logger.Printf("Page not found in EPUB: %s", pageHref)
+		return parsedPage{}
+	}
+
+	file, err := f.Open()
+	if err != nil {
+		logger.Printf("Error opening %s: %v", pageHref, err)
+		return parsedPage{}
+	}
+	// Read the content of the page
+	content, err := io.ReadAll(file)
+	file.Close() // Close the file immediately after reading
+	if err != nil {
+		logger.Printf("Error reading %s: %v", pageHref, err)
+		return parsedPage{}
+	}
+
+	// Extract images
+	page := parsedPage{images: extractImagesFromXHTML(content, pageHref, nil, logger)}
+	if detectChapters {
+		page.chapter, page.hasChapter = pageChapterTitle(content)
+	}
+	return page
+}
+
+// extractImagesFromXHTML extracts image paths from HTML content.
+// The content is streamed through the tokenizer instead of building a DOM for
+// every page; both HTML <img src> and SVG <image href> pages are supported.
+func extractImagesFromXHTML(htmlContent []byte, pageHref string, srcs []string, logger *log.Logger) []string {
+	tokenizer := html.NewTokenizer(bytes.NewReader(htmlContent))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				logger.Printf("Error parsing HTML from %s: %v", pageHref, err)
+			}
+			return srcs
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			if !hasAttr {
+				continue
+			}
+			var srcKey string
+			switch string(name) {
+			case "img":
+				srcKey = "src"
+			case "image":
+				srcKey = "href"
+			default:
+				continue
+			}
+			for {
+				key, val, more := tokenizer.TagAttr()
+				// SVG 1.1 uses xlink:href, SVG 2 a plain href
+				if string(key) == srcKey || (srcKey == "href" && string(key) == "xlink:href") {
+					if imgPath := resolveImagePath(pageHref, string(val)); imgPath != "" {
+						srcs = append(srcs, imgPath)
+					}
+					break
+				}
+				if !more {
+					break
+				}
+			}
+		}
+	}
+}
+
+// resolveImagePath resolves an image reference relative to the page containing it.
+// Inline data URIs have no archive entry and are ignored.
+func resolveImagePath(pageHref string, src string) string {
+	if src == "" || strings.HasPrefix(src, "data:") {
+		return ""
+	}
+	imgPath := filepath.Join(filepath.Dir(pageHref), src)
+	imgPath = filepath.ToSlash(imgPath)
+	return strings.TrimPrefix(imgPath, "/")
+}
+
+// imageExtensions maps sniffed MIME types to the extension written in the CBZ
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"image/bmp":  ".bmp",
+}
+
+// sniffImageType detects the MIME type of an image from its leading bytes.
+// It returns an empty string if the content is not a known image format.
+func sniffImageType(header []byte) string {
+	mimeType := http.DetectContentType(header)
+	if _, ok := imageExtensions[mimeType]; ok {
+		return mimeType
+	}
+	return ""
+}
+
+// Compression policies for image entries
+const (
+	CompressionAuto    = "auto"    // store already compressed formats, deflate the others
+	CompressionStore   = "store"   // store every image
+	CompressionDeflate = "deflate" // deflate every image
+	CompressionKeep    = "keep"    // keep the compression of the EPUB entry
+)
+
+// compressedImageTypes are formats that gain nothing from being deflated again
+var compressedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// validateCompressionPolicy checks that a policy given on the command line is known
+func validateCompressionPolicy(policy string) error {
+	switch policy {
+	case CompressionAuto, CompressionStore, CompressionDeflate, CompressionKeep:
+		return nil
+	}
+	return fmt.Errorf("invalid compression policy %q (expected %s, %s, %s or %s)", policy, CompressionAuto, CompressionStore, CompressionDeflate, CompressionKeep)
+}
+
+// imageMethod returns the ZIP method used to write an image entry.
+// Deflating JPEG, PNG or WebP data wastes CPU and often grows the output.
+func imageMethod(policy string, mimeType string, sourceMethod uint16) uint16 {
+	switch policy {
+	case CompressionStore:
+		return zip.Store
+	case CompressionDeflate:
+		return zip.Deflate
+	case CompressionKeep:
+		return sourceMethod
+	}
+	if compressedImageTypes[mimeType] {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// imageExtension returns the extension matching the sniffed MIME type,
+// falling back to the extension of the original name when sniffing fails
+func imageExtension(mimeType string, originalName string) string {
+	if ext, ok := imageExtensions[mimeType]; ok {
+		return ext
+	}
+	return strings.ToLower(filepath.Ext(originalName))
+}
+
+// normalizeImageName renames images with the format "pageX.extension"
+func normalizeImageName(ext string, index int, totalFiles int) string {
+	// Calculate number of digits needed for total
+	totalDigits := len(strconv.Itoa(totalFiles))
+
+	// Create new name with prefix "page" + padded index
+	return fmt.Sprintf("page%0*d%s", totalDigits, index, ext)
+}
+
+// structuredImageName names an image after its path in the EPUB, with the
+// extension matching its content. An image shown on several pages gets a
+// numbered name for each repeat, like "images/001_2.jpg".
+func structuredImageName(src string, ext string, used map[string]bool) string {
+	base := strings.TrimSuffix(src, path.Ext(src))
+	name := base + ext
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+	used[name] = true
+	return name
+}
+
+// verifyingReader returns a reader of the raw data of an entry that
+// decompresses and hashes the data as it is read, and a function checking
+// the CRC-32 once the copy is over, so a corrupted image fails instead of
+// being copied into the CBZ. The check must be called even when the copy
+// fails.
+func verifyingReader(raw io.Reader, f *zip.File) (io.Reader, func() error) {
+	hash := crc32.NewIEEE()
+	check := func() error {
+		if hash.Sum32() != f.CRC32 {
+			return zip.ErrChecksum
+		}
+		return nil
+	}
+	if f.Method == zip.Store {
+		return io.TeeReader(raw, hash), check
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		inflater := flate.NewReader(pr)
+		_, err := io.Copy(hash, inflater)
+		inflater.Close()
+		if err != nil {
+			pr.CloseWithError(err)
+		} else {
+			// Drain what follows the deflate stream, the copy must not block
+			io.Copy(io.Discard, pr)
+		}
+		done <- err
+	}()
+	return io.TeeReader(raw, pw), func() error {
+		pw.Close()
+		if err := <-done; err != nil {
+			return err
+		}
+		return check()
+	}
+}
+
+// preparedImage is an image entry ready to be written in the output ZIP
+type preparedImage struct {
+	src    string          // path of the image in the EPUB
+	header *zip.FileHeader // header with CRC and sizes filled, named when written
+	ext    string          // extension matching the image content
+	width  int             // size of the image, 0 when it could not be decoded
+	height int
+	next   *preparedImage // second page of a split spread
+	data   *bytes.Buffer  // pooled entry data, already compressed with header.Method
+	spill  *os.File       // temporary file holding the data of entries too large for memory
+}
+
+// prepareImage reads an image from the EPUB and compresses it for the output ZIP.
+// It runs concurrently for several pages, so it only reads from the EPUB; the
+// entry is named by the writer, once the total number of images is known.
+// When the entry keeps the compression method of the source, the compressed bytes
+// are copied as they are, so images are never inflated and re-deflated.
+// When modTime is set the entry keeps the modification time it had in the EPUB,
+// or modTime if the EPUB entry has none.
+func prepareImage(index archiveIndex, imgPath string, opts Options, modTime time.Time, logger *log.Logger) (prepared *preparedImage) {
+	f, ok := index.lookup(imgPath)
+	if !ok {
+		logger.Printf("Image not found in EPUB: %s", imgPath)
+		return nil
+	}
+
+	if f.Method != zip.Store && f.Method != zip.Deflate {
+		logger.Printf("Error opening image %s: unsupported compression method %d", imgPath, f.Method)
+		return nil
+	}
+
+	// Sniff the real image type, since EPUBs often carry PNGs named .jpg and vice versa
+	srcFile, err := f.Open()
+	if err != nil {
+		logger.Printf("Error opening image %s: %v", imgPath, err)
+		return nil
+	}
+	header := make([]byte, 512)
+	n, err := io.ReadFull(srcFile, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		srcFile.Close()
+		logger.Printf("Error reading image %s: %v", imgPath, err)
+		return nil
+	}
+	mimeType := sniffImageType(header[:n])
+	if mimeType == "" {
+		logger.Printf("Warning: could not detect image type of %s, keeping its extension", imgPath)
+	}
+	// The size of the page, recorded in ComicInfo.xml, is read from the image
+	// header, decoders stop there
+	config, _, _ := image.DecodeConfig(io.MultiReader(bytes.NewReader(header[:n]), srcFile))
+	srcFile.Close()
+	defer func() {
+		if prepared != nil && prepared.width == 0 {
+			prepared.width, prepared.height = config.Width, config.Height
+		}
+	}()
+
+	// Create entry header
+	ext := imageExtension(mimeType, imgPath)
+	entryHeader := &zip.FileHeader{
+		Method: imageMethod(opts.Compression, mimeType, f.Method),
+	}
+	if !modTime.IsZero() {
+		entryHeader.Modified = f.Modified
+		if entryHeader.Modified.IsZero() || f.ModifiedDate == 0 {
+			entryHeader.Modified = modTime
+		}
+	}
+
+	// Spreads are decoded and cut in two pages
+	if opts.SplitSpreads && isSpread(config) {
+		return prepareSpreadImage(f, imgPath, entryHeader, opts, logger)
+	}
+
+	// Watermarked pages are decoded, stamped and encoded again
+	if opts.Watermark != "" {
+		return prepareWatermarkedImage(f, imgPath, entryHeader, opts, logger)
+	}
+
+	if entryHeader.Method == f.Method {
+		// Same method, copy the compressed bytes as they are
+		rawFile, err := f.OpenRaw()
+		if err != nil {
+			logger.Printf("Error opening image %s: %v", imgPath, err)
+			return nil
+		}
+		entryHeader.CRC32 = f.CRC32
+		entryHeader.CompressedSize64 = f.CompressedSize64
+		entryHeader.UncompressedSize64 = f.UncompressedSize64
+		// Entries decompressed to EOF have their CRC checked by archive/zip,
+		// raw copies are checked while they are copied
+		var src io.Reader = rawFile
+		var verify func() error
+		if opts.VerifySource {
+			src, verify = verifyingReader(rawFile, f)
+		}
+		opts.limits.doIO(func() {
+			if shouldSpill(f.CompressedSize64, opts.SpillThreshold) {
+				var spill *os.File
+				if spill, err = spillRaw(src); err == nil {
+					prepared = &preparedImage{header: entryHeader, ext: ext, spill: spill}
+				}
+			} else {
+				var data *bytes.Buffer
+				if data, err = readAllPooled(src); err == nil {
+					prepared = &preparedImage{header: entryHeader, ext: ext, data: data}
+				}
+			}
+		})
+		if verify != nil {
+			if verifyErr := verify(); verifyErr != nil && err == nil {
+				prepared.release()
+				logger.Printf("Error verifying image %s: %v", imgPath, verifyErr)
+				return nil
+			}
+		}
+		if err != nil {
+			logger.Printf("Error copying image %s: %v", imgPath, err)
+			return nil
+		}
+		return prepared
+	}
+
+	srcFile, err = f.Open()
+	if err != nil {
+		logger.Printf("Error opening image %s: %v", imgPath, err)
+		return nil
+	}
+	defer srcFile.Close()
+	if shouldSpill(f.UncompressedSize64, opts.SpillThreshold) {
+		// Streamed: reading and compressing can't be separated
+		opts.limits.doCPU(func() {
+			var spill *os.File
+			if spill, err = spillEntry(srcFile, entryHeader); err == nil {
+				prepared = &preparedImage{header: entryHeader, ext: ext, spill: spill}
+			}
+		})
+		if err != nil {
+			logger.Printf("Error compressing image %s: %v", imgPath, err)
+			return nil
+		}
+		return prepared
+	}
+
+	var content *bytes.Buffer
+	opts.limits.doIO(func() {
+		content, err = readAllPooled(srcFile)
+	})
+	if err != nil {
+		logger.Printf("Error copying image %s: %v", imgPath, err)
+		return nil
+	}
+	var data *bytes.Buffer
+	opts.limits.doCPU(func() {
+		data, err = compressEntry(content, entryHeader)
+	})
+	if err != nil {
+		logger.Printf("Error compressing image %s: %v", imgPath, err)
+		return nil
+	}
+	return &preparedImage{header: entryHeader, ext: ext, data: data}
+}
+
+// prepareWatermarkedImage stamps the watermark of the options on an image
+// and compresses the result for the output ZIP
+func prepareWatermarkedImage(f *zip.File, imgPath string, entryHeader *zip.FileHeader, opts Options, logger *log.Logger) *preparedImage {
+	srcFile, err := f.Open()
+	if err != nil {
+		logger.Printf("Error opening image %s: %v", imgPath, err)
+		return nil
+	}
+	defer srcFile.Close()
+
+	var content *bytes.Buffer
+	opts.limits.doIO(func() {
+		content, err = readAllPooled(srcFile)
+	})
+	if err != nil {
+		logger.Printf("Error copying image %s: %v", imgPath, err)
+		return nil
+	}
+	defer releaseEntryBuffer(content)
+
+	var data *bytes.Buffer
+	var spill *os.File
+	var mimeType string
+	opts.limits.doCPU(func() {
+		var stamped []byte
+		if stamped, mimeType, err = watermarkImage(content.Bytes(), opts.Watermark, opts.WatermarkStyle); err != nil {
+			return
+		}
+		entryHeader.Method = imageMethod(opts.Compression, mimeType, f.Method)
+		data, spill, err = compressPage(stamped, entryHeader, opts.SpillThreshold)
+	})
+	if err != nil {
+		logger.Printf("Error watermarking image %s: %v", imgPath, err)
+		return nil
+	}
+	return &preparedImage{header: entryHeader, ext: imageExtension(mimeType, imgPath), data: data, spill: spill}
+}
+
+// compressEntry compresses content with the method of the header, and fills
+// the CRC and sizes the header needs to be written raw.
+// The content buffer is consumed: it is either returned or released.
+func compressEntry(content *bytes.Buffer, entryHeader *zip.FileHeader) (*bytes.Buffer, error) {
+	entryHeader.CRC32 = crc32.ChecksumIEEE(content.Bytes())
+	entryHeader.UncompressedSize64 = uint64(content.Len())
+
+	data := content
+	if entryHeader.Method == zip.Deflate {
+		defer releaseEntryBuffer(content)
+		data = getEntryBuffer()
+		compressor, err := flate.NewWriter(data, flate.DefaultCompression)
+		if err == nil {
+			_, err = compressor.Write(content.Bytes())
+		}
+		if err == nil {
+			err = compressor.Close()
+		}
+		if err != nil {
+			releaseEntryBuffer(data)
+			return nil, err
+		}
+	}
+	entryHeader.CompressedSize64 = uint64(data.Len())
+	return data, nil
+}
+
+// release frees the data of a prepared image, in memory or on disk
+func (image *preparedImage) release() {
+	if image.spill != nil {
+		discardSpill(image.spill)
+	} else {
+		releaseEntryBuffer(image.data)
+	}
+}
+
+// writePreparedImage writes a prepared image in the output ZIP and reports whether it was written
+func writePreparedImage(zipw *zip.Writer, image *preparedImage, logger *log.Logger) bool {
+	defer image.release()
+
+	dstFile, err := zipw.CreateRaw(image.header)
+	if err != nil {
+		logger.Printf("Error creating entry in ZIP: %v", err)
+		return false
+	}
+	if image.spill != nil {
+		err = copySpill(dstFile, image.spill)
+	} else {
+		_, err = dstFile.Write(image.data.Bytes())
+	}
+	if err != nil {
+		logger.Printf("Error writing %s to ZIP: %v", image.header.Name, err)
+		return false
+	}
+	return true
+}
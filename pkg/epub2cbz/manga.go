@@ -0,0 +1,281 @@
+package epub2cbz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manga metadata providers
+const (
+	MangaAniList      = "anilist"
+	MangaMangaUpdates = "mangaupdates"
+)
+
+// Endpoints of the manga metadata providers
+const (
+	aniListAPI      = "https://graphql.anilist.co"
+	mangaUpdatesAPI = "https://api.mangaupdates.com/v1"
+)
+
+// mangaInterval is the delay between two requests to a manga provider,
+// below the rate limits of AniList (90 per minute) and MangaUpdates
+const mangaInterval = 700 * time.Millisecond
+
+// mangaSeries is the series metadata of a manga provider
+type mangaSeries struct {
+	Summary string
+	Genres  []string
+	Writers []string
+	Artists []string
+	Adult   bool // explicit content, rated Adults Only 18+
+	Mature  bool // mature content, rated Mature 17+
+}
+
+// mangaProviders look a series up by title, returning nil when not found
+var mangaProviders = map[string]func(c *mangaClient, title string) (*mangaSeries, error){
+	MangaAniList:      (*mangaClient).aniList,
+	MangaMangaUpdates: (*mangaClient).mangaUpdates,
+}
+
+// validateMangaProvider checks the manga provider given on the command line
+func validateMangaProvider(provider string) error {
+	if _, ok := mangaProviders[provider]; ok || provider == "" {
+		return nil
+	}
+	return fmt.Errorf("invalid manga metadata provider %q (expected %s or %s)", provider, MangaAniList, MangaMangaUpdates)
+}
+
+// mangaClient queries a manga provider. Series are looked up once per run,
+// the books of a batch being mostly volumes of the same series.
+type mangaClient struct {
+	provider string
+	client   *http.Client
+
+	throttle sync.Mutex
+	last     time.Time // time of the last request
+
+	mutex  sync.Mutex
+	series map[string]*mangaSeries // lookups by series title, nil when not found
+}
+
+// newMangaClient returns a client of a manga provider, or nil without provider
+func newMangaClient(provider string) *mangaClient {
+	if provider == "" {
+		return nil
+	}
+	return &mangaClient{
+		provider: provider,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		series:   make(map[string]*mangaSeries),
+	}
+}
+
+// request sends a JSON request to the provider and decodes its response
+func (c *mangaClient) request(method string, url string, body any, response any) error {
+	c.throttle.Lock()
+	if wait := mangaInterval - time.Since(c.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	c.last = time.Now()
+	c.throttle.Unlock()
+
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "epub2cbz/"+Version())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error querying %s: %w", c.provider, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error querying %s: %s", c.provider, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return fmt.Errorf("error decoding %s response: %w", c.provider, err)
+	}
+	return nil
+}
+
+// aniListQuery searches a manga by title with its description, genres and staff
+const aniListQuery = `query ($search: String) {
+  Media(search: $search, type: MANGA) {
+    description(asHtml: true)
+    genres
+    isAdult
+    staff { edges { role node { name { full } } } }
+  }
+}`
+
+// aniList looks a series up on AniList
+func (c *mangaClient) aniList(title string) (*mangaSeries, error) {
+	var response struct {
+		Data struct {
+			Media *struct {
+				Description string   `json:"description"`
+				Genres      []string `json:"genres"`
+				IsAdult     bool     `json:"isAdult"`
+				Staff       struct {
+					Edges []struct {
+						Role string `json:"role"`
+						Node struct {
+							Name struct {
+								Full string `json:"full"`
+							} `json:"name"`
+						} `json:"node"`
+					} `json:"edges"`
+				} `json:"staff"`
+			} `json:"Media"`
+		} `json:"data"`
+	}
+	body := map[string]any{"query": aniListQuery, "variables": map[string]string{"search": title}}
+	if err := c.request(http.MethodPost, aniListAPI, body, &response); err != nil || response.Data.Media == nil {
+		return nil, err
+	}
+
+	media := response.Data.Media
+	series := &mangaSeries{Summary: descriptionText(media.Description), Genres: media.Genres, Adult: media.IsAdult}
+	for _, edge := range media.Staff.Edges {
+		// Roles read "Story & Art", "Story", "Art" or "Art (assistant)"
+		name := edge.Node.Name.Full
+		if strings.Contains(edge.Role, "(") || name == "" {
+			continue
+		}
+		if strings.Contains(edge.Role, "Story") {
+			series.Writers = append(series.Writers, name)
+		}
+		if strings.Contains(edge.Role, "Art") {
+			series.Artists = append(series.Artists, name)
+		}
+	}
+	return series, nil
+}
+
+// mangaUpdates looks a series up on MangaUpdates, preferring the result
+// titled exactly like the book
+func (c *mangaClient) mangaUpdates(title string) (*mangaSeries, error) {
+	var search struct {
+		Results []struct {
+			Record struct {
+				ID    int64  `json:"series_id"`
+				Title string `json:"title"`
+			} `json:"record"`
+		} `json:"results"`
+	}
+	body := map[string]any{"search": title, "perpage": 10}
+	if err := c.request(http.MethodPost, mangaUpdatesAPI+"/series/search", body, &search); err != nil || len(search.Results) == 0 {
+		return nil, err
+	}
+	id := search.Results[0].Record.ID
+	for _, result := range search.Results {
+		if strings.EqualFold(result.Record.Title, title) {
+			id = result.Record.ID
+			break
+		}
+	}
+
+	var record struct {
+		Description string `json:"description"`
+		Genres      []struct {
+			Genre string `json:"genre"`
+		} `json:"genres"`
+		Authors []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"authors"`
+	}
+	if err := c.request(http.MethodGet, fmt.Sprintf("%s/series/%d", mangaUpdatesAPI, id), nil, &record); err != nil {
+		return nil, err
+	}
+	series := &mangaSeries{Summary: descriptionText(record.Description)}
+	for _, genre := range record.Genres {
+		series.Genres = append(series.Genres, genre.Genre)
+		switch genre.Genre {
+		case "Adult", "Hentai", "Smut":
+			series.Adult = true
+		case "Mature":
+			series.Mature = true
+		}
+	}
+	for _, author := range record.Authors {
+		switch author.Type {
+		case "Author":
+			series.Writers = append(series.Writers, author.Name)
+		case "Artist":
+			series.Artists = append(series.Artists, author.Name)
+		}
+	}
+	return series, nil
+}
+
+// lookup returns the provider metadata of a series, nil when not found
+func (c *mangaClient) lookup(title string) (*mangaSeries, error) {
+	key := strings.ToLower(strings.TrimSpace(title))
+	c.mutex.Lock()
+	series, ok := c.series[key]
+	c.mutex.Unlock()
+	if ok {
+		return series, nil
+	}
+	series, err := mangaProviders[c.provider](c, title)
+	if err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.series[key] = series
+	c.mutex.Unlock()
+	return series, nil
+}
+
+// enrich fills the empty Genre, Summary, Writer, Penciller and AgeRating
+// fields of a ComicInfo with the metadata of its series, looked up by
+// series (or title). It reports whether the series was found.
+func (c *mangaClient) enrich(info *ComicInfo) (bool, error) {
+	title := firstNonEmpty(info.Series, info.Title)
+	if title == "" {
+		return false, nil
+	}
+	series, err := c.lookup(title)
+	if err != nil || series == nil {
+		return false, err
+	}
+
+	fill := func(dst *string, values ...string) {
+		values = slices.DeleteFunc(slices.Clone(values), func(value string) bool { return value == "" })
+		if *dst == "" {
+			*dst = strings.Join(slices.Compact(values), ", ")
+		}
+	}
+	fill(&info.Summary, series.Summary)
+	fill(&info.Genre, series.Genres...)
+	fill(&info.Writer, series.Writers...)
+	fill(&info.Penciller, series.Artists...)
+	if info.AgeRating == "" || info.AgeRating == "Unknown" {
+		switch {
+		case series.Adult:
+			info.AgeRating = "Adults Only 18+"
+		case series.Mature:
+			info.AgeRating = "Mature 17+"
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,178 @@
+package epub2cbz
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// manifestJob is a row of a manifest: a book, its output and the metadata
+// corrections applied to it
+type manifestJob struct {
+	line      int
+	source    string
+	output    string // empty for the default output path
+	overrides map[string]string
+}
+
+// readManifest reads a CSV manifest. The header names the columns: "source"
+// is required, "destination" is optional, and every other column is a
+// ComicInfo field (series, number, age rating...) whose non-empty values
+// override the EPUB metadata. Relative paths are relative to the manifest.
+func readManifest(manifestPath string) ([]manifestJob, error) {
+	file, err := os.Open(longPath(manifestPath))
+	if err != nil {
+		return nil, fmt.Errorf("error opening manifest: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest header: %w", err)
+	}
+
+	sourceColumn, outputColumn := -1, -1
+	fields := make(map[int]string)
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		switch strings.ToLower(name) {
+		case "source":
+			sourceColumn = i
+		case "destination", "output":
+			outputColumn = i
+		default:
+			if _, ok := comicInfoField(name); !ok {
+				return nil, fmt.Errorf("error reading manifest header: unknown ComicInfo field %q", name)
+			}
+			fields[i] = name
+		}
+	}
+	if sourceColumn < 0 {
+		return nil, fmt.Errorf("error reading manifest header: no source column")
+	}
+
+	dir := filepath.Dir(manifestPath)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) || IsRemoteURL(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	var jobs []manifestJob
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading manifest: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		job := manifestJob{line: line, source: resolve(strings.TrimSpace(record[sourceColumn]))}
+		if job.source == "" {
+			return nil, fmt.Errorf("error reading manifest line %d: empty source", line)
+		}
+		if outputColumn >= 0 {
+			job.output = resolve(strings.TrimSpace(record[outputColumn]))
+		}
+		for i, name := range fields {
+			if value := strings.TrimSpace(record[i]); value != "" {
+				if job.overrides == nil {
+					job.overrides = make(map[string]string)
+				}
+				job.overrides[name] = value
+			}
+		}
+		if err := validateOverrides(job.overrides); err != nil {
+			return nil, fmt.Errorf("error reading manifest line %d: %w", line, err)
+		}
+		jobs = append(jobs, job)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("error reading manifest: no books listed")
+	}
+	return jobs, nil
+}
+
+// processManifest converts the books of a manifest with their corrections
+// and returns the files that failed
+func processManifest(jobs []manifestJob, opts Options) []string {
+	opts.batch = true
+	if opts.MaxOpen > 0 {
+		opts.readers = newReaderCache(opts.MaxOpen)
+	} else {
+		opts.readers = newReaderCache(opts.Jobs)
+	}
+	defer opts.readers.close()
+
+	// Two rows writing the same output would overwrite each other
+	var failed []string
+	outputs := make(map[string]int)
+	for i := range jobs {
+		if jobs[i].output == "" {
+			jobs[i].output = defaultOutputPath(jobs[i].source, opts)
+		}
+		key := strings.ToLower(jobs[i].output)
+		if line, ok := outputs[key]; ok {
+			opts.logger().Printf("Error in manifest line %d: output %s already written by line %d", jobs[i].line, jobs[i].output, line)
+			failed = append(failed, jobs[i].source)
+			jobs[i].output = ""
+			continue
+		}
+		outputs[key] = jobs[i].line
+	}
+
+	opts.Events.batchStart(len(outputs))
+
+	var wg sync.WaitGroup
+	var failedMutex sync.Mutex
+	semaphore := make(chan struct{}, opts.Jobs)
+	for _, job := range jobs {
+		if job.output == "" {
+			continue
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(job manifestJob) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			jobOpts := opts
+			// The corrections of the row win over the ones of the command line
+			jobOpts.Overrides = maps.Clone(opts.Overrides)
+			if jobOpts.Overrides == nil {
+				jobOpts.Overrides = make(map[string]string)
+			}
+			maps.Copy(jobOpts.Overrides, job.overrides)
+			err := createOutputDir(job.output)
+			if err != nil {
+				opts.logger().Printf("Error creating output directory structure for %s: %v", job.source, err)
+				opts.Events.fileFailed(job.source, job.output, err)
+			} else if err = processFile(job.source, job.output, jobOpts); IsSkipped(err) {
+				opts.printf("Skipped %s: %v\n", job.source, err)
+				err = nil
+			} else if err != nil {
+				opts.logger().Printf("ERROR processing %s: %v", job.source, err)
+			}
+			if err != nil {
+				failedMutex.Lock()
+				failed = append(failed, job.source)
+				failedMutex.Unlock()
+			}
+		}(job)
+	}
+
+	wg.Wait()
+	sort.Strings(failed)
+	return failed
+}
@@ -0,0 +1,118 @@
+package epub2cbz
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// defaultMappingsJSON are the mapping tables used without -mappings, also
+// the starting point of custom tables
+//
+//go:embed schema/mappings.json
+var defaultMappingsJSON []byte
+
+// enumMapping maps the vocabulary of publisher metadata onto the values of
+// a ComicInfo enum field
+type enumMapping struct {
+	// Sources are the metadata read, in order: "meta:<name>" for an OPF
+	// <meta> element, "subject" for the dc:subject values and "spine" for
+	// the page-progression-direction of the spine
+	Sources []string `json:"sources"`
+	// Values maps publisher values, ignoring case, to ComicInfo values
+	Values map[string]string `json:"values"`
+}
+
+// enumMappings are the mapping tables, by ComicInfo field
+type enumMappings map[string]enumMapping
+
+// loadMappings reads the mapping tables of a JSON file, or the default ones
+// when path is empty, and checks every value against the ComicInfo schema
+func loadMappings(path string) (enumMappings, error) {
+	data := defaultMappingsJSON
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("error reading mappings: %w", err)
+		}
+	}
+	var mappings enumMappings
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, fmt.Errorf("error decoding mappings %s: %w", path, err)
+	}
+
+	schema, err := loadComicInfoSchema()
+	if err != nil {
+		return nil, err
+	}
+	comicInfoType := schema.complexType("ComicInfo")
+	var problems []error
+	result := make(enumMappings, len(mappings))
+	for field, mapping := range mappings {
+		i, ok := comicInfoField(field)
+		if !ok || reflect.TypeOf(ComicInfo{}).Field(i).Type.Kind() != reflect.String {
+			problems = append(problems, fmt.Errorf("unknown ComicInfo text field %q", field))
+			continue
+		}
+		name := reflect.TypeOf(ComicInfo{}).Field(i).Name
+		for _, source := range mapping.Sources {
+			if source != "subject" && source != "spine" && !strings.HasPrefix(source, "meta:") {
+				problems = append(problems, fmt.Errorf("%s: invalid source %q (expected subject, spine or meta:<name>)", field, source))
+			}
+		}
+		for _, element := range comicInfoType.Sequence {
+			if element.Name != name {
+				continue
+			}
+			for from, to := range mapping.Values {
+				for _, err := range schema.validateValue(to, element.Type) {
+					problems = append(problems, fmt.Errorf("%s: %q: %w", field, from, err))
+				}
+			}
+		}
+
+		// Publisher values are matched ignoring case
+		values := make(map[string]string, len(mapping.Values))
+		for from, to := range mapping.Values {
+			values[strings.ToLower(strings.TrimSpace(from))] = to
+		}
+		result[name] = enumMapping{Sources: mapping.Sources, Values: values}
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid mappings %s: %w", path, errors.Join(problems...))
+	}
+	return result, nil
+}
+
+// apply sets the ComicInfo fields whose mapping matches a metadata value,
+// the first source holding a known value winning
+func (m enumMappings) apply(info *ComicInfo, metadata Metadata) {
+	v := reflect.ValueOf(info).Elem()
+	for field, mapping := range m {
+		i, ok := comicInfoField(field)
+		if !ok {
+			continue
+		}
+	sources:
+		for _, source := range mapping.Sources {
+			var values []string
+			if name, ok := strings.CutPrefix(source, "meta:"); ok {
+				values = []string{metadata.Meta[name]}
+			} else if source == "subject" {
+				values = metadata.Subject
+			} else if source == "spine" {
+				values = []string{metadata.Direction}
+			}
+			for _, value := range values {
+				if mapped, ok := mapping.Values[strings.ToLower(strings.TrimSpace(value))]; ok {
+					v.Field(i).SetString(mapped)
+					break sources
+				}
+			}
+		}
+	}
+}
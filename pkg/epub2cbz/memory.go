@@ -0,0 +1,115 @@
+package epub2cbz
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ParseByteSize parses a size such as 512M, 2G or 1048576
+func ParseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		value  int64
+	}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40}} {
+		if trimmed, ok := strings.CutSuffix(strings.TrimSuffix(s, "B"), unit.suffix); ok {
+			s, multiplier = trimmed, unit.value
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, "B")), 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// FormatBytes formats a size with a binary unit
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// estimateMemory estimates the memory a conversion needs from the central
+// directory of the EPUB: each page worker holds one whole image, plus its
+// compressed copy when the image is recompressed. Entries spilled to disk
+// only count up to the spill threshold.
+func estimateMemory(epubPath string, opts Options) (int64, error) {
+	zipReader, closeEPUB, err := openEPUB(epubPath, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer closeEPUB()
+
+	workers := pageWorkers(opts, opts.batch)
+	spillThreshold := opts.SpillThreshold
+	sizes := make([]int64, 0, len(zipReader.File))
+	for _, f := range zipReader.File {
+		size := int64(f.UncompressedSize64)
+		if spillThreshold > 0 && size > spillThreshold {
+			size = spillThreshold
+		}
+		sizes = append(sizes, size)
+	}
+	slices.Sort(sizes)
+	slices.Reverse(sizes)
+
+	estimate := int64(copyBufferSize + outputBufferSize)
+	for i := 0; i < workers && i < len(sizes); i++ {
+		estimate += 2 * sizes[i]
+	}
+	return estimate, nil
+}
+
+// memoryBudget limits the memory estimated for the conversions running
+// at the same time. A zero limit disables the budget.
+type memoryBudget struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	limit int64
+	used  int64
+}
+
+// newMemoryBudget creates a budget of limit bytes
+func newMemoryBudget(limit int64) *memoryBudget {
+	budget := &memoryBudget{limit: limit}
+	budget.cond = sync.NewCond(&budget.mutex)
+	return budget
+}
+
+// acquire blocks until amount bytes fit in the budget and reserves them.
+// A conversion larger than the whole budget runs once nothing else is running.
+func (b *memoryBudget) acquire(amount int64) {
+	if b.limit <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.used > 0 && b.used+amount > b.limit {
+		b.cond.Wait()
+	}
+	b.used += amount
+}
+
+// release returns amount bytes to the budget
+func (b *memoryBudget) release(amount int64) {
+	if b.limit <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	b.used -= amount
+	b.mutex.Unlock()
+	b.cond.Broadcast()
+}
@@ -0,0 +1,152 @@
+package epub2cbz
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestMetadataUnmarshalXML decodes the OPF packages of testdata/opf, written
+// the way publishers and tools produce them
+func TestMetadataUnmarshalXML(t *testing.T) {
+	tests := []struct {
+		file        string
+		title       []string
+		creator     []string
+		publisher   []string
+		language    []string
+		identifier  []string
+		date        []string
+		series      []string
+		number      []string
+		subject     []string
+		credits     []credit
+		meta        map[string]string
+		collections []collectionMeta
+		direction   string
+	}{
+		{
+			// OPF 2 written by Calibre: opf:role and opf:scheme attributes,
+			// series in calibre metas
+			file:       "calibre-opf2.opf",
+			title:      []string{"Spy x Family, Vol. 3"},
+			creator:    []string{"Tatsuya Endo"},
+			publisher:  []string{"VIZ Media LLC"},
+			language:   []string{"en"},
+			identifier: []string{"1873", "5c0e3a4e-3d1b-4b8f-9d0a-58e1c8b8f0a7", "urn:isbn:9781974715466"},
+			date:       []string{"2021-03-02T08:00:00+00:00"},
+			series:     []string{"Spy x Family"},
+			number:     []string{"3"},
+			subject:    []string{"Comics & Graphic Novels", "Manga"},
+			credits: []credit{
+				{Name: "Tatsuya Endo", Role: "aut"},
+				{Name: "Casey Loe", Role: "trl", Contributor: true},
+				{Name: "calibre (6.29.0) [https://calibre-ebook.com]", Role: "bkp", Contributor: true},
+			},
+			meta: map[string]string{"calibre:series": "Spy x Family", "cover": "cover"},
+		},
+		{
+			// OPF 3 of a Japanese fixed layout manga: roles and series in
+			// refining metas, right to left spine
+			file:       "fixed-layout-opf3.opf",
+			title:      []string{"進撃の巨人（１）", "Attack on Titan 1"},
+			creator:    []string{"諫山創"},
+			publisher:  []string{"講談社"},
+			language:   []string{"ja"},
+			identifier: []string{"urn:isbn:9784063842760"},
+			date:       []string{"2010-03-17"},
+			series:     []string{"進撃の巨人"},
+			number:     []string{"1"},
+			credits: []credit{
+				{Name: "諫山創", Role: "aut", ID: "creator01"},
+				{Name: "講談社デジタル製作", Role: "bkp", ID: "contributor01", Contributor: true},
+			},
+			meta:        map[string]string{"rendition:layout": "pre-paginated", "cover": "cover"},
+			collections: []collectionMeta{{ID: "c01", Name: "進撃の巨人"}},
+			direction:   "rtl",
+		},
+		{
+			// OPF 2 with every element prefixed by opf:, as InDesign exports
+			file:       "prefixed-opf2.opf",
+			title:      []string{"Bone: Out from Boneville"},
+			creator:    []string{"Jeff Smith"},
+			publisher:  []string{"Cartoon Books"},
+			language:   []string{"en-US"},
+			identifier: []string{"urn:isbn:9780439706407"},
+			date:       []string{"2005-02-01"},
+			subject:    []string{"Fantasy"},
+			credits: []credit{
+				{Name: "Jeff Smith", Role: "aut"},
+				{Name: "Steve Hamaker", Role: "clr", Contributor: true},
+			},
+			meta: map[string]string{"generator": "Adobe InDesign 7.5", "cover": "x01.jpg"},
+		},
+		{
+			// OEB 1.x package: dc-metadata wrapper, capitalized Dublin Core
+			// names in the 1.0 namespace, unprefixed role and scheme
+			file:       "oeb-dc-metadata.opf",
+			title:      []string{"Akira Volume 1"},
+			creator:    []string{"Katsuhiro Otomo"},
+			publisher:  []string{"Kodansha Comics"},
+			language:   []string{"en"},
+			identifier: []string{"urn:isbn:1935429000"},
+			date:       []string{"2009-10-13"},
+			subject:    []string{"Science Fiction"},
+			credits:    []credit{{Name: "Katsuhiro Otomo", Role: "aut"}},
+			meta:       map[string]string{"book-type": "comic"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", "opf", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var pkg Package
+			if err := xml.Unmarshal(data, &pkg); err != nil {
+				t.Fatalf("error decoding package: %v", err)
+			}
+			m := pkg.Metadata
+
+			fields := []struct {
+				name      string
+				got, want []string
+			}{
+				{"title", m.Title, test.title},
+				{"creator", m.Creator, test.creator},
+				{"publisher", m.Publisher, test.publisher},
+				{"language", m.Language, test.language},
+				{"identifier", m.Identifier, test.identifier},
+				{"date", m.Date, test.date},
+				{"series", m.Series, test.series},
+				{"number", m.Number, test.number},
+				{"subject", m.Subject, test.subject},
+			}
+			for _, field := range fields {
+				if !slices.Equal(field.got, field.want) {
+					t.Errorf("%s = %q, want %q", field.name, field.got, field.want)
+				}
+			}
+			if !slices.Equal(m.Credits, test.credits) {
+				t.Errorf("credits = %+v, want %+v", m.Credits, test.credits)
+			}
+			for name, want := range test.meta {
+				if got := m.Meta[name]; got != want {
+					t.Errorf("meta %s = %q, want %q", name, got, want)
+				}
+			}
+			if !slices.Equal(m.Collections, test.collections) {
+				t.Errorf("collections = %+v, want %+v", m.Collections, test.collections)
+			}
+			if pkg.Spine.Direction != test.direction {
+				t.Errorf("spine direction = %q, want %q", pkg.Spine.Direction, test.direction)
+			}
+			if len(pkg.Manifest.Items) == 0 || len(pkg.Spine.Itemrefs) == 0 {
+				t.Errorf("manifest and spine not decoded: %d item(s), %d itemref(s)", len(pkg.Manifest.Items), len(pkg.Spine.Itemrefs))
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package epub2cbz
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the conversion duration histogram
+var durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// failureReasons classifies conversion errors by the start of their message,
+// to label the failure counter with a bounded set of values
+var failureReasons = []struct {
+	prefix string
+	reason string
+}{
+	{"no images extracted", "no_images"},
+	{"no pages found", "no_pages"},
+	{"error opening EPUB", "open"},
+	{"input file must have", "not_epub"},
+	{"invalid ComicInfo.xml", "metadata"},
+	{"output ", "output_path"},
+	{"error creating ZIP", "write"},
+	{"error writing ZIP", "write"},
+	{"error closing ZIP", "write"},
+	{"error moving ZIP", "write"},
+	{"error uploading", "upload"},
+}
+
+// metrics counts the conversions of a long running process, exposed in the
+// Prometheus text format
+type metrics struct {
+	mutex       sync.Mutex
+	conversions map[string]int64 // by status
+	failures    map[string]int64 // by reason
+	pages       int64
+	inputBytes  int64
+	outputBytes int64
+	buckets     []int64 // cumulative counts of durationBuckets
+	count       int64
+	sum         float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		conversions: make(map[string]int64),
+		failures:    make(map[string]int64),
+		buckets:     make([]int64, len(durationBuckets)),
+	}
+}
+
+// startMetrics serves the metrics on addr under /metrics, logging the errors
+// of the server to logger
+func startMetrics(addr string, logger *log.Logger) *metrics {
+	m := newMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.write(w)
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Printf("Error serving metrics on %s: %v", addr, err)
+		}
+	}()
+	return m
+}
+
+// fileDone records the outcome of a conversion
+func (m *metrics) fileDone(epubPath string, stats *conversionStats, elapsed time.Duration, err error) {
+	var inputSize int64
+	if info, statErr := os.Stat(longPath(epubPath)); statErr == nil {
+		inputSize = info.Size()
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	switch {
+	case IsSkipped(err):
+		m.conversions[StatusSkipped]++
+		return
+	case err != nil:
+		m.conversions[StatusFailed]++
+		m.failures[failureReason(err)]++
+	default:
+		m.conversions[StatusConverted]++
+	}
+
+	m.inputBytes += inputSize
+	if stats != nil {
+		m.pages += int64(stats.Images)
+		m.outputBytes += stats.OutputBytes
+	}
+	seconds := elapsed.Seconds()
+	m.count++
+	m.sum += seconds
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+}
+
+// failureReason returns the label of the failure counter matching an error
+func failureReason(err error) string {
+	// Wrapped errors keep the message of their outermost context
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		for _, known := range failureReasons {
+			if strings.HasPrefix(e.Error(), known.prefix) {
+				return known.reason
+			}
+		}
+	}
+	return "other"
+}
+
+// write prints the metrics in the Prometheus text exposition format
+func (m *metrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP epub2cbz_conversions_total Files processed, by outcome.")
+	fmt.Fprintln(w, "# TYPE epub2cbz_conversions_total counter")
+	for _, status := range []string{StatusConverted, StatusSkipped, StatusFailed} {
+		fmt.Fprintf(w, "epub2cbz_conversions_total{status=%q} %d\n", status, m.conversions[status])
+	}
+
+	fmt.Fprintln(w, "# HELP epub2cbz_failures_total Failed conversions, by error type.")
+	fmt.Fprintln(w, "# TYPE epub2cbz_failures_total counter")
+	reasons := make([]string, 0, len(m.failures))
+	for reason := range m.failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "epub2cbz_failures_total{reason=%q} %d\n", reason, m.failures[reason])
+	}
+
+	fmt.Fprintln(w, "# HELP epub2cbz_pages_total Images written to CBZ files.")
+	fmt.Fprintln(w, "# TYPE epub2cbz_pages_total counter")
+	fmt.Fprintf(w, "epub2cbz_pages_total %d\n", m.pages)
+	fmt.Fprintln(w, "# HELP epub2cbz_input_bytes_total Size of the EPUB files processed.")
+	fmt.Fprintln(w, "# TYPE epub2cbz_input_bytes_total counter")
+	fmt.Fprintf(w, "epub2cbz_input_bytes_total %d\n", m.inputBytes)
+	fmt.Fprintln(w, "# HELP epub2cbz_output_bytes_total Size of the CBZ files written.")
+	fmt.Fprintln(w, "# TYPE epub2cbz_output_bytes_total counter")
+	fmt.Fprintf(w, "epub2cbz_output_bytes_total %d\n", m.outputBytes)
+
+	fmt.Fprintln(w, "# HELP epub2cbz_conversion_duration_seconds Duration of the conversions, skipped files excluded.")
+	fmt.Fprintln(w, "# TYPE epub2cbz_conversion_duration_seconds histogram")
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(w, "epub2cbz_conversion_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.buckets[i])
+	}
+	fmt.Fprintf(w, "epub2cbz_conversion_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "epub2cbz_conversion_duration_seconds_sum %g\n", m.sum)
+	fmt.Fprintf(w, "epub2cbz_conversion_duration_seconds_count %d\n", m.count)
+}
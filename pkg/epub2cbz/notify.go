@@ -0,0 +1,287 @@
+package epub2cbz
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifier posts a JSON payload to a webhook after each conversion and at the
+// end of a batch, sends the batch summary to ntfy and by email, and counts the
+// outcomes for that summary
+type notifier struct {
+	webhook string
+	ntfy    string // ntfy topic URL, e.g. https://ntfy.sh/my-topic
+	email   string // recipient of the summary email
+	client  *http.Client
+	start   time.Time
+	logger  *log.Logger // receives the errors of the notifications
+
+	mutex     sync.Mutex
+	converted int
+	skipped   int
+	failed    []string
+}
+
+// fileNotification is sent after each conversion. Text is duplicated in the
+// fields read by Slack (text) and Discord (content) incoming webhooks.
+type fileNotification struct {
+	Event    string                `json:"event"`
+	File     string                `json:"file"`
+	Status   string                `json:"status"`
+	Output   string                `json:"output,omitempty"`
+	Error    string                `json:"error,omitempty"`
+	Pages    int                   `json:"pages,omitempty"`
+	Bytes    int64                 `json:"bytes,omitempty"`
+	Metadata *notificationMetadata `json:"metadata,omitempty"`
+	Text     string                `json:"text"`
+	Content  string                `json:"content"`
+}
+
+// notificationMetadata summarizes the metadata of a converted book
+type notificationMetadata struct {
+	Title  string `json:"title,omitempty"`
+	Series string `json:"series,omitempty"`
+	Number string `json:"number,omitempty"`
+	Writer string `json:"writer,omitempty"`
+}
+
+// batchNotification is sent once a directory has been converted
+type batchNotification struct {
+	Event     string   `json:"event"`
+	Source    string   `json:"source"`
+	Converted int      `json:"converted"`
+	Skipped   int      `json:"skipped"`
+	Failed    int      `json:"failed"`
+	Files     []string `json:"failed_files,omitempty"`
+	Seconds   float64  `json:"seconds"`
+	Text      string   `json:"text"`
+	Content   string   `json:"content"`
+}
+
+// newNotifier returns a notifier for the given targets, or nil without any
+func newNotifier(webhook string, ntfy string, email string, logger *log.Logger) *notifier {
+	if webhook == "" && ntfy == "" && email == "" {
+		return nil
+	}
+	return &notifier{
+		webhook: webhook,
+		ntfy:    ntfy,
+		email:   email,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		start:   time.Now(),
+		logger:  logger,
+	}
+}
+
+// fileDone reports the outcome of a conversion
+func (n *notifier) fileDone(epubPath string, outputPath string, stats *conversionStats, err error) {
+	payload := fileNotification{Event: "file", File: epubPath}
+	n.mutex.Lock()
+	switch {
+	case IsSkipped(err):
+		n.skipped++
+		payload.Status = StatusSkipped
+		payload.Error = err.Error()
+		payload.Text = fmt.Sprintf("Skipped %s: %v", epubPath, err)
+	case err != nil:
+		n.failed = append(n.failed, epubPath)
+		payload.Status = StatusFailed
+		payload.Error = err.Error()
+		payload.Text = fmt.Sprintf("Failed to convert %s: %v", epubPath, err)
+	default:
+		n.converted++
+		payload.Status = StatusConverted
+		payload.Output = outputPath
+		payload.Text = fmt.Sprintf("Converted %s to %s", epubPath, outputPath)
+	}
+	n.mutex.Unlock()
+
+	if stats != nil {
+		payload.Pages = stats.Images
+		payload.Bytes = stats.OutputBytes
+		if info := stats.ComicInfo; info != nil {
+			payload.Metadata = &notificationMetadata{Title: info.Title, Series: info.Series, Number: info.Number, Writer: info.Writer}
+		}
+	}
+	payload.Content = payload.Text
+	if n.webhook != "" {
+		n.post(payload)
+	}
+}
+
+// batchDone reports the summary of a directory conversion
+func (n *notifier) batchDone(sourceDir string) {
+	n.mutex.Lock()
+	payload := batchNotification{
+		Event:     "batch",
+		Source:    sourceDir,
+		Converted: n.converted,
+		Skipped:   n.skipped,
+		Failed:    len(n.failed),
+		Files:     append([]string(nil), n.failed...),
+		Seconds:   time.Since(n.start).Seconds(),
+	}
+	n.mutex.Unlock()
+	payload.Text = fmt.Sprintf("Converted %d file(s) from %s in %s, %d skipped, %d failed",
+		payload.Converted, sourceDir, time.Since(n.start).Round(time.Second), payload.Skipped, payload.Failed)
+	payload.Content = payload.Text
+	if n.webhook != "" {
+		n.post(payload)
+	}
+
+	// ntfy and email only receive the summary, with the failed files
+	message := payload.Text
+	if len(payload.Files) > 0 {
+		message += "\n\nFailed files:\n" + strings.Join(payload.Files, "\n")
+	}
+	priority := "default"
+	if payload.Failed > 0 {
+		priority = "high"
+	}
+	if n.ntfy != "" {
+		if err := n.sendNtfy("epub2cbz: "+sourceDir, message, priority); err != nil {
+			n.logger.Printf("Error sending ntfy notification: %v", err)
+		}
+	}
+	if n.email != "" {
+		if err := sendEmail(n.email, "epub2cbz: "+sourceDir, message); err != nil {
+			n.logger.Printf("Error sending email notification: %v", err)
+		}
+	}
+}
+
+// sendNtfy publishes a message to an ntfy topic
+func (n *notifier) sendNtfy(title string, message string, priority string) error {
+	req, err := http.NewRequest(http.MethodPost, n.ntfy, strings.NewReader(message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", title)
+	req.Header.Set("Priority", priority)
+	req.Header.Set("Tags", "books")
+	if token := os.Getenv("NTFY_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// emailAttachment is a file attached to an email
+type emailAttachment struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// sendEmail sends a plain text email through the SMTP server configured by
+// SMTP_HOST, SMTP_PORT (587 by default), SMTP_USER, SMTP_PASSWORD and SMTP_FROM
+func sendEmail(to string, subject string, body string, attachments ...emailAttachment) error {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return fmt.Errorf("SMTP_HOST is not set")
+	}
+	port := firstNonEmpty(os.Getenv("SMTP_PORT"), "587")
+	user := os.Getenv("SMTP_USER")
+	from := firstNonEmpty(os.Getenv("SMTP_FROM"), user)
+	if from == "" {
+		return fmt.Errorf("SMTP_FROM is not set")
+	}
+
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	var message bytes.Buffer
+	message.WriteString("From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n")
+	text := strings.ReplaceAll(body, "\n", "\r\n") + "\r\n"
+	if len(attachments) == 0 {
+		message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n" + text)
+	} else {
+		parts := multipart.NewWriter(&message)
+		message.WriteString("Content-Type: multipart/mixed; boundary=" + parts.Boundary() + "\r\n\r\n")
+		part, _ := parts.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+		io.WriteString(part, text)
+		for _, attachment := range attachments {
+			part, _ := parts.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {attachment.contentType},
+				"Content-Transfer-Encoding": {"base64"},
+				"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": attachment.name})},
+			})
+			encoder := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: part})
+			encoder.Write(attachment.data)
+			encoder.Close()
+		}
+		parts.Close()
+	}
+	return smtp.SendMail(net.JoinHostPort(host, port), auth, from, []string{to}, message.Bytes())
+}
+
+// lineWrapper breaks base64 output in the 76 character lines of MIME
+type lineWrapper struct {
+	w      io.Writer
+	column int
+}
+
+func (l *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := min(len(p), 76-l.column)
+		if _, err := l.w.Write(p[:chunk]); err != nil {
+			return written, err
+		}
+		written += chunk
+		l.column += chunk
+		p = p[chunk:]
+		if l.column == 76 {
+			if _, err := io.WriteString(l.w, "\r\n"); err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+	}
+	return written, nil
+}
+
+// post sends a payload to the webhook. Failures are only logged, a
+// notification must never fail a conversion.
+func (n *notifier) post(payload any) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		n.logger.Printf("Error marshaling notification: %v", err)
+		return
+	}
+	resp, err := n.client.Post(n.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		n.logger.Printf("Error sending notification: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		n.logger.Printf("Error sending notification: %s", resp.Status)
+	}
+}
@@ -0,0 +1,433 @@
+package epub2cbz
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sizes used to stream objects: ranges fetched for reads, parts sent for writes
+const (
+	objectBlockSize  = 1 << 20 // bytes fetched by each ranged GET
+	objectBlockCount = 16      // blocks kept in memory per open object
+	objectPartSize   = 8 << 20 // multipart upload part size, S3 requires at least 5 MB
+)
+
+// objectURL designates an object of a bucket, s3://bucket/key or gs://bucket/key
+type objectURL struct {
+	Scheme string
+	Bucket string
+	Key    string
+}
+
+// parseObjectURL parses an object storage URL, it returns false for local paths
+func parseObjectURL(s string) (objectURL, bool) {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok || (scheme != "s3" && scheme != "gs") {
+		return objectURL{}, false
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return objectURL{}, false
+	}
+	return objectURL{Scheme: scheme, Bucket: bucket, Key: key}, true
+}
+
+// isObjectURL reports whether a path designates an object storage URL
+func isObjectURL(s string) bool {
+	_, ok := parseObjectURL(s)
+	return ok
+}
+
+func (o objectURL) String() string {
+	return o.Scheme + "://" + o.Bucket + "/" + o.Key
+}
+
+// objectStore sends signed requests to an S3 compatible API. Google Cloud
+// Storage is reached through its XML API with HMAC keys.
+type objectStore struct {
+	endpoint     *url.URL
+	virtualHost  bool // bucket in the host name rather than in the path
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// newObjectStore configures a store from the environment: the usual
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN, AWS_REGION and
+// AWS_ENDPOINT_URL for s3://, and GCS_ACCESS_KEY_ID, GCS_SECRET_ACCESS_KEY
+// for gs:// (falling back to the AWS variables)
+func newObjectStore(scheme string) (*objectStore, error) {
+	store := &objectStore{client: &http.Client{Timeout: remoteTimeout}}
+	var endpoint string
+	switch scheme {
+	case "s3":
+		store.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		store.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		store.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		store.region = firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+		if endpoint == "" {
+			endpoint = "https://s3." + store.region + ".amazonaws.com"
+			store.virtualHost = true
+		}
+	case "gs":
+		store.accessKey = firstNonEmpty(os.Getenv("GCS_ACCESS_KEY_ID"), os.Getenv("AWS_ACCESS_KEY_ID"))
+		store.secretKey = firstNonEmpty(os.Getenv("GCS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		store.region = "auto"
+		endpoint = "https://storage.googleapis.com"
+	default:
+		return nil, fmt.Errorf("unsupported object storage scheme %q", scheme)
+	}
+	if store.accessKey == "" || store.secretKey == "" {
+		return nil, fmt.Errorf("missing credentials for %s:// URLs", scheme)
+	}
+
+	var err error
+	if store.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid object storage endpoint %q: %w", endpoint, err)
+	}
+	return store, nil
+}
+
+// do sends a request signed with AWS signature version 4 and returns the
+// response when its status is a success
+func (s *objectStore) do(method string, object objectURL, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	key := "/" + object.Key
+	if s.virtualHost {
+		u.Host = object.Bucket + "." + u.Host
+	} else {
+		key = "/" + object.Bucket + key
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + key
+	u.RawPath = awsURIEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, object, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS signature version 4 headers to a request
+func (s *objectStore) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256.Sum256(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	signed := []string{"host"}
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			signed = append(signed, lower)
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	sort.Strings(signed)
+	var canonicalHeaders strings.Builder
+	for _, name := range signed {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes a string the way signature version 4 expects
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query parameters sorted by name
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			parts = append(parts, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// statObject returns the size and modification time of an object
+func statObject(rawURL string) (int64, time.Time, error) {
+	object, _ := parseObjectURL(rawURL)
+	store, err := newObjectStore(object.Scheme)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp, err := store.do(http.MethodHead, object, nil, nil, nil)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modTime, nil
+}
+
+// objectReader reads an object with ranged GET requests. It implements
+// io.ReaderAt so EPUB archives are read in place, without a local copy; the
+// last blocks fetched are kept since archive entries are read in small chunks.
+type objectReader struct {
+	store  *objectStore
+	object objectURL
+	size   int64
+
+	mutex  sync.Mutex
+	blocks map[int64][]byte
+	order  []int64 // blocks from the least to the most recently fetched
+}
+
+// openObject opens an object for reading and returns its size
+func openObject(rawURL string) (*objectReader, int64, error) {
+	object, _ := parseObjectURL(rawURL)
+	store, err := newObjectStore(object.Scheme)
+	if err != nil {
+		return nil, 0, err
+	}
+	size, _, err := statObject(rawURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &objectReader{store: store, object: object, size: size, blocks: make(map[int64][]byte)}, size, nil
+}
+
+func (r *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		block, err := r.block(off / objectBlockSize)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], block[off%objectBlockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// block returns a block of the object, fetching it when it is not cached
+func (r *objectReader) block(index int64) ([]byte, error) {
+	r.mutex.Lock()
+	if block, ok := r.blocks[index]; ok {
+		r.mutex.Unlock()
+		return block, nil
+	}
+	r.mutex.Unlock()
+
+	start := index * objectBlockSize
+	end := min(start+objectBlockSize, r.size) - 1
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end)}}
+	resp, err := r.store.do(http.MethodGet, r.object, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	block, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(block)) != end-start+1 {
+		return nil, fmt.Errorf("GET %s: short range read of %d bytes", r.object, len(block))
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, ok := r.blocks[index]; !ok {
+		if len(r.order) == objectBlockCount {
+			delete(r.blocks, r.order[0])
+			r.order = r.order[1:]
+		}
+		r.blocks[index] = block
+		r.order = append(r.order, index)
+	}
+	return block, nil
+}
+
+// objectWriter uploads an object while it is written. Small objects are sent
+// with a single PUT when closed, larger ones with a multipart upload; the
+// object only appears once the upload is completed.
+type objectWriter struct {
+	store    *objectStore
+	object   objectURL
+	buffer   bytes.Buffer
+	uploadID string
+	parts    []completedPart
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// createObject starts writing an object
+func createObject(rawURL string) (*objectWriter, error) {
+	object, _ := parseObjectURL(rawURL)
+	store, err := newObjectStore(object.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{store: store, object: object}, nil
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	n, _ := w.buffer.Write(p)
+	for w.buffer.Len() >= objectPartSize {
+		if err := w.uploadPart(w.buffer.Next(objectPartSize)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// uploadPart sends a part, starting the multipart upload on the first one
+func (w *objectWriter) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.store.do(http.MethodPost, w.object, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return fmt.Errorf("error starting upload: %w", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return fmt.Errorf("error starting upload: %w", err)
+		}
+		w.uploadID = result.UploadID
+	}
+
+	number := len(w.parts) + 1
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {w.uploadID}}
+	resp, err := w.store.do(http.MethodPut, w.object, query, nil, data)
+	if err != nil {
+		return fmt.Errorf("error uploading part %d: %w", number, err)
+	}
+	resp.Body.Close()
+	w.parts = append(w.parts, completedPart{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// commit sends the remaining data and makes the object visible
+func (w *objectWriter) commit() error {
+	if w.uploadID == "" {
+		resp, err := w.store.do(http.MethodPut, w.object, nil, nil, w.buffer.Bytes())
+		if err != nil {
+			return fmt.Errorf("error uploading %s: %w", w.object, err)
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if w.buffer.Len() > 0 {
+		if err := w.uploadPart(w.buffer.Bytes()); err != nil {
+			return err
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: w.parts})
+	if err != nil {
+		return err
+	}
+	resp, err := w.store.do(http.MethodPost, w.object, url.Values{"uploadId": {w.uploadID}}, nil, body)
+	if err != nil {
+		return fmt.Errorf("error completing upload of %s: %w", w.object, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// abort cancels a multipart upload, so the parts sent are not billed
+func (w *objectWriter) abort() {
+	if w.uploadID == "" {
+		return
+	}
+	if resp, err := w.store.do(http.MethodDelete, w.object, url.Values{"uploadId": {w.uploadID}}, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,287 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OPDSCatalogName is the feed written at the root of the catalog directory
+const OPDSCatalogName = "catalog.xml"
+
+// MIME types and link relations of the OPDS 1.2 specification
+const (
+	opdsAcquisitionType = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsAcquisitionRel  = "http://opds-spec.org/acquisition"
+	opdsImageRel        = "http://opds-spec.org/image"
+	opdsThumbnailRel    = "http://opds-spec.org/image/thumbnail"
+	cbzMimeType         = "application/vnd.comicbook+zip"
+)
+
+type opdsFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	XmlnsDC string      `xml:"xmlns:dc,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []opdsLink  `xml:"link"`
+	Entries []opdsEntry `xml:"entry"`
+}
+
+type opdsLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type opdsEntry struct {
+	Title      string         `xml:"title"`
+	ID         string         `xml:"id"`
+	Updated    string         `xml:"updated"`
+	Authors    []opdsAuthor   `xml:"author,omitempty"`
+	Publisher  string         `xml:"dc:publisher,omitempty"`
+	Language   string         `xml:"dc:language,omitempty"`
+	Issued     string         `xml:"dc:issued,omitempty"`
+	Categories []opdsCategory `xml:"category,omitempty"`
+	Summary    string         `xml:"summary,omitempty"`
+	Links      []opdsLink     `xml:"link"`
+}
+
+type opdsAuthor struct {
+	Name string `xml:"name"`
+}
+
+type opdsCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+// WriteOPDSCatalog writes the catalog of every CBZ found under dir, and the
+// cover of each book next to it, and returns the number of books listed. The
+// title defaults to the name of the directory. The books that can't be
+// listed are logged to logger, nil for the standard logger.
+func WriteOPDSCatalog(dir string, title string, logger *log.Logger) (int, error) {
+	logger = loggerOrDefault(logger)
+	if title == "" {
+		absDir, err := filepath.Abs(dir)
+		if err != nil {
+			return 0, fmt.Errorf("error resolving catalog directory: %w", err)
+		}
+		title = filepath.Base(absDir)
+	}
+
+	var books []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.EqualFold(filepath.Ext(path), ".cbz") {
+			books = append(books, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error reading catalog directory: %w", err)
+	}
+	sort.Strings(books)
+
+	feed := opdsFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		XmlnsDC: "http://purl.org/dc/terms/",
+		ID:      "urn:epub2cbz:" + shortHash(title),
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []opdsLink{
+			{Rel: "self", Href: OPDSCatalogName, Type: opdsAcquisitionType},
+			{Rel: "start", Href: OPDSCatalogName, Type: opdsAcquisitionType},
+		},
+	}
+	for _, book := range books {
+		entry, err := opdsBookEntry(dir, book, logger)
+		if err != nil {
+			logger.Printf("Error adding %s to the catalog: %v", book, err)
+			continue
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("error marshaling OPDS catalog: %w", err)
+	}
+	catalogPath := filepath.Join(dir, OPDSCatalogName)
+	if err := os.WriteFile(longPath(catalogPath), append([]byte(xml.Header), data...), 0644); err != nil {
+		return 0, fmt.Errorf("error writing OPDS catalog: %w", err)
+	}
+	return len(feed.Entries), nil
+}
+
+// opdsBookEntry describes a CBZ from its ComicInfo.xml and extracts its cover
+func opdsBookEntry(dir string, book string, logger *log.Logger) (opdsEntry, error) {
+	info, err := os.Stat(longPath(book))
+	if err != nil {
+		return opdsEntry{}, err
+	}
+	rel, err := filepath.Rel(dir, book)
+	if err != nil {
+		return opdsEntry{}, err
+	}
+	href := opdsHref(rel)
+
+	zipReader, err := zip.OpenReader(longPath(book))
+	if err != nil {
+		return opdsEntry{}, fmt.Errorf("error opening CBZ file: %w", err)
+	}
+	defer zipReader.Close()
+
+	var comicInfo ComicInfo
+	if f := findZipEntry(zipReader.File, "ComicInfo.xml"); f != nil {
+		if err := readZipXML(f, &comicInfo); err != nil {
+			logger.Printf("Warning: %s: invalid ComicInfo.xml: %v", book, err)
+		}
+	}
+
+	entry := opdsEntry{
+		Title:     firstNonEmpty(comicInfo.Title, comicInfo.Series, strings.TrimSuffix(filepath.Base(book), filepath.Ext(book))),
+		ID:        "urn:epub2cbz:" + shortHash(filepath.ToSlash(rel)),
+		Updated:   info.ModTime().UTC().Format(time.RFC3339),
+		Publisher: comicInfo.Publisher,
+		Language:  comicInfo.LanguageISO,
+		Summary:   comicInfo.Summary,
+		Links:     []opdsLink{{Rel: opdsAcquisitionRel, Href: href, Type: cbzMimeType}},
+	}
+	if comicInfo.Series != "" && comicInfo.Number != "" {
+		entry.Title = fmt.Sprintf("%s #%s", comicInfo.Series, comicInfo.Number)
+		if comicInfo.Title != "" && comicInfo.Title != comicInfo.Series {
+			entry.Title += " - " + comicInfo.Title
+		}
+	}
+	if comicInfo.Year > 0 {
+		entry.Issued = strconv.Itoa(comicInfo.Year)
+	}
+	for _, name := range strings.Split(comicInfo.Writer, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			entry.Authors = append(entry.Authors, opdsAuthor{Name: name})
+		}
+	}
+	for _, genre := range strings.Split(comicInfo.Genre, ",") {
+		if genre = strings.TrimSpace(genre); genre != "" {
+			entry.Categories = append(entry.Categories, opdsCategory{Term: genre, Label: genre})
+		}
+	}
+
+	coverPath, coverType, err := extractCover(zipReader.File, &comicInfo, book)
+	if err != nil {
+		logger.Printf("Warning: %s: %v", book, err)
+	} else if coverPath != "" {
+		coverRel, err := filepath.Rel(dir, coverPath)
+		if err == nil {
+			coverHref := opdsHref(coverRel)
+			entry.Links = append(entry.Links,
+				opdsLink{Rel: opdsImageRel, Href: coverHref, Type: coverType},
+				opdsLink{Rel: opdsThumbnailRel, Href: coverHref, Type: coverType})
+		}
+	}
+	return entry, nil
+}
+
+// extractCover writes the cover of a CBZ next to it, as "<name>.cover.<ext>".
+// The cover is the FrontCover page of ComicInfo.xml, or the first image.
+func extractCover(files []*zip.File, comicInfo *ComicInfo, book string) (string, string, error) {
+	images := archiveImages(files)
+	if len(images) == 0 {
+		return "", "", nil
+	}
+
+	cover := images[0]
+	if comicInfo.Pages != nil {
+		for _, page := range comicInfo.Pages.Page {
+			if page.Type == "FrontCover" && page.Image >= 0 && page.Image < len(images) {
+				cover = images[page.Image]
+				break
+			}
+		}
+	}
+
+	r, err := cover.Open()
+	if err != nil {
+		return "", "", fmt.Errorf("error reading cover: %w", err)
+	}
+	defer r.Close()
+	var data bytes.Buffer
+	if _, err := io.Copy(&data, r); err != nil {
+		return "", "", fmt.Errorf("error reading cover: %w", err)
+	}
+
+	ext := strings.ToLower(path.Ext(cover.Name))
+	coverPath := strings.TrimSuffix(book, filepath.Ext(book)) + ".cover" + ext
+	if err := os.WriteFile(longPath(coverPath), data.Bytes(), 0644); err != nil {
+		return "", "", fmt.Errorf("error writing cover: %w", err)
+	}
+	return coverPath, sniffImageType(data.Bytes()), nil
+}
+
+// archiveImages returns the image entries of a CBZ in page order
+func archiveImages(files []*zip.File) []*zip.File {
+	var images []*zip.File
+	for _, f := range files {
+		ext := strings.ToLower(path.Ext(f.Name))
+		for _, known := range imageExtensions {
+			if ext == known {
+				images = append(images, f)
+				break
+			}
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images
+}
+
+// findZipEntry returns the entry of an archive with a name, ignoring case
+func findZipEntry(files []*zip.File, name string) *zip.File {
+	for _, f := range files {
+		if strings.EqualFold(f.Name, name) {
+			return f
+		}
+	}
+	return nil
+}
+
+// readZipXML decodes an XML entry of an archive
+func readZipXML(f *zip.File, v any) error {
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return xml.NewDecoder(r).Decode(v)
+}
+
+// opdsHref converts a relative file path to a URL path
+func opdsHref(rel string) string {
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// shortHash returns a short stable identifier for a string
+func shortHash(s string) string {
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:8])
+}
@@ -0,0 +1,75 @@
+package epub2cbz
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// comicInfoField returns the index of the ComicInfo field written as an
+// element name, ignoring case, spaces and underscores so "age rating" and
+// "AgeRating" both match. Only text and number fields can be overridden.
+func comicInfoField(name string) (int, bool) {
+	key := strings.ToLower(strings.NewReplacer(" ", "", "_", "", "-", "").Replace(name))
+	t := reflect.TypeOf(ComicInfo{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		switch field.Type.Kind() {
+		case reflect.String, reflect.Int:
+		default:
+			continue
+		}
+		element, _, _ := strings.Cut(field.Tag.Get("xml"), ",")
+		if strings.ToLower(element) == key {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// validateOverrides checks that metadata overrides name known ComicInfo
+// fields and that number fields get numbers
+func validateOverrides(overrides map[string]string) error {
+	for name, value := range overrides {
+		i, ok := comicInfoField(name)
+		if !ok {
+			return fmt.Errorf("unknown ComicInfo field %q", name)
+		}
+		if reflect.TypeOf(ComicInfo{}).Field(i).Type.Kind() == reflect.Int && value != "" {
+			if _, err := strconv.Atoi(value); err != nil {
+				return fmt.Errorf("invalid %s %q: not a number", name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseOverride adds a "Field=value" override, as given on the command line
+func ParseOverride(overrides map[string]string, value string) error {
+	name, v, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected Field=value")
+	}
+	overrides[strings.TrimSpace(name)] = strings.TrimSpace(v)
+	return validateOverrides(overrides)
+}
+
+// applyOverrides replaces ComicInfo fields with the values of the overrides,
+// which were validated before; an empty value clears the field
+func applyOverrides(info *ComicInfo, overrides map[string]string) {
+	v := reflect.ValueOf(info).Elem()
+	for name, value := range overrides {
+		i, ok := comicInfoField(name)
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Int {
+			number, _ := strconv.Atoi(value)
+			field.SetInt(int64(number))
+		} else {
+			field.SetString(value)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PackComic writes the images of a folder to a CBZ in natural order, renamed
+// as by the conversion, with the metadata of its ComicInfo.xml sidecar and
+// the overrides. The CBZ is written to target, or next to the folder when
+// empty. It returns the path of the CBZ and the number of pages written. The
+// warnings are logged to logger, nil for the standard logger.
+func PackComic(source string, target string, overrides map[string]string, logger *log.Logger) (string, int, error) {
+	if err := validateOverrides(overrides); err != nil {
+		return "", 0, err
+	}
+	if target == "" {
+		target = strings.TrimRight(source, `/\`) + ".cbz"
+	}
+	if err := checkOutputPath(target, []string{source}); err != nil {
+		return "", 0, err
+	}
+	count, err := packComic(source, target, overrides, loggerOrDefault(logger))
+	if err != nil {
+		return "", 0, fmt.Errorf("error packing %s: %w", source, err)
+	}
+	return target, count, nil
+}
+
+// packComic writes the images of a folder to a CBZ in natural order, and
+// returns the number of pages written
+func packComic(source string, target string, overrides map[string]string, logger *log.Logger) (int, error) {
+	pages, info, closeComic, err := openComic(source, logger)
+	if err != nil {
+		return 0, err
+	}
+	defer closeComic()
+	if len(pages) == 0 {
+		return 0, fmt.Errorf("no images found")
+	}
+
+	output, err := createOutput(target)
+	if err != nil {
+		return 0, err
+	}
+	completed := false
+	defer func() {
+		if !completed {
+			output.abort()
+		}
+	}()
+	buffer := bufio.NewWriterSize(output, outputBufferSize)
+	zipw := zip.NewWriter(buffer)
+	modTime := time.Now()
+
+	for i, page := range pages {
+		data, err := readComicPage(page)
+		if err != nil {
+			return 0, err
+		}
+		mimeType := sniffImageType(data)
+		header := &zip.FileHeader{
+			Name:     normalizeImageName(imageExtension(mimeType, page.name), i, len(pages)),
+			Method:   imageMethod(CompressionAuto, mimeType, zip.Deflate),
+			Modified: modTime,
+		}
+		w, err := zipw.CreateHeader(header)
+		if err != nil {
+			return 0, fmt.Errorf("error creating %s in ZIP: %w", header.Name, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return 0, fmt.Errorf("error writing %s to ZIP: %w", header.Name, err)
+		}
+	}
+
+	// The metadata of the sidecar and of the command line, when there is any
+	applyOverrides(info, overrides)
+	if *info != (ComicInfo{}) {
+		info.PageCount = len(pages)
+		data, err := xml.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return 0, fmt.Errorf("error marshaling ComicInfo: %w", err)
+		}
+		document := append([]byte(xml.Header), data...)
+		for _, problem := range validateComicInfo(document) {
+			logger.Printf("Warning: %s: invalid ComicInfo.xml: %v", filepath.Base(target), problem)
+		}
+		w, err := zipw.CreateHeader(&zip.FileHeader{Name: "ComicInfo.xml", Method: zip.Deflate, Modified: modTime})
+		if err != nil {
+			return 0, fmt.Errorf("error creating ComicInfo.xml in ZIP: %w", err)
+		}
+		if _, err := w.Write(document); err != nil {
+			return 0, fmt.Errorf("error writing ComicInfo.xml to ZIP: %w", err)
+		}
+	}
+
+	if err := errors.Join(zipw.Close(), buffer.Flush()); err != nil {
+		return 0, fmt.Errorf("error finalizing ZIP file: %w", err)
+	}
+	if err := output.commit(); err != nil {
+		return 0, err
+	}
+	completed = true
+	return len(pages), nil
+}
@@ -0,0 +1,268 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Positions of the title page
+const (
+	TitlePageFirst  = "first"
+	TitlePageSecond = "second"
+)
+
+// validateTitlePage checks the position of the title page given on the command line
+func validateTitlePage(position string) error {
+	switch position {
+	case "", TitlePageFirst, TitlePageSecond:
+		return nil
+	}
+	return fmt.Errorf("invalid title page position %q (expected %s or %s)", position, TitlePageFirst, TitlePageSecond)
+}
+
+// Size of generated pages when the size of the cover is unknown
+const (
+	defaultPageWidth  = 1200
+	defaultPageHeight = 1800
+)
+
+// insertedPages are the generated pages of a book, each inserted before the
+// image of a reference index, in increasing order. Their slots are reserved
+// in the page names before the images are written, since pages like the
+// contents are only rendered once every chapter is known.
+type insertedPages []int
+
+// nameIndex returns the index naming the image of a reference, shifted by
+// the pages inserted before it
+func (p insertedPages) nameIndex(ref int) int {
+	index := ref
+	for _, slot := range p {
+		if slot <= ref {
+			index++
+		}
+	}
+	return index
+}
+
+// pageIndex returns the index naming the i-th inserted page
+func (p insertedPages) pageIndex(i int) int {
+	return p[i] + i
+}
+
+// writeGeneratedPage writes a rendered PNG page in the archive
+func writeGeneratedPage(zipw *zip.Writer, name string, data []byte, modTime time.Time) error {
+	w, err := zipw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime})
+	if err != nil {
+		return fmt.Errorf("error creating %s in ZIP: %w", name, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("error writing %s to ZIP: %w", name, err)
+	}
+	return nil
+}
+
+// firstImage returns the first image referenced by the pages
+func firstImage(firstImages []string) string {
+	for _, image := range firstImages {
+		if image != "" {
+			return image
+		}
+	}
+	return ""
+}
+
+// coverSize returns the size of the first image of a book, to render the
+// generated pages at the same size
+func coverSize(index archiveIndex, firstImage string) (int, int) {
+	if f, ok := index.lookup(firstImage); ok {
+		if r, err := f.Open(); err == nil {
+			defer r.Close()
+			if config, _, err := image.DecodeConfig(r); err == nil && config.Width > 0 && config.Height > 0 {
+				return config.Width, config.Height
+			}
+		}
+	}
+	return defaultPageWidth, defaultPageHeight
+}
+
+// pageRenderer draws text on a white page with the Go font, which covers
+// Latin, Greek and Cyrillic scripts
+type pageRenderer struct {
+	img    *image.Gray
+	margin int
+	font   *opentype.Font
+}
+
+func newPageRenderer(width int, height int) (*pageRenderer, error) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("error loading font: %w", err)
+	}
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	return &pageRenderer{img: img, margin: width / 12, font: f}, nil
+}
+
+// face returns the font at a size in pixels
+func (r *pageRenderer) face(size float64) (font.Face, error) {
+	return opentype.NewFace(r.font, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// draw writes text with its baseline at y, aligned left at x, shortened with
+// an ellipsis to fit in maxWidth
+func (r *pageRenderer) draw(face font.Face, text string, x int, y int, maxWidth int) int {
+	drawer := &font.Drawer{Dst: r.img, Src: image.NewUniform(color.Black), Face: face}
+	text = fitText(drawer, text, maxWidth)
+	drawer.Dot = fixed.P(x, y)
+	drawer.DrawString(text)
+	return drawer.MeasureString(text).Ceil()
+}
+
+// measure returns the width of a text in pixels
+func (r *pageRenderer) measure(face font.Face, text string) int {
+	return font.MeasureString(face, text).Ceil()
+}
+
+// encode returns the page as a PNG, which keeps text sharp
+func (r *pageRenderer) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, r.img); err != nil {
+		return nil, fmt.Errorf("error encoding page: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// fitText shortens a text with an ellipsis until it fits in maxWidth
+func fitText(drawer *font.Drawer, text string, maxWidth int) string {
+	if drawer.MeasureString(text).Ceil() <= maxWidth {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		if shortened := string(runes) + "…"; drawer.MeasureString(shortened).Ceil() <= maxWidth {
+			return shortened
+		}
+	}
+	return ""
+}
+
+// renderContentsPage renders the table of contents of a book: the title of
+// each chapter with the number of its first page, shrunk to fit the page
+func renderContentsPage(chapters []chapter, pageNumbers []int, width int, height int) ([]byte, error) {
+	r, err := newPageRenderer(width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	titleSize := float64(width) / 14
+	titleFace, err := r.face(titleSize)
+	if err != nil {
+		return nil, err
+	}
+	defer titleFace.Close()
+	y := r.margin + int(titleSize)
+	r.draw(titleFace, "Contents", r.margin, y, width-2*r.margin)
+	y += int(titleSize)
+
+	// Lines are spaced by 1.6 times the font size
+	lineSize := min(float64(width)/28, float64(height-y-r.margin)/(1.6*float64(len(chapters))))
+	lineSize = max(lineSize, 8)
+	lineFace, err := r.face(lineSize)
+	if err != nil {
+		return nil, err
+	}
+	defer lineFace.Close()
+	lineHeight := int(lineSize * 1.6)
+
+	for i, c := range chapters {
+		y += lineHeight
+		if y > height-r.margin {
+			break
+		}
+		number := strconv.Itoa(pageNumbers[i])
+		numberWidth := r.measure(lineFace, number)
+		r.draw(lineFace, number, width-r.margin-numberWidth, y, numberWidth)
+		r.draw(lineFace, c.Title, r.margin, y, width-2*r.margin-numberWidth-int(lineSize))
+	}
+	return r.encode()
+}
+
+// renderTitlePage renders a title card from the metadata of a book: series,
+// volume and number, title, authors, then publisher and year at the bottom
+func renderTitlePage(info *ComicInfo, width int, height int) ([]byte, error) {
+	r, err := newPageRenderer(width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	heading := firstNonEmpty(info.Series, info.Title)
+	var issue []string
+	if info.Volume > 0 {
+		issue = append(issue, fmt.Sprintf("Volume %d", info.Volume))
+	}
+	if number := strings.TrimSpace(info.Number); number != "" && info.Series != "" {
+		issue = append(issue, "#"+number)
+	}
+	subtitle := ""
+	if info.Series != "" && info.Title != "" && info.Title != info.Series {
+		subtitle = info.Title
+	}
+	var authors []string
+	for _, credit := range []string{info.Writer, info.Penciller} {
+		for _, name := range strings.Split(credit, ",") {
+			if name = strings.TrimSpace(name); name != "" && !slices.Contains(authors, name) {
+				authors = append(authors, name)
+			}
+		}
+	}
+	var imprint []string
+	if info.Publisher != "" {
+		imprint = append(imprint, info.Publisher)
+	}
+	if info.Year > 0 {
+		imprint = append(imprint, strconv.Itoa(info.Year))
+	}
+
+	// Lines are centered, the heading a third down the page
+	lines := []struct {
+		text string
+		size float64
+		y    int
+	}{
+		{heading, float64(width) / 12, height / 3},
+		{strings.Join(issue, " "), float64(width) / 20, height/3 + width/9},
+		{subtitle, float64(width) / 22, height/3 + width/5},
+		{strings.Join(authors, ", "), float64(width) / 24, height * 3 / 5},
+		{strings.Join(imprint, " · "), float64(width) / 30, height - r.margin},
+	}
+	for _, line := range lines {
+		if line.text == "" {
+			continue
+		}
+		face, err := r.face(line.size)
+		if err != nil {
+			return nil, err
+		}
+		maxWidth := width - 2*r.margin
+		x := r.margin + max(0, (maxWidth-r.measure(face, line.text))/2)
+		r.draw(face, line.text, x, line.y, maxWidth)
+		face.Close()
+	}
+	return r.encode()
+}
@@ -0,0 +1,301 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/webp"
+)
+
+// pdfWriter writes a PDF with one image per page, sized to the image. JPEG
+// images are embedded as they are, other formats are decoded and deflated
+// without loss.
+type pdfWriter struct {
+	w       *countingWriter
+	offsets map[int]int64 // byte offset of each object
+	next    int           // number of the next object
+	pages   []int         // page objects, in order
+}
+
+// Objects written last but referenced by every page
+const (
+	pdfCatalogObject = 1
+	pdfPagesObject   = 2
+	pdfInfoObject    = 3
+)
+
+func newPDFWriter(w io.Writer) (*pdfWriter, error) {
+	p := &pdfWriter{w: &countingWriter{w: w}, offsets: make(map[int]int64), next: 4}
+	// The binary comment marks the file as binary for transfer tools
+	if _, err := io.WriteString(p.w, "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// object writes an object with an optional stream
+func (p *pdfWriter) object(number int, dict string, stream []byte) error {
+	p.offsets[number] = p.w.n
+	if stream == nil {
+		_, err := fmt.Fprintf(p.w, "%d 0 obj\n%s\nendobj\n", number, dict)
+		return err
+	}
+	if _, err := fmt.Fprintf(p.w, "%d 0 obj\n%s\nstream\n", number, dict); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(stream); err != nil {
+		return err
+	}
+	_, err := io.WriteString(p.w, "\nendstream\nendobj\n")
+	return err
+}
+
+// addImage adds a page showing an image
+func (p *pdfWriter) addImage(data []byte) error {
+	dict, stream, width, height, err := pdfImage(data)
+	if err != nil {
+		return err
+	}
+
+	imageObject, contentObject, pageObject := p.next, p.next+1, p.next+2
+	p.next += 3
+	if err := p.object(imageObject, dict, stream); err != nil {
+		return err
+	}
+	content := fmt.Sprintf("q %d 0 0 %d 0 0 cm /Im0 Do Q", width, height)
+	if err := p.object(contentObject, fmt.Sprintf("<< /Length %d >>", len(content)), []byte(content)); err != nil {
+		return err
+	}
+	page := fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %d %d] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		pdfPagesObject, width, height, imageObject, contentObject)
+	if err := p.object(pageObject, page, nil); err != nil {
+		return err
+	}
+	p.pages = append(p.pages, pageObject)
+	return nil
+}
+
+// close writes the page tree, the document information and the cross-reference table
+func (p *pdfWriter) close(title string, author string) error {
+	if len(p.pages) == 0 {
+		return fmt.Errorf("error writing PDF: no pages")
+	}
+	kids := make([]string, len(p.pages))
+	for i, page := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", page)
+	}
+	if err := p.object(pdfPagesObject, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)), nil); err != nil {
+		return err
+	}
+	if err := p.object(pdfCatalogObject, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pdfPagesObject), nil); err != nil {
+		return err
+	}
+	info := "<< /Producer " + pdfString("epub2cbz "+Version())
+	if title != "" {
+		info += " /Title " + pdfString(title)
+	}
+	if author != "" {
+		info += " /Author " + pdfString(author)
+	}
+	if err := p.object(pdfInfoObject, info+" >>", nil); err != nil {
+		return err
+	}
+
+	xref := p.w.n
+	if _, err := fmt.Fprintf(p.w, "xref\n0 %d\n0000000000 65535 f \n", p.next); err != nil {
+		return err
+	}
+	for number := 1; number < p.next; number++ {
+		if _, err := fmt.Fprintf(p.w, "%010d 00000 n \n", p.offsets[number]); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(p.w, "trailer\n<< /Size %d /Root %d 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		p.next, pdfCatalogObject, pdfInfoObject, xref)
+	return err
+}
+
+// writePDF writes the pages of a converted CBZ to w as a PDF, one page per
+// image, converted by transform unless it is nil
+func writePDF(cbzPath string, w io.Writer, info *ComicInfo, transform func([]byte) ([]byte, error)) error {
+	zipReader, err := zip.OpenReader(longPath(cbzPath))
+	if err != nil {
+		return fmt.Errorf("error opening CBZ file: %w", err)
+	}
+	defer zipReader.Close()
+
+	pdf, err := newPDFWriter(w)
+	if err != nil {
+		return err
+	}
+	for _, f := range archiveImages(zipReader.File) {
+		r, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", f.Name, err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", f.Name, err)
+		}
+		if transform != nil {
+			if data, err = transform(data); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+		if err := pdf.addImage(data); err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	author := ""
+	if info != nil {
+		author = info.Writer
+	}
+	return pdf.close(pdfTitle(cbzPath, info), author)
+}
+
+// savePDF writes the pages of a converted CBZ as a PDF next to it, with the
+// same name, and returns the path of the PDF
+func savePDF(cbzPath string, info *ComicInfo) (string, error) {
+	pdfPath := strings.TrimSuffix(cbzPath, filepath.Ext(cbzPath)) + ".pdf"
+	output, err := createOutput(pdfPath)
+	if err != nil {
+		return "", err
+	}
+	buffer := bufio.NewWriterSize(output, outputBufferSize)
+	if err := writePDF(cbzPath, buffer, info, nil); err != nil {
+		output.abort()
+		return "", fmt.Errorf("error writing PDF: %w", err)
+	}
+	if err := buffer.Flush(); err != nil {
+		output.abort()
+		return "", fmt.Errorf("error writing PDF: %w", err)
+	}
+	if err := output.commit(); err != nil {
+		return "", err
+	}
+	return pdfPath, nil
+}
+
+// pdfTitle returns the title of the PDF of a book, its file name without metadata
+func pdfTitle(cbzPath string, info *ComicInfo) string {
+	baseName := strings.TrimSuffix(filepath.Base(cbzPath), filepath.Ext(cbzPath))
+	if info == nil {
+		return baseName
+	}
+	return firstNonEmpty(info.Title, info.Series, baseName)
+}
+
+// pdfImage returns the XObject dictionary and stream of an image, with its size
+func pdfImage(data []byte) (string, []byte, int, int, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, 0, 0, fmt.Errorf("error reading image: %w", err)
+	}
+
+	if format == "jpeg" {
+		colorSpace, decode := "/DeviceRGB", ""
+		switch config.ColorModel {
+		case color.GrayModel:
+			colorSpace = "/DeviceGray"
+		case color.CMYKModel:
+			// Adobe CMYK JPEGs are stored inverted
+			colorSpace, decode = "/DeviceCMYK", " /Decode [1 0 1 0 1 0 1 0]"
+		}
+		dict := fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8%s /Filter /DCTDecode /Length %d >>",
+			config.Width, config.Height, colorSpace, decode, len(data))
+		return dict, data, config.Width, config.Height, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, 0, 0, fmt.Errorf("error decoding image: %w", err)
+	}
+	bounds := img.Bounds()
+	gray := isGrayImage(img)
+	var pixels bytes.Buffer
+	zw := zlib.NewWriter(&pixels)
+	row := make([]byte, 0, bounds.Dx()*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Transparent pixels are shown over white, like readers display pages
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			r, g, b := blendWhite(c.R, c.A), blendWhite(c.G, c.A), blendWhite(c.B, c.A)
+			if gray {
+				row = append(row, r)
+			} else {
+				row = append(row, r, g, b)
+			}
+		}
+		zw.Write(row)
+	}
+	if err := zw.Close(); err != nil {
+		return "", nil, 0, 0, err
+	}
+	colorSpace := "/DeviceRGB"
+	if gray {
+		colorSpace = "/DeviceGray"
+	}
+	dict := fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /FlateDecode /Length %d >>",
+		bounds.Dx(), bounds.Dy(), colorSpace, pixels.Len())
+	return dict, pixels.Bytes(), bounds.Dx(), bounds.Dy(), nil
+}
+
+// isGrayImage reports whether an image only has gray pixels, which is the
+// case of most manga pages even when stored as RGB
+func isGrayImage(img image.Image) bool {
+	switch img.ColorModel() {
+	case color.GrayModel, color.Gray16Model:
+		return true
+	}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.R != c.G || c.G != c.B {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// blendWhite composes a color channel with its alpha over a white background
+func blendWhite(v uint8, alpha uint8) uint8 {
+	return uint8((int(v)*int(alpha) + 255*(255-int(alpha))) / 255)
+}
+
+// pdfString encodes a text string, as UTF-16 when it is not plain ASCII
+func pdfString(s string) string {
+	ascii := true
+	for _, r := range s {
+		if r > 126 || r < 32 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return "(" + strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`).Replace(s) + ")"
+	}
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", unit)
+	}
+	b.WriteString(">")
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package epub2cbz
+
+import "runtime"
+
+// orderedStage is a pipeline stage applying process to every item received
+// from in, using at most workers goroutines. Results are sent to the returned
+// channel in input order, which is closed once in is closed and drained.
+// At most workers results are pending at any time, which bounds the memory
+// held by results waiting for an earlier, slower one.
+func orderedStage[T, R any](in <-chan T, workers int, process func(int, T) R) <-chan R {
+	if workers < 1 {
+		workers = 1
+	}
+
+	pending := make(chan chan R, workers)
+	go func() {
+		i := 0
+		for item := range in {
+			result := make(chan R, 1)
+			pending <- result
+			go func(i int, item T) {
+				result <- process(i, item)
+			}(i, item)
+			i++
+		}
+		close(pending)
+	}()
+
+	out := make(chan R)
+	go func() {
+		for result := range pending {
+			out <- <-result
+		}
+		close(out)
+	}()
+	return out
+}
+
+// sliceSource returns a channel producing the items of a slice
+func sliceSource[T any](items []T) <-chan T {
+	out := make(chan T)
+	go func() {
+		for _, item := range items {
+			out <- item
+		}
+		close(out)
+	}()
+	return out
+}
+
+// unboundedQueue forwards the items of in to the returned channel, queuing
+// them in memory so the producer never waits for the consumer. It is meant
+// for small items like image references.
+func unboundedQueue[T any](in <-chan T) <-chan T {
+	out := make(chan T)
+	go func() {
+		var queue []T
+		for in != nil || len(queue) > 0 {
+			// Only offer an item when one is queued
+			var send chan T
+			var next T
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+			select {
+			case item, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				queue = append(queue, item)
+			case send <- next:
+				queue = queue[1:]
+			}
+		}
+		close(out)
+	}()
+	return out
+}
+
+// pageWorkers returns the number of workers used inside a single conversion.
+// When unset it shares the CPUs between the files converted in parallel.
+func pageWorkers(opts Options, batch bool) int {
+	if opts.PageJobs > 0 {
+		return opts.PageJobs
+	}
+	if batch && opts.Jobs > 0 {
+		return max(1, runtime.NumCPU()/opts.Jobs)
+	}
+	return runtime.NumCPU()
+}
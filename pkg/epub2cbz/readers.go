@@ -0,0 +1,135 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+// readerCache limits the number of EPUB archives open at the same time,
+// independently of the number of workers, since every open archive holds a
+// file descriptor and pressures the page cache of NAS boxes. Released
+// readers stay open in LRU order so a file touched again (memory estimation
+// then conversion, or a watched file modified again) is not reopened.
+type readerCache struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	limit int        // maximum number of open readers
+	open  int        // readers in use or idle
+	idle  *list.List // idle readers, least recently used first
+}
+
+// cachedReader is an open EPUB with the state of the file it was opened from
+type cachedReader struct {
+	path    string
+	size    int64
+	modTime time.Time
+	reader  *zip.ReadCloser
+}
+
+// newReaderCache creates a cache keeping at most limit archives open
+func newReaderCache(limit int) *readerCache {
+	cache := &readerCache{limit: max(1, limit), idle: list.New()}
+	cache.cond = sync.NewCond(&cache.mutex)
+	return cache
+}
+
+// acquire returns an open reader for path, reusing an idle one when the file
+// did not change. The reader is used exclusively until released.
+func (c *readerCache) acquire(path string) (*cachedReader, error) {
+	info, err := os.Stat(longPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	for e := c.idle.Front(); e != nil; e = e.Next() {
+		cached := e.Value.(*cachedReader)
+		if cached.path != path {
+			continue
+		}
+		c.idle.Remove(e)
+		if cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+			c.mutex.Unlock()
+			return cached, nil
+		}
+		// The file changed since it was opened
+		cached.reader.Close()
+		c.open--
+		break
+	}
+
+	for c.open >= c.limit {
+		if e := c.idle.Front(); e != nil {
+			// Evict the least recently used idle reader
+			c.idle.Remove(e).(*cachedReader).reader.Close()
+			c.open--
+			continue
+		}
+		c.cond.Wait()
+	}
+	c.open++
+	c.mutex.Unlock()
+
+	reader, err := zip.OpenReader(longPath(path))
+	if err != nil {
+		c.mutex.Lock()
+		c.open--
+		c.mutex.Unlock()
+		c.cond.Signal()
+		return nil, err
+	}
+	return &cachedReader{path: path, size: info.Size(), modTime: info.ModTime(), reader: reader}, nil
+}
+
+// release makes a reader available again
+func (c *readerCache) release(cached *cachedReader) {
+	c.mutex.Lock()
+	c.idle.PushBack(cached)
+	c.mutex.Unlock()
+	c.cond.Signal()
+}
+
+// close closes every idle reader
+func (c *readerCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for e := c.idle.Front(); e != nil; e = e.Next() {
+		e.Value.(*cachedReader).reader.Close()
+		c.open--
+	}
+	c.idle.Init()
+}
+
+// openEPUB opens an EPUB through the cache of the options when there is one.
+// The returned function must be called once the archive is no longer used.
+func openEPUB(epubPath string, opts Options) (*zip.Reader, func(), error) {
+	if isObjectURL(epubPath) {
+		// Objects are read in place with ranged requests
+		object, size, err := openObject(epubPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		reader, err := zip.NewReader(object, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() {}, nil
+	}
+
+	if opts.readers == nil {
+		reader, err := zip.OpenReader(longPath(epubPath))
+		if err != nil {
+			return nil, nil, err
+		}
+		return &reader.Reader, func() { reader.Close() }, nil
+	}
+
+	cached, err := opts.readers.acquire(epubPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &cached.reader.Reader, func() { opts.readers.release(cached) }, nil
+}
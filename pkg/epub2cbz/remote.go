@@ -0,0 +1,242 @@
+package epub2cbz
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// remoteTimeout bounds a request to a remote output. Uploads are streamed
+// while the book is converted, so it is far longer than for notifications
+const remoteTimeout = 30 * time.Minute
+
+// IsRemoteURL reports whether an output path designates a remote target:
+// an object storage URL, a WebDAV share or an SFTP server
+func IsRemoteURL(s string) bool {
+	if isObjectURL(s) {
+		return true
+	}
+	for _, scheme := range []string{"webdav://", "webdavs://", "sftp://"} {
+		if strings.HasPrefix(s, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// createRemoteOutput starts writing a remote output
+func createRemoteOutput(outputPath string) (outputFile, error) {
+	if isObjectURL(outputPath) {
+		return createObject(outputPath)
+	}
+	u, err := url.Parse(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output URL %s: %w", outputPath, err)
+	}
+	if u.Scheme == "sftp" {
+		return createSFTPOutput(u)
+	}
+	return createWebDAVOutput(u)
+}
+
+// joinRemotePath joins path elements to a remote URL
+func joinRemotePath(prefix string, elem ...string) string {
+	key := path.Join(elem...)
+	if key == "." {
+		key = ""
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + key
+}
+
+// remoteOutputPath names the CBZ of an EPUB in a remote directory ending
+// with a slash, e.g. s3://bucket/comics/
+func remoteOutputPath(prefix string, epubPath string, opts Options) string {
+	base := path.Base(strings.ReplaceAll(epubPath, `\`, "/"))
+	base = strings.TrimSuffix(base, path.Ext(base))
+	return prefix + sanitizeFileName(base, opts.Sanitize) + ".cbz"
+}
+
+// webdavOutput streams a CBZ to a WebDAV share with a PUT of a .part file,
+// moved to its final name on commit
+type webdavOutput struct {
+	client   *http.Client
+	user     string
+	password string
+	target   *url.URL
+	part     *url.URL
+	pipe     *io.PipeWriter
+	done     chan struct{} // closed once the PUT request returned
+	err      error         // result of the PUT request
+}
+
+// createWebDAVOutput creates the collections of an output and starts its
+// upload. webdav:// is sent over HTTP and webdavs:// over HTTPS. The user
+// comes from the URL or WEBDAV_USER, the password from WEBDAV_PASSWORD only,
+// since output paths are printed.
+func createWebDAVOutput(u *url.URL) (outputFile, error) {
+	target := *u
+	target.Scheme = strings.Replace(u.Scheme, "webdav", "http", 1)
+	target.User = nil
+	w := &webdavOutput{
+		client:   &http.Client{Timeout: remoteTimeout},
+		user:     os.Getenv("WEBDAV_USER"),
+		password: os.Getenv("WEBDAV_PASSWORD"),
+		target:   &target,
+		done:     make(chan struct{}),
+	}
+	if u.User != nil {
+		w.user = u.User.Username()
+	}
+	part := target
+	part.Path += ".part"
+	w.part = &part
+
+	// Create the missing collections, from the root of the share
+	collection := target
+	segments := strings.Split(strings.Trim(path.Dir(target.Path), "/"), "/")
+	collection.Path = ""
+	for _, segment := range segments {
+		if segment == "" {
+			continue
+		}
+		collection.Path += "/" + segment + "/"
+		resp, err := w.request("MKCOL", &collection, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating WebDAV collection: %w", err)
+		}
+		resp.Body.Close()
+		// 405 reports a collection that already exists
+		if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusMethodNotAllowed {
+			return nil, fmt.Errorf("error creating WebDAV collection %s: %s", collection.Path, resp.Status)
+		}
+	}
+
+	reader, writer := io.Pipe()
+	w.pipe = writer
+	go func() {
+		resp, err := w.request(http.MethodPut, w.part, reader, nil)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("PUT %s: %s", w.part.Path, resp.Status)
+			}
+		}
+		reader.CloseWithError(err)
+		w.err = err
+		close(w.done)
+	}()
+	return w, nil
+}
+
+// request sends an authenticated WebDAV request
+func (w *webdavOutput) request(method string, u *url.URL, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if w.user != "" {
+		req.SetBasicAuth(w.user, w.password)
+	}
+	return w.client.Do(req)
+}
+
+func (w *webdavOutput) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
+}
+
+func (w *webdavOutput) commit() error {
+	w.pipe.Close()
+	<-w.done
+	if w.err != nil {
+		return fmt.Errorf("error uploading ZIP file: %w", w.err)
+	}
+	header := http.Header{"Destination": {w.target.String()}, "Overwrite": {"T"}}
+	resp, err := w.request("MOVE", w.part, nil, header)
+	if err != nil {
+		return fmt.Errorf("error moving ZIP file into place: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error moving ZIP file into place: MOVE %s: %s", w.part.Path, resp.Status)
+	}
+	return nil
+}
+
+func (w *webdavOutput) abort() {
+	w.pipe.CloseWithError(fmt.Errorf("conversion aborted"))
+	<-w.done
+	if resp, err := w.request(http.MethodDelete, w.part, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// sftpOutput stages a CBZ in a temporary file sent with the sftp command on
+// commit, so the keys, agents and host configuration of OpenSSH apply
+type sftpOutput struct {
+	*os.File
+	target *url.URL
+}
+
+func createSFTPOutput(u *url.URL) (outputFile, error) {
+	f, err := os.CreateTemp("", "epub2cbz-*.cbz")
+	if err != nil {
+		return nil, fmt.Errorf("error creating ZIP file: %w", err)
+	}
+	return &sftpOutput{File: f, target: u}, nil
+}
+
+func (s *sftpOutput) commit() error {
+	defer os.Remove(s.Name())
+	if err := s.Close(); err != nil {
+		return fmt.Errorf("error closing ZIP file: %w", err)
+	}
+
+	// Commands prefixed with "-" may fail: existing directories and outputs
+	remotePath := s.target.Path
+	var batch strings.Builder
+	dir := ""
+	for _, segment := range strings.Split(strings.Trim(path.Dir(remotePath), "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		dir += "/" + segment
+		fmt.Fprintf(&batch, "-mkdir %s\n", sftpQuote(dir))
+	}
+	fmt.Fprintf(&batch, "put %s %s\n", sftpQuote(s.Name()), sftpQuote(remotePath+".part"))
+	fmt.Fprintf(&batch, "-rm %s\n", sftpQuote(remotePath))
+	fmt.Fprintf(&batch, "rename %s %s\n", sftpQuote(remotePath+".part"), sftpQuote(remotePath))
+
+	host := s.target.Hostname()
+	if s.target.User != nil {
+		host = s.target.User.Username() + "@" + host
+	}
+	args := []string{"-q", "-b", "-"}
+	if port := s.target.Port(); port != "" {
+		args = append(args, "-P", port)
+	}
+	cmd := exec.Command("sftp", append(args, host)...)
+	cmd.Stdin = strings.NewReader(batch.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error uploading ZIP file with sftp: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (s *sftpOutput) abort() {
+	s.Close()
+	os.Remove(s.Name())
+}
+
+// sftpQuote quotes a path for an sftp batch file
+func sftpQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
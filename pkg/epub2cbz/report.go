@@ -0,0 +1,167 @@
+package epub2cbz
+
+import (
+	"encoding/csv"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// reportHeader are the columns of the CSV report
+var reportHeader = []string{
+	"source", "output", "status", "error", "epub_bytes", "cbz_bytes", "size_ratio",
+	"spine_pages", "images", "image_bytes", "image_formats", "processing",
+}
+
+// batchReport writes one CSV row per converted file, flushed as soon as the
+// file is done so a report of an interrupted run is still usable, and an
+// aggregate row once the run ends
+type batchReport struct {
+	mutex  sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+	total  reportTotals
+}
+
+// reportTotals sums the rows of the converted files
+type reportTotals struct {
+	files      int
+	epubBytes  int64
+	cbzBytes   int64
+	pages      int
+	images     int
+	imageBytes int64
+	formats    map[string]int
+}
+
+// newBatchReport creates the report file and writes its header
+func newBatchReport(path string) (*batchReport, error) {
+	f, err := os.Create(longPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("error creating report: %w", err)
+	}
+	r := &batchReport{file: f, writer: csv.NewWriter(f), total: reportTotals{formats: make(map[string]int)}}
+	r.writer.Write(reportHeader)
+	r.writer.Flush()
+	return r, r.writer.Error()
+}
+
+// fileDone writes the row of a file, whatever the outcome of its conversion
+func (r *batchReport) fileDone(epubPath string, outputPath string, stats *conversionStats, opts Options, err error) {
+	status, message := StatusConverted, ""
+	switch {
+	case IsSkipped(err):
+		status, message = StatusSkipped, err.Error()
+	case err != nil:
+		status, message = StatusFailed, err.Error()
+	}
+	var epubBytes int64
+	if info, err := os.Stat(longPath(epubPath)); err == nil {
+		epubBytes = info.Size()
+	}
+	row := []string{epubPath, outputPath, status, message, strconv.FormatInt(epubBytes, 10), "", "", "", "", "", "", processingSummary(opts)}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if status == StatusConverted && stats != nil {
+		row[5] = strconv.FormatInt(stats.OutputBytes, 10)
+		row[6] = sizeRatio(stats.OutputBytes, epubBytes)
+		row[7] = strconv.Itoa(stats.Pages)
+		row[8] = strconv.Itoa(stats.Images)
+		row[9] = strconv.FormatInt(stats.ImageBytes, 10)
+		row[10] = formatCounts(stats.Formats)
+		r.total.files++
+		r.total.epubBytes += epubBytes
+		r.total.cbzBytes += stats.OutputBytes
+		r.total.pages += stats.Pages
+		r.total.images += stats.Images
+		r.total.imageBytes += stats.ImageBytes
+		for ext, count := range stats.Formats {
+			r.total.formats[ext] += count
+		}
+	}
+	r.writer.Write(row)
+	r.writer.Flush()
+}
+
+// close writes the aggregate row of the converted files and closes the report
+func (r *batchReport) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	t := r.total
+	r.writer.Write([]string{
+		"TOTAL", "", fmt.Sprintf("%d converted", t.files), "",
+		strconv.FormatInt(t.epubBytes, 10), strconv.FormatInt(t.cbzBytes, 10), sizeRatio(t.cbzBytes, t.epubBytes),
+		strconv.Itoa(t.pages), strconv.Itoa(t.images), strconv.FormatInt(t.imageBytes, 10), formatCounts(t.formats), "",
+	})
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		r.file.Close()
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
+
+// sizeRatio returns the size of the CBZ relative to the EPUB
+func sizeRatio(cbzBytes int64, epubBytes int64) string {
+	if epubBytes == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(float64(cbzBytes)/float64(epubBytes), 'f', 3, 64)
+}
+
+// formatCounts lists the number of images of each format, like "jpg:120 png:3"
+func formatCounts(formats map[string]int) string {
+	var counts []string
+	for _, ext := range slices.Sorted(maps.Keys(formats)) {
+		counts = append(counts, fmt.Sprintf("%s:%d", strings.TrimPrefix(ext, "."), formats[ext]))
+	}
+	return strings.Join(counts, " ")
+}
+
+// processingSummary lists the options that changed the output of a book
+func processingSummary(opts Options) string {
+	steps := []string{"compression=" + opts.Compression}
+	flags := []struct {
+		set  bool
+		name string
+	}{
+		{opts.Reverse, "reverse"},
+		{opts.NoCover, "no-cover"},
+		{opts.StripBackmatter, "strip-backmatter"},
+		{opts.Watermark != "", "watermark=" + opts.WatermarkStyle},
+		{opts.TitlePage != "", "title-page=" + opts.TitlePage},
+		{opts.TOCPage, "toc-page"},
+		{opts.SplitSpreads, "split-spreads=" + opts.SplitOrder},
+		{opts.SplitChapters, "split-chapters"},
+		{opts.SplitVolumes, "split-volumes"},
+		{opts.KeepStructure, "keep-structure"},
+		{opts.PageOffset != 0, "page-offset=" + strconv.Itoa(opts.PageOffset)},
+		{opts.VerifySource, "verify-source"},
+		{opts.Format != "", "format=" + opts.Format},
+		{opts.PDF, "pdf"},
+		{opts.PDFOnly, "pdf-only"},
+		{opts.ExtractDir, "extract-dir"},
+		{opts.ComicTagger, "comictagger"},
+		{opts.ComicBookInfo, "cbi"},
+		{opts.Metadata != "" && opts.Metadata != MetadataComicInfo, "metadata=" + opts.Metadata},
+		{opts.Calibre != "", "calibre-metadata"},
+		{len(opts.Overrides) > 0, "overrides"},
+		{opts.ParseFilename != "", "parse-filename"},
+		{opts.ComicVineKey != "", "comicvine"},
+		{opts.MangaMetadata != "", "manga-metadata=" + opts.MangaMetadata},
+	}
+	for _, flag := range flags {
+		if flag.set {
+			steps = append(steps, flag.name)
+		}
+	}
+	return strings.Join(steps, " ")
+}
@@ -0,0 +1,71 @@
+package epub2cbz
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sanitize policies for output file names
+const (
+	SanitizeNone    = "none"    // keep names as they are
+	SanitizeReplace = "replace" // replace invalid characters with an underscore
+	SanitizeStrip   = "strip"   // remove invalid characters
+)
+
+// invalidNameChars are characters rejected by Windows and SMB shares
+const invalidNameChars = `<>:"/\|?*`
+
+// reservedNames are device names that cannot be used as file names on Windows,
+// with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// validateSanitizePolicy checks that a policy given on the command line is known
+func validateSanitizePolicy(policy string) error {
+	switch policy {
+	case SanitizeNone, SanitizeReplace, SanitizeStrip:
+		return nil
+	}
+	return fmt.Errorf("invalid sanitize policy %q (expected %s, %s or %s)", policy, SanitizeNone, SanitizeReplace, SanitizeStrip)
+}
+
+// sanitizeFileName makes a single path component safe to create on Windows,
+// SMB shares and Unix filesystems according to the given policy
+func sanitizeFileName(name string, policy string) string {
+	if policy == SanitizeNone || policy == "" {
+		return name
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r == 0x7F || strings.ContainsRune(invalidNameChars, r) {
+			if policy == SanitizeReplace {
+				b.WriteByte('_')
+			}
+			continue
+		}
+		b.WriteRune(r)
+	}
+	name = b.String()
+
+	// Windows silently drops trailing dots and spaces, which breaks lookups
+	name = strings.TrimRight(name, ". ")
+	if name == "" {
+		return "_"
+	}
+
+	// Device names are reserved regardless of the extension
+	stem, ext, _ := strings.Cut(name, ".")
+	if reservedNames[strings.ToUpper(strings.TrimRight(stem, " "))] {
+		name = stem + "_"
+		if ext != "" {
+			name += "." + ext
+		}
+	}
+	return name
+}
@@ -0,0 +1,326 @@
+package epub2cbz
+
+import (
+	_ "embed"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// comicInfoXSD is the ComicInfo schema the generated ComicInfo.xml must follow
+//
+//go:embed schema/ComicInfo.xsd
+var comicInfoXSD []byte
+
+// xsdSchema is the subset of XML Schema used by the ComicInfo XSD
+type xsdSchema struct {
+	Elements     []xsdElement     `xml:"element"`
+	ComplexTypes []xsdComplexType `xml:"complexType"`
+	SimpleTypes  []xsdSimpleType  `xml:"simpleType"`
+}
+
+type xsdElement struct {
+	Name       string         `xml:"name,attr"`
+	Type       string         `xml:"type,attr"`
+	MinOccurs  string         `xml:"minOccurs,attr"`
+	MaxOccurs  string         `xml:"maxOccurs,attr"`
+	SimpleType *xsdSimpleType `xml:"simpleType"`
+}
+
+type xsdAttribute struct {
+	Name string `xml:"name,attr"`
+	Type string `xml:"type,attr"`
+	Use  string `xml:"use,attr"`
+}
+
+type xsdComplexType struct {
+	Name       string         `xml:"name,attr"`
+	Sequence   []xsdElement   `xml:"sequence>element"`
+	Attributes []xsdAttribute `xml:"attribute"`
+}
+
+type xsdSimpleType struct {
+	Name        string          `xml:"name,attr"`
+	Restriction *xsdRestriction `xml:"restriction"`
+	List        *struct {
+		SimpleType *xsdSimpleType `xml:"simpleType"`
+	} `xml:"list"`
+}
+
+type xsdRestriction struct {
+	Base           string     `xml:"base,attr"`
+	Enumerations   []xsdValue `xml:"enumeration"`
+	MinInclusive   *xsdValue  `xml:"minInclusive"`
+	MaxInclusive   *xsdValue  `xml:"maxInclusive"`
+	FractionDigits *xsdValue  `xml:"fractionDigits"`
+}
+
+type xsdValue struct {
+	Value string `xml:"value,attr"`
+}
+
+// xmlNode is a generic element tree of the document being validated
+type xmlNode struct {
+	Name     string
+	Attrs    []xml.Attr
+	Children []*xmlNode
+	Text     string
+}
+
+// loadComicInfoSchema parses the embedded schema once
+var loadComicInfoSchema = sync.OnceValues(func() (*xsdSchema, error) {
+	var schema xsdSchema
+	if err := xml.Unmarshal(comicInfoXSD, &schema); err != nil {
+		return nil, fmt.Errorf("error parsing ComicInfo schema: %w", err)
+	}
+	return &schema, nil
+})
+
+// validateComicInfo checks a ComicInfo.xml document against the embedded
+// schema and returns every problem found, so strict readers that reject the
+// whole file on a single invalid value can be caught before writing it
+func validateComicInfo(document []byte) []error {
+	schema, err := loadComicInfoSchema()
+	if err != nil {
+		return []error{err}
+	}
+
+	root, err := parseXMLNode(document)
+	if err != nil {
+		return []error{fmt.Errorf("error parsing ComicInfo.xml: %w", err)}
+	}
+
+	for _, element := range schema.Elements {
+		if element.Name == root.Name {
+			return schema.validateElement(root, element, root.Name)
+		}
+	}
+	return []error{fmt.Errorf("unexpected root element <%s>", root.Name)}
+}
+
+// parseXMLNode builds the element tree of a document
+func parseXMLNode(document []byte) (*xmlNode, error) {
+	decoder := xml.NewDecoder(strings.NewReader(string(document)))
+	var stack []*xmlNode
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{Name: t.Name.Local, Attrs: t.Copy().Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, node)
+			}
+			stack = append(stack, node)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].Text += string(t)
+			}
+		case xml.EndElement:
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return node, nil
+			}
+		}
+	}
+}
+
+// validateElement checks a node against its element declaration
+func (s *xsdSchema) validateElement(node *xmlNode, element xsdElement, path string) []error {
+	if element.SimpleType != nil {
+		return wrapErrors(path, s.validateSimpleType(strings.TrimSpace(node.Text), element.SimpleType))
+	}
+	if complexType := s.complexType(element.Type); complexType != nil {
+		return s.validateComplexType(node, complexType, path)
+	}
+	return wrapErrors(path, s.validateValue(strings.TrimSpace(node.Text), element.Type))
+}
+
+// validateComplexType checks the attributes and the child sequence of a node
+func (s *xsdSchema) validateComplexType(node *xmlNode, complexType *xsdComplexType, path string) []error {
+	var errs []error
+
+	declared := make(map[string]xsdAttribute, len(complexType.Attributes))
+	for _, attribute := range complexType.Attributes {
+		declared[attribute.Name] = attribute
+	}
+	present := make(map[string]bool, len(node.Attrs))
+	for _, attr := range node.Attrs {
+		attribute, ok := declared[attr.Name.Local]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unexpected attribute %s", path, attr.Name.Local))
+			continue
+		}
+		present[attr.Name.Local] = true
+		errs = append(errs, wrapErrors(path+"@"+attr.Name.Local, s.validateValue(attr.Value, attribute.Type))...)
+	}
+	for _, attribute := range complexType.Attributes {
+		if attribute.Use == "required" && !present[attribute.Name] {
+			errs = append(errs, fmt.Errorf("%s: missing required attribute %s", path, attribute.Name))
+		}
+	}
+
+	// Children must follow the declared sequence order
+	position, occurrences := 0, 0
+	for _, child := range node.Children {
+		for position < len(complexType.Sequence) && complexType.Sequence[position].Name != child.Name {
+			errs = append(errs, checkMinOccurs(complexType.Sequence[position], occurrences, path)...)
+			position, occurrences = position+1, 0
+		}
+		if position == len(complexType.Sequence) {
+			errs = append(errs, fmt.Errorf("%s: unexpected or misplaced element <%s>", path, child.Name))
+			// Restart matching so later elements are still validated
+			position, occurrences = 0, 0
+			continue
+		}
+		element := complexType.Sequence[position]
+		occurrences++
+		if element.MaxOccurs != "unbounded" {
+			maxOccurs := 1
+			if element.MaxOccurs != "" {
+				maxOccurs, _ = strconv.Atoi(element.MaxOccurs)
+			}
+			if occurrences > maxOccurs {
+				errs = append(errs, fmt.Errorf("%s: too many <%s> elements", path, child.Name))
+			}
+		}
+		errs = append(errs, s.validateElement(child, element, path+"/"+child.Name)...)
+	}
+	for ; position < len(complexType.Sequence); position, occurrences = position+1, 0 {
+		errs = append(errs, checkMinOccurs(complexType.Sequence[position], occurrences, path)...)
+	}
+	return errs
+}
+
+// checkMinOccurs reports a mandatory element that appears too few times
+func checkMinOccurs(element xsdElement, occurrences int, path string) []error {
+	minOccurs := 1
+	if element.MinOccurs != "" {
+		minOccurs, _ = strconv.Atoi(element.MinOccurs)
+	}
+	if occurrences < minOccurs {
+		return []error{fmt.Errorf("%s: missing element <%s>", path, element.Name)}
+	}
+	return nil
+}
+
+// validateValue checks a text value against a built-in or named simple type
+func (s *xsdSchema) validateValue(value string, typeName string) []error {
+	if simpleType := s.simpleType(typeName); simpleType != nil {
+		return s.validateSimpleType(value, simpleType)
+	}
+
+	var err error
+	switch typeName {
+	case "xs:int":
+		_, err = strconv.ParseInt(value, 10, 32)
+	case "xs:long":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "xs:decimal":
+		_, err = strconv.ParseFloat(value, 64)
+		if err == nil && strings.ContainsAny(value, "eE") {
+			err = fmt.Errorf("exponent not allowed")
+		}
+	case "xs:boolean":
+		switch value {
+		case "true", "false", "1", "0":
+		default:
+			err = fmt.Errorf("not a boolean")
+		}
+	case "xs:string", "":
+	default:
+		return []error{fmt.Errorf("unknown type %s", typeName)}
+	}
+	if err != nil {
+		return []error{fmt.Errorf("invalid %s value %q", typeName, value)}
+	}
+	return nil
+}
+
+// validateSimpleType checks a value against a restriction or list type
+func (s *xsdSchema) validateSimpleType(value string, simpleType *xsdSimpleType) []error {
+	if simpleType.List != nil && simpleType.List.SimpleType != nil {
+		var errs []error
+		for _, item := range strings.Fields(value) {
+			errs = append(errs, s.validateSimpleType(item, simpleType.List.SimpleType)...)
+		}
+		return errs
+	}
+
+	restriction := simpleType.Restriction
+	if restriction == nil {
+		return nil
+	}
+	if errs := s.validateValue(value, restriction.Base); len(errs) > 0 {
+		return errs
+	}
+
+	if len(restriction.Enumerations) > 0 {
+		allowed := make([]string, len(restriction.Enumerations))
+		for i, enumeration := range restriction.Enumerations {
+			if enumeration.Value == value {
+				return nil
+			}
+			allowed[i] = enumeration.Value
+		}
+		return []error{fmt.Errorf("invalid value %q (allowed: %s)", value, strings.Join(allowed, ", "))}
+	}
+
+	var errs []error
+	number, _ := strconv.ParseFloat(value, 64)
+	if restriction.MinInclusive != nil {
+		if minimum, err := strconv.ParseFloat(restriction.MinInclusive.Value, 64); err == nil && number < minimum {
+			errs = append(errs, fmt.Errorf("value %s is below the minimum %s", value, restriction.MinInclusive.Value))
+		}
+	}
+	if restriction.MaxInclusive != nil {
+		if maximum, err := strconv.ParseFloat(restriction.MaxInclusive.Value, 64); err == nil && number > maximum {
+			errs = append(errs, fmt.Errorf("value %s is above the maximum %s", value, restriction.MaxInclusive.Value))
+		}
+	}
+	if restriction.FractionDigits != nil {
+		digits, _ := strconv.Atoi(restriction.FractionDigits.Value)
+		if _, fraction, ok := strings.Cut(value, "."); ok && len(strings.TrimRight(fraction, "0")) > digits {
+			errs = append(errs, fmt.Errorf("value %s has more than %d fraction digits", value, digits))
+		}
+	}
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		errs = append(errs, fmt.Errorf("value %s is not a finite number", value))
+	}
+	return errs
+}
+
+// complexType returns the named complex type, or nil for simple types
+func (s *xsdSchema) complexType(name string) *xsdComplexType {
+	for i := range s.ComplexTypes {
+		if s.ComplexTypes[i].Name == name {
+			return &s.ComplexTypes[i]
+		}
+	}
+	return nil
+}
+
+// simpleType returns the named simple type, or nil for built-in types
+func (s *xsdSchema) simpleType(name string) *xsdSimpleType {
+	for i := range s.SimpleTypes {
+		if s.SimpleTypes[i].Name == name {
+			return &s.SimpleTypes[i]
+		}
+	}
+	return nil
+}
+
+// wrapErrors prefixes errors with the location of the offending value
+func wrapErrors(path string, errs []error) []error {
+	for i, err := range errs {
+		errs[i] = fmt.Errorf("%s: %w", path, err)
+	}
+	return errs
+}
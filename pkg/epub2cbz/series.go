@@ -0,0 +1,90 @@
+package epub2cbz
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// bookVolume returns the volume number of a book, from its volume or its
+// number in the series, or 0 when it has none
+func bookVolume(info *ComicInfo) int {
+	if info.Volume > 0 {
+		return info.Volume
+	}
+	number, err := strconv.Atoi(strings.TrimSpace(info.Number))
+	if err != nil || number < 0 {
+		return 0
+	}
+	return number
+}
+
+// inferSeriesCounts infers the number of volumes of the series converted in
+// a batch, for the books whose metadata does not give it. A series counts as
+// complete when its volumes are numbered from 1 without gaps, the last volume
+// number being the count; incomplete series are left alone. It returns the
+// count of each book, by EPUB path.
+func inferSeriesCounts(epubFiles []string, opts Options) map[string]int {
+	type seriesBooks struct {
+		name    string
+		volumes map[int]bool
+		paths   []string // books without a count
+	}
+	series := make(map[string]*seriesBooks)
+	for _, epubPath := range epubFiles {
+		metadata, err := readEPUBMetadata(epubPath, opts)
+		if err != nil {
+			// processFile reports the error when it opens the file
+			continue
+		}
+		overrides, err := bookOverrides(epubPath, opts)
+		if err != nil {
+			continue
+		}
+		info := createComicInfo(metadata)
+		applyOverrides(info, overrides)
+		volume := bookVolume(info)
+		if info.Series == "" || volume == 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(info.Series))
+		books, ok := series[key]
+		if !ok {
+			books = &seriesBooks{name: info.Series, volumes: make(map[int]bool)}
+			series[key] = books
+		}
+		books.volumes[volume] = true
+		if info.Count == 0 {
+			books.paths = append(books.paths, epubPath)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, books := range series {
+		last := 0
+		for volume := range books.volumes {
+			last = max(last, volume)
+		}
+		if last < 2 || len(books.paths) == 0 {
+			continue
+		}
+		if len(books.volumes) != last {
+			opts.logger().Printf("Series %s has missing volumes, their count is not set", books.name)
+			continue
+		}
+		for _, path := range books.paths {
+			counts[path] = last
+		}
+	}
+	return counts
+}
+
+// withOverride returns a copy of overrides with one more value
+func withOverride(overrides map[string]string, name string, value string) map[string]string {
+	result := maps.Clone(overrides)
+	if result == nil {
+		result = make(map[string]string)
+	}
+	result[name] = value
+	return result
+}
@@ -0,0 +1,129 @@
+package epub2cbz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sidecarName is the name of the metadata sidecar of a whole directory; the
+// sidecar of one book is named after it, "<book>.metadata.json"
+const sidecarName = "metadata"
+
+// sidecarExtensions are the formats of metadata sidecars, in lookup order
+var sidecarExtensions = []string{".json", ".yaml", ".yml"}
+
+// readSidecarMetadata reads the ComicInfo values curated in the sidecars of
+// an EPUB: the metadata.json or metadata.yaml of its directory, then its own
+// <book>.metadata.json or <book>.metadata.yaml, whose values win. Values are
+// keyed by ComicInfo element name, like the -set overrides.
+func readSidecarMetadata(epubPath string) (map[string]string, error) {
+	dir := filepath.Dir(epubPath)
+	base := strings.TrimSuffix(filepath.Base(epubPath), filepath.Ext(epubPath))
+	var values map[string]string
+	for _, name := range []string{filepath.Join(dir, sidecarName), filepath.Join(dir, base+"."+sidecarName)} {
+		for _, ext := range sidecarExtensions {
+			data, err := os.ReadFile(longPath(name + ext))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("error reading metadata sidecar: %w", err)
+			}
+			sidecar, err := parseSidecar(data, ext)
+			if err == nil {
+				err = validateOverrides(sidecar)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid metadata sidecar %s: %w", name+ext, err)
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			maps.Copy(values, sidecar)
+			break
+		}
+	}
+	return values, nil
+}
+
+// parseSidecar decodes the values of a JSON or YAML sidecar
+func parseSidecar(data []byte, ext string) (map[string]string, error) {
+	if ext != ".json" {
+		return parseFlatYAML(data)
+	}
+	var document map[string]any
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(document))
+	for name, value := range document {
+		switch v := value.(type) {
+		case string:
+			values[name] = strings.TrimSpace(v)
+		case float64:
+			values[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case nil:
+			values[name] = ""
+		default:
+			return nil, fmt.Errorf("%s: expected a text or a number", name)
+		}
+	}
+	return values, nil
+}
+
+// parseFlatYAML decodes the "Field: value" lines of a YAML mapping, which is
+// all a sidecar holds. Values may be quoted, and # starts a comment.
+func parseFlatYAML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name != strings.TrimSpace(name) || name == "" {
+			return nil, fmt.Errorf("line %d: expected Field: value", i+1)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value", i+1)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("line %d: invalid quoted value", i+1)
+			}
+			value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		default:
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+			if value == "~" || value == "null" {
+				value = ""
+			}
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// bookOverrides returns the ComicInfo values replacing the EPUB metadata of
+// a book: the values of its sidecars, and over them the ones of the options
+func bookOverrides(epubPath string, opts Options) (map[string]string, error) {
+	sidecar, err := readSidecarMetadata(epubPath)
+	if err != nil || sidecar == nil {
+		return opts.Overrides, err
+	}
+	maps.Copy(sidecar, opts.Overrides)
+	return sidecar, nil
+}
@@ -0,0 +1,107 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// DefaultSpillThreshold is the entry size above which intermediate data is
+// written to a temporary file instead of being held in memory
+const DefaultSpillThreshold = 64 << 20
+
+// shouldSpill reports whether an entry of the given size must be spilled to disk
+func shouldSpill(size uint64, threshold int64) bool {
+	return threshold > 0 && size > uint64(threshold)
+}
+
+// spillRaw copies already compressed entry data into a temporary file
+func spillRaw(src io.Reader) (*os.File, error) {
+	spill, err := os.CreateTemp("", "epub2cbz-*.spill")
+	if err != nil {
+		return nil, err
+	}
+	chunk := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(chunk)
+	if _, err := io.CopyBuffer(spill, src, *chunk); err != nil {
+		discardSpill(spill)
+		return nil, err
+	}
+	return spill, nil
+}
+
+// spillEntry compresses src with the method of the header into a temporary
+// file, filling the CRC and sizes the header needs to be written raw,
+// without ever holding the whole entry in memory
+func spillEntry(src io.Reader, entryHeader *zip.FileHeader) (*os.File, error) {
+	spill, err := os.CreateTemp("", "epub2cbz-*.spill")
+	if err != nil {
+		return nil, err
+	}
+
+	var dst io.Writer = spill
+	var compressor *flate.Writer
+	if entryHeader.Method == zip.Deflate {
+		if compressor, err = flate.NewWriter(spill, flate.DefaultCompression); err != nil {
+			discardSpill(spill)
+			return nil, err
+		}
+		dst = compressor
+	}
+
+	hash := crc32.NewIEEE()
+	chunk := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(chunk)
+	size, err := io.CopyBuffer(io.MultiWriter(dst, hash), src, *chunk)
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+	if err != nil {
+		discardSpill(spill)
+		return nil, err
+	}
+
+	compressedSize, err := spill.Seek(0, io.SeekCurrent)
+	if err != nil {
+		discardSpill(spill)
+		return nil, err
+	}
+	entryHeader.CRC32 = hash.Sum32()
+	entryHeader.UncompressedSize64 = uint64(size)
+	entryHeader.CompressedSize64 = uint64(compressedSize)
+	return spill, nil
+}
+
+// compressPage compresses an encoded page with the method of the header,
+// into a temporary file when it is larger than the threshold, or into a
+// pooled buffer otherwise
+func compressPage(page []byte, entryHeader *zip.FileHeader, threshold int64) (*bytes.Buffer, *os.File, error) {
+	if shouldSpill(uint64(len(page)), threshold) {
+		spill, err := spillEntry(bytes.NewReader(page), entryHeader)
+		return nil, spill, err
+	}
+	data := getEntryBuffer()
+	data.Write(page)
+	data, err := compressEntry(data, entryHeader)
+	return data, nil, err
+}
+
+// copySpill writes the content of a spill file to dst
+func copySpill(dst io.Writer, spill *os.File) error {
+	if _, err := spill.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	chunk := copyBufferPool.Get().(*[]byte)
+	defer copyBufferPool.Put(chunk)
+	_, err := io.CopyBuffer(dst, spill, *chunk)
+	return err
+}
+
+// discardSpill closes and removes a spill file
+func discardSpill(spill *os.File) {
+	spill.Close()
+	os.Remove(spill.Name())
+}
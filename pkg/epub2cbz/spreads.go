@@ -0,0 +1,142 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+)
+
+// Orders of the halves of a split spread
+const (
+	SplitOrderLTR = "ltr" // left half first, for left to right books
+	SplitOrderRTL = "rtl" // right half first, for manga
+)
+
+// spreadQuality is the quality of the halves of JPEG spreads, high enough
+// for the second compression not to show
+const spreadQuality = 92
+
+// validateSplitOrder checks the split order given on the command line
+func validateSplitOrder(order string) error {
+	switch order {
+	case SplitOrderLTR, SplitOrderRTL:
+		return nil
+	}
+	return fmt.Errorf("invalid split order %q (expected %s or %s)", order, SplitOrderLTR, SplitOrderRTL)
+}
+
+// isSpread reports whether an image is a landscape spread of two pages
+func isSpread(config image.Config) bool {
+	return config.Width > config.Height
+}
+
+// splitSpread cuts a spread in two pages, returned in reading order. JPEG
+// spreads give JPEG pages and every other format PNG pages; the MIME type
+// of the pages is returned.
+func splitSpread(data []byte, order string) ([][]byte, string, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding image: %w", err)
+	}
+	bounds := src.Bounds()
+	middle := bounds.Min.X + bounds.Dx()/2
+	halves := []image.Rectangle{
+		image.Rect(bounds.Min.X, bounds.Min.Y, middle, bounds.Max.Y),
+		image.Rect(middle, bounds.Min.Y, bounds.Max.X, bounds.Max.Y),
+	}
+	if order == SplitOrderRTL {
+		halves[0], halves[1] = halves[1], halves[0]
+	}
+
+	mimeType := "image/png"
+	if format == "jpeg" {
+		mimeType = "image/jpeg"
+	}
+	pages := make([][]byte, 0, len(halves))
+	for _, half := range halves {
+		// Gray spreads stay gray, other ones are drawn in RGBA
+		var dst draw.Image = image.NewRGBA(image.Rect(0, 0, half.Dx(), half.Dy()))
+		if _, ok := src.(*image.Gray); ok {
+			dst = image.NewGray(dst.Bounds())
+		}
+		draw.Draw(dst, dst.Bounds(), src, half.Min, draw.Src)
+		var buf bytes.Buffer
+		if format == "jpeg" {
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: spreadQuality})
+		} else {
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("error encoding page: %w", err)
+		}
+		pages = append(pages, buf.Bytes())
+	}
+	return pages, mimeType, nil
+}
+
+// prepareSpreadImage cuts a spread in two pages compressed for the output
+// ZIP, the second one chained to the first. Each page gets the watermark of
+// the options.
+func prepareSpreadImage(f *zip.File, imgPath string, entryHeader *zip.FileHeader, opts Options, logger *log.Logger) *preparedImage {
+	srcFile, err := f.Open()
+	if err != nil {
+		logger.Printf("Error opening image %s: %v", imgPath, err)
+		return nil
+	}
+	defer srcFile.Close()
+
+	var content *bytes.Buffer
+	opts.limits.doIO(func() {
+		content, err = readAllPooled(srcFile)
+	})
+	if err != nil {
+		logger.Printf("Error copying image %s: %v", imgPath, err)
+		return nil
+	}
+	defer releaseEntryBuffer(content)
+
+	var first, last *preparedImage
+	opts.limits.doCPU(func() {
+		var pages [][]byte
+		var mimeType string
+		if pages, mimeType, err = splitSpread(content.Bytes(), opts.SplitOrder); err != nil {
+			return
+		}
+		for _, page := range pages {
+			if opts.Watermark != "" {
+				if page, mimeType, err = watermarkImage(page, opts.Watermark, opts.WatermarkStyle); err != nil {
+					return
+				}
+			}
+			config, _, _ := image.DecodeConfig(bytes.NewReader(page))
+			header := *entryHeader
+			header.Method = imageMethod(opts.Compression, mimeType, f.Method)
+			var data *bytes.Buffer
+			var spill *os.File
+			if data, spill, err = compressPage(page, &header, opts.SpillThreshold); err != nil {
+				return
+			}
+			part := &preparedImage{header: &header, ext: imageExtension(mimeType, imgPath), width: config.Width, height: config.Height, data: data, spill: spill}
+			if first == nil {
+				first = part
+			} else {
+				last.next = part
+			}
+			last = part
+		}
+	})
+	if err != nil {
+		for part := first; part != nil; part = part.next {
+			part.release()
+		}
+		logger.Printf("Error splitting spread %s: %v", imgPath, err)
+		return nil
+	}
+	return first
+}
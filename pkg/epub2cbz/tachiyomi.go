@@ -0,0 +1,52 @@
+package epub2cbz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tachiyomiDetails is the details.json of a series folder read by the local
+// source of Tachiyomi and Mihon
+type tachiyomiDetails struct {
+	Title       string   `json:"title"`
+	Author      string   `json:"author,omitempty"`
+	Artist      string   `json:"artist,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Genre       []string `json:"genre,omitempty"`
+	Status      string   `json:"status"` // "0" is unknown
+}
+
+// writeTachiyomiDetails writes the details.json of a series folder, unless
+// one exists: it may have been edited in the reader
+func writeTachiyomiDetails(seriesDir string, info *ComicInfo) error {
+	detailsPath := filepath.Join(seriesDir, "details.json")
+	if _, err := os.Stat(longPath(detailsPath)); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	details := tachiyomiDetails{
+		Title:       firstNonEmpty(info.Series, info.Title, filepath.Base(seriesDir)),
+		Author:      info.Writer,
+		Artist:      firstNonEmpty(info.Penciller, info.CoverArtist),
+		Description: info.Summary,
+		Status:      "0",
+	}
+	for _, genre := range strings.Split(info.Genre, ",") {
+		if genre = strings.TrimSpace(genre); genre != "" {
+			details.Genre = append(details.Genre, genre)
+		}
+	}
+
+	data, err := json.MarshalIndent(details, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling details.json: %w", err)
+	}
+	if err := os.WriteFile(longPath(detailsPath), data, 0644); err != nil {
+		return fmt.Errorf("error writing details.json: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// thumbnailDir is the folder of the thumbnails, next to the books
+const thumbnailDir = ".thumbs"
+
+// thumbnailQuality is the JPEG quality of thumbnails
+const thumbnailQuality = 85
+
+// ParseThumbnailSize parses a thumbnail size like "300x450"
+func ParseThumbnailSize(value string) (int, int, error) {
+	w, h, ok := strings.Cut(strings.ToLower(strings.TrimSpace(value)), "x")
+	width, errW := strconv.Atoi(w)
+	height, errH := strconv.Atoi(h)
+	if !ok || errW != nil || errH != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid thumbnail size %q (expected WIDTHxHEIGHT, e.g. 300x450)", value)
+	}
+	return width, height, nil
+}
+
+// thumbnailPath returns the thumbnail of a book, "<name>.jpg" in the
+// .thumbs folder next to it
+func thumbnailPath(bookPath string) string {
+	name := strings.TrimSuffix(filepath.Base(bookPath), filepath.Ext(bookPath)) + ".jpg"
+	return filepath.Join(filepath.Dir(bookPath), thumbnailDir, name)
+}
+
+// writeThumbnail writes the thumbnail of the cover of a converted book,
+// resized to fit in width x height
+func writeThumbnail(bookPath string, width int, height int) error {
+	reader, err := zip.OpenReader(longPath(bookPath))
+	if err != nil {
+		return fmt.Errorf("error opening CBZ file: %w", err)
+	}
+	defer reader.Close()
+
+	// The cover is the first page written
+	var cover *zip.File
+	for _, f := range reader.File {
+		if isImageName(f.Name) {
+			cover = f
+			break
+		}
+	}
+	if cover == nil {
+		return fmt.Errorf("error writing thumbnail: %s has no image", bookPath)
+	}
+	r, err := cover.Open()
+	if err != nil {
+		return fmt.Errorf("error reading cover: %w", err)
+	}
+	defer r.Close()
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return fmt.Errorf("error decoding cover: %w", err)
+	}
+
+	// The thumbnail keeps the proportions of the cover
+	bounds := src.Bounds()
+	scale := min(float64(width)/float64(bounds.Dx()), float64(height)/float64(bounds.Dy()))
+	size := image.Rect(0, 0, max(1, int(float64(bounds.Dx())*scale)), max(1, int(float64(bounds.Dy())*scale)))
+	dst := image.NewRGBA(size)
+	draw.CatmullRom.Scale(dst, size, src, bounds, draw.Src, nil)
+
+	thumbnail := thumbnailPath(bookPath)
+	if err := os.MkdirAll(longPath(filepath.Dir(thumbnail)), 0755); err != nil {
+		return fmt.Errorf("error creating thumbnail folder: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return fmt.Errorf("error encoding thumbnail: %w", err)
+	}
+	if err := os.WriteFile(longPath(thumbnail), buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing thumbnail: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package epub2cbz
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// titleVariants returns the other forms of the title of a book, so titles in
+// several scripts (kanji and romaji) all survive for search: the titles of
+// type "alternate" or in another language than the main title, their
+// alternate-script refinements, and their file-as forms unless they only
+// reorder the words of the title ("Saga, The").
+func titleVariants(m Metadata) []string {
+	if len(m.Title) == 0 {
+		return nil
+	}
+	main := m.Title[0]
+	var variants []string
+	add := func(value string) {
+		value = strings.Join(strings.Fields(value), " ")
+		if value != "" && !sameWords(value, main) && !slices.Contains(variants, value) {
+			variants = append(variants, value)
+		}
+	}
+
+	var mainLang string
+	for i, attrs := range m.TitleAttrs {
+		if i >= len(m.Title) {
+			break
+		}
+		refines := m.Refines[attrs.ID]
+		if i == 0 {
+			mainLang = attrs.Lang
+		} else if titleType := getFirst(refines["title-type"]); titleType == "alternate" ||
+			(titleType == "" && attrs.Lang != "" && !strings.EqualFold(attrs.Lang, mainLang)) {
+			add(m.Title[i])
+		}
+		add(attrs.FileAs)
+		for _, value := range refines["file-as"] {
+			add(value)
+		}
+		for _, value := range refines["alternate-script"] {
+			add(value)
+		}
+	}
+	return variants
+}
+
+// sameWords reports whether two titles have the same words, whatever their
+// order, case and punctuation
+func sameWords(a string, b string) bool {
+	words := func(s string) []string {
+		fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+		slices.Sort(fields)
+		return fields
+	}
+	return slices.Equal(words(a), words(b))
+}
+
+// alternateTitlesNote returns the line of ComicInfo Notes listing the other
+// forms of the title, or "" when there are none
+func alternateTitlesNote(m Metadata) string {
+	variants := titleVariants(m)
+	if len(variants) == 0 {
+		return ""
+	}
+	return "Alternate titles: " + strings.Join(variants, "; ")
+}
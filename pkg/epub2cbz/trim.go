@@ -0,0 +1,106 @@
+package epub2cbz
+
+import (
+	"io"
+	"log"
+	"slices"
+	"strings"
+)
+
+// backmatterKeywords recognize the table of contents entries of the pages
+// publishers append after the story
+var backmatterKeywords = []string{
+	"about the author", "about the creator", "advertisement", "also available",
+	"also by", "bonus preview", "catalog", "copyright", "credits", "get the latest",
+	"more from", "newsletter", "preview", "sign up", "thank you for", "coming soon",
+}
+
+// isBackmatter reports whether a table of contents entry is back matter
+func isBackmatter(title string) bool {
+	title = strings.ToLower(title)
+	for _, keyword := range backmatterKeywords {
+		if strings.Contains(title, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// backmatterStart returns the first page of the back matter: the page of the
+// first of the last table of contents entries that are all back matter, or
+// -1 when the book does not end with back matter
+func backmatterStart(chapters []chapter) int {
+	start := -1
+	for i := len(chapters) - 1; i > 0 && isBackmatter(chapters[i].Title); i-- {
+		start = chapters[i].Page
+	}
+	return start
+}
+
+// coverPage returns the spine page showing the cover: the page displaying
+// the cover image of the manifest among the first pages, or the first page
+// when the cover is not declared. It returns -1 when the cover image is
+// declared but not part of the spine.
+func coverPage(index archiveIndex, pkg *Package, opfPath string, pages []string) int {
+	cover := declaredCover(pkg, opfPath)
+	if cover == "" {
+		return 0
+	}
+	for page := range min(len(pages), 3) {
+		if slices.Contains(readPage(index, pages[page], false, log.New(io.Discard, "", 0)).images, cover) {
+			return page
+		}
+	}
+	return -1
+}
+
+// declaredCover returns the path of the cover image declared by the
+// manifest, with the cover-image property of EPUB 3 or the "cover" meta of
+// EPUB 2, or "" when the cover is not declared
+func declaredCover(pkg *Package, opfPath string) string {
+	coverID := pkg.Metadata.Meta["cover"]
+	for _, item := range pkg.Manifest.Items {
+		if hasProperty(item.Properties, "cover-image") || (coverID != "" && item.ID == coverID) {
+			return resolveImagePath(opfPath, item.Href)
+		}
+	}
+	return ""
+}
+
+// dropChapters moves the chapters of a book whose spine pages from first to
+// last, included, were removed, leaving pageCount pages. A chapter starting
+// on a dropped page starts on the next page kept, unless another chapter
+// already does.
+func dropChapters(chapters []chapter, first int, last int, pageCount int) []chapter {
+	removed := last - first + 1
+	var kept []chapter
+	for _, c := range chapters {
+		switch {
+		case c.Page > last:
+			c.Page -= removed
+		case c.Page >= first:
+			c.Page = first
+		}
+		if c.Page >= pageCount {
+			continue
+		}
+		if len(kept) > 0 && kept[len(kept)-1].Page == c.Page {
+			// The later chapter wins, the earlier one lost all its pages
+			kept = kept[:len(kept)-1]
+		}
+		kept = append(kept, c)
+	}
+	return kept
+}
+
+// reverseChapters moves the chapters of a book of pageCount pages whose
+// spine was reversed, for EPUBs listing the pages backwards. Chapter entries
+// point to the real first page of each chapter, they keep pointing to it.
+func reverseChapters(chapters []chapter, pageCount int) []chapter {
+	reversed := make([]chapter, len(chapters))
+	for i, c := range chapters {
+		c.Page = pageCount - 1 - c.Page
+		reversed[len(chapters)-1-i] = c
+	}
+	return reversed
+}
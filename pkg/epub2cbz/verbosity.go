@@ -0,0 +1,40 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+)
+
+// Verbosity levels of the messages
+const (
+	VerbosityQuiet   = -1 // errors only
+	VerbosityNormal  = 0  // progress, warnings and errors
+	VerbosityVerbose = 1  // details of each conversion: package, pages, timings
+	VerbosityDebug   = 2  // every page and image of each conversion
+)
+
+// verbosef logs a detail of a conversion shown with -verbose
+func (opts Options) verbosef(logger *log.Logger, format string, args ...any) {
+	if opts.Verbosity >= VerbosityVerbose {
+		logger.Printf(format, args...)
+	}
+}
+
+// debugf logs a detail of a conversion shown with -debug
+func (opts Options) debugf(logger *log.Logger, format string, args ...any) {
+	if opts.Verbosity >= VerbosityDebug {
+		logger.Printf(format, args...)
+	}
+}
+
+// methodName names the compression method of an entry in debug messages
+func methodName(method uint16) string {
+	switch method {
+	case zip.Store:
+		return "stored"
+	case zip.Deflate:
+		return "deflated"
+	}
+	return fmt.Sprintf("method %d", method)
+}
@@ -0,0 +1,53 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestVerifyingReader copies the raw data of stored and deflated entries,
+// checking their CRC-32 in the same pass, and fails the ones whose CRC-32
+// doesn't match their data
+func TestVerifyingReader(t *testing.T) {
+	content := bytes.Repeat([]byte("epub2cbz "), 10000)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		var buf bytes.Buffer
+		zipw := zip.NewWriter(&buf)
+		w, err := zipw.CreateHeader(&zip.FileHeader{Name: "page.png", Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+		if err := zipw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := reader.File[0]
+
+		for _, corrupted := range []bool{false, true} {
+			if corrupted {
+				f.CRC32++
+			}
+			raw, err := f.OpenRaw()
+			if err != nil {
+				t.Fatal(err)
+			}
+			src, verify := verifyingReader(raw, f)
+			data, err := io.ReadAll(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uint64(len(data)) != f.CompressedSize64 {
+				t.Errorf("method %d: copied %d bytes, want %d", method, len(data), f.CompressedSize64)
+			}
+			if err := verify(); (err != nil) != corrupted {
+				t.Errorf("method %d, corrupted %v: verify returned %v", method, corrupted, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package epub2cbz
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultSettleDelay is how long a file must stay unchanged before it is converted
+const DefaultSettleDelay = 5 * time.Second
+
+// pendingFile is an EPUB seen by the watcher and not converted yet
+type pendingFile struct {
+	lastEvent time.Time // last event or change observed
+	size      int64
+	modTime   time.Time
+}
+
+// watchDirectory converts the EPUBs found in sourceDir, then the ones added or
+// modified, until ctx is canceled; running conversions are completed.
+// Changes come from the events of the operating system (inotify, kqueue,
+// ReadDirectoryChangesW) rather than from polling, which is too expensive on
+// large network shares. A file is converted once its size and modification
+// time stayed the same for the settle delay and it opens as a complete
+// archive, since copies over SMB arrive in many writes. The books processed
+// are recorded in the database at dbPath, so a restart doesn't convert them
+// again.
+func watchDirectory(ctx context.Context, sourceDir string, outputDir string, opts Options, settle time.Duration, dbPath string) error {
+	if settle <= 0 {
+		return fmt.Errorf("invalid settle delay %s, it must be greater than 0", settle)
+	}
+	opts.batch = true
+
+	db, err := loadWatchDatabase(dbPath, sourceDir)
+	if err != nil {
+		return err
+	}
+	// The database and the cache are saved at most once per tick, and when
+	// the watch stops, rather than after every book of a large copy
+	save := func() {
+		if err := db.save(); err != nil {
+			opts.logger().Print(err)
+		}
+		if opts.cache != nil {
+			if err := opts.cache.save(); err != nil {
+				opts.logger().Print(err)
+			}
+		}
+	}
+	defer save()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error starting watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	pending := make(map[string]*pendingFile)
+	queue := func(path string) {
+		if strings.EqualFold(filepath.Ext(path), ".epub") {
+			pending[path] = &pendingFile{lastEvent: time.Now()}
+		}
+	}
+
+	// watchTree watches a directory and its subdirectories in recursive mode,
+	// queuing the EPUBs already there: they may have been written before the
+	// watch was in place
+	watchTree := func(dir string) error {
+		return filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				if path != dir && !opts.Recursive {
+					return filepath.SkipDir
+				}
+				if err := watcher.Add(path); err != nil {
+					return fmt.Errorf("error watching %s: %w", path, err)
+				}
+				return nil
+			}
+			queue(path)
+			return nil
+		})
+	}
+	if err := watchTree(sourceDir); err != nil {
+		return err
+	}
+	if outputDir != "" && !IsRemoteURL(outputDir) {
+		if err := os.MkdirAll(longPath(outputDir), 0755); err != nil {
+			return fmt.Errorf("error creating output directory: %w", err)
+		}
+	}
+
+	ticker := time.NewTicker(min(settle, time.Second))
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, opts.Jobs)
+	var convertingMutex sync.Mutex
+	converting := make(map[string]bool)
+	taken := make(map[string]string)
+	outputs := make(map[string]string) // output of each EPUB, kept across modifications
+
+	for {
+		select {
+		case <-ctx.Done():
+			opts.printf("Stopping, waiting for running conversions...\n")
+			wg.Wait()
+			return nil
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				wg.Wait()
+				return nil
+			}
+			switch {
+			case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+				// Renames report the old name, the new one comes as a Create
+				delete(pending, event.Name)
+			case event.Has(fsnotify.Create):
+				if info, err := os.Stat(longPath(event.Name)); err == nil && info.IsDir() {
+					if opts.Recursive {
+						if err := watchTree(event.Name); err != nil {
+							opts.logger().Print(err)
+						}
+					}
+					continue
+				}
+				queue(event.Name)
+			case event.Has(fsnotify.Write):
+				if file, ok := pending[event.Name]; ok {
+					file.lastEvent = time.Now()
+				} else {
+					queue(event.Name)
+				}
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				wg.Wait()
+				return nil
+			}
+			opts.logger().Printf("Error watching %s: %v", sourceDir, err)
+
+		case now := <-ticker.C:
+			save()
+			for path, file := range pending {
+				if now.Sub(file.lastEvent) < settle {
+					continue
+				}
+				info, err := os.Stat(longPath(path))
+				if err != nil {
+					delete(pending, path)
+					continue
+				}
+				// Some SMB clients write without events on the share: the
+				// file must also be unchanged between two checks
+				if info.Size() != file.size || !info.ModTime().Equal(file.modTime) {
+					file.size, file.modTime, file.lastEvent = info.Size(), info.ModTime(), now
+					continue
+				}
+				if !isCompleteArchive(path) {
+					// Still being copied, or broken: the next write queues it again
+					opts.logger().Printf("Warning: %s is not a complete EPUB yet, waiting for changes", path)
+					delete(pending, path)
+					continue
+				}
+				delete(pending, path)
+				if db.processed(path, info) {
+					continue
+				}
+
+				convertingMutex.Lock()
+				busy := converting[path]
+				converting[path] = true
+				convertingMutex.Unlock()
+				if busy {
+					// Converted again once the running conversion ends
+					pending[path] = &pendingFile{lastEvent: now}
+					continue
+				}
+
+				outputPath, ok := outputs[path]
+				if !ok {
+					outputPath, err = directoryOutputPath(sourceDir, outputDir, path, opts)
+					if err != nil {
+						opts.logger().Printf("Error getting output path for %s: %v", path, err)
+						convertingMutex.Lock()
+						delete(converting, path)
+						convertingMutex.Unlock()
+						continue
+					}
+					outputPath = disambiguateOutputPath(outputPath, taken, opts.logger())
+					taken[strings.ToLower(outputPath)] = path
+					outputs[path] = outputPath
+				}
+
+				wg.Add(1)
+				go func(path string, outputPath string, info os.FileInfo) {
+					defer wg.Done()
+					semaphore <- struct{}{}
+					defer func() { <-semaphore }()
+					defer func() {
+						convertingMutex.Lock()
+						delete(converting, path)
+						convertingMutex.Unlock()
+					}()
+
+					err := createOutputDir(outputPath)
+					if err != nil {
+						opts.logger().Printf("Error creating output directory structure for %s: %v", path, err)
+						opts.Events.fileFailed(path, outputPath, err)
+					} else if err = processFile(path, outputPath, opts); IsSkipped(err) {
+						opts.printf("Skipped %s: %v\n", path, err)
+						err = nil
+					} else if err != nil {
+						opts.logger().Printf("Error processing file %s: %v", path, err)
+					}
+					if err == nil {
+						db.record(path, info, outputPath)
+					}
+				}(path, outputPath, info)
+			}
+		}
+	}
+}
+
+// isCompleteArchive reports whether a file opens as a ZIP archive, whose
+// central directory is only written at the end of a copy
+func isCompleteArchive(path string) bool {
+	reader, err := zip.OpenReader(longPath(path))
+	if err != nil {
+		return false
+	}
+	reader.Close()
+	return true
+}
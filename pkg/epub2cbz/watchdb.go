@@ -0,0 +1,87 @@
+package epub2cbz
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// WatchDatabaseName is the default name of the database of Watch, kept in
+// the watched directory so it follows the books when the folder is moved
+const WatchDatabaseName = ".epub2cbz-watch.json"
+
+// watchDatabase remembers the EPUBs processed by -watch with their size and
+// modification time, so a restarted watcher only converts the books added or
+// modified while it was stopped, even when their outputs were moved away
+type watchDatabase struct {
+	path  string
+	root  string // watched directory, the books are keyed relative to it
+	mutex sync.Mutex
+	files map[string]watchedFile
+	dirty bool
+}
+
+// watchedFile is a book processed by -watch
+type watchedFile struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"modTime"`
+	Output    string    `json:"output"`
+	Converted time.Time `json:"converted"`
+}
+
+// loadWatchDatabase reads the database of a watched directory, starting
+// empty when it doesn't exist yet
+func loadWatchDatabase(path string, root string) (*watchDatabase, error) {
+	db := &watchDatabase{path: path, root: root, files: make(map[string]watchedFile)}
+	content, err := os.ReadFile(longPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading watch database: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &db.files); err != nil {
+			return nil, fmt.Errorf("error decoding watch database %s: %w", path, err)
+		}
+	}
+	return db, nil
+}
+
+// key returns the name of a book in the database
+func (db *watchDatabase) key(epubPath string) string {
+	if rel, err := filepath.Rel(db.root, epubPath); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return epubPath
+}
+
+// processed reports whether a book was processed with its current content
+func (db *watchDatabase) processed(epubPath string, info os.FileInfo) bool {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	file, ok := db.files[db.key(epubPath)]
+	return ok && file.Size == info.Size() && file.ModTime.Equal(info.ModTime())
+}
+
+// record stores a processed book, written by the next save
+func (db *watchDatabase) record(epubPath string, info os.FileInfo, outputPath string) {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.files[db.key(epubPath)] = watchedFile{Size: info.Size(), ModTime: info.ModTime(), Output: outputPath, Converted: time.Now()}
+	db.dirty = true
+}
+
+// save writes the database back if it changed
+func (db *watchDatabase) save() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if !db.dirty {
+		return nil
+	}
+	if err := writeJSONFile(db.path, db.files); err != nil {
+		return fmt.Errorf("error writing watch database: %w", err)
+	}
+	db.dirty = false
+	return nil
+}
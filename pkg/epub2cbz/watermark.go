@@ -0,0 +1,131 @@
+package epub2cbz
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Watermark styles
+const (
+	WatermarkCorner   = "corner"   // small text in the bottom right corner
+	WatermarkDiagonal = "diagonal" // large faint text across the page
+)
+
+// watermarkQuality is the quality of watermarked JPEG pages, high enough for
+// the second compression not to show
+const watermarkQuality = 92
+
+// validateWatermarkStyle checks the watermark style given on the command line
+func validateWatermarkStyle(style string) error {
+	switch style {
+	case WatermarkCorner, WatermarkDiagonal:
+		return nil
+	}
+	return fmt.Errorf("invalid watermark style %q (expected %s or %s)", style, WatermarkCorner, WatermarkDiagonal)
+}
+
+// watermarkImage stamps a text on an image. JPEG images are encoded again as
+// JPEG and every other format as PNG; the MIME type of the result is returned.
+func watermarkImage(data []byte, text string, style string) ([]byte, string, error) {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("error decoding image: %w", err)
+	}
+
+	// Gray pages stay gray, other ones are drawn in RGBA
+	var dst draw.Image
+	if gray, ok := src.(*image.Gray); ok {
+		dst = gray
+	} else {
+		rgba := image.NewRGBA(src.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+		dst = rgba
+	}
+
+	mask, err := watermarkMask(dst.Bounds(), text, style)
+	if err != nil {
+		return nil, "", err
+	}
+	if style == WatermarkDiagonal {
+		draw.DrawMask(dst, dst.Bounds(), image.NewUniform(color.Gray{Y: 128}), image.Point{}, mask, image.Point{}, draw.Over)
+	} else {
+		// A dark shadow keeps the light text readable on white pages
+		shadow := dst.Bounds().Add(image.Pt(1, 1))
+		draw.DrawMask(dst, shadow, image.NewUniform(color.Black), image.Point{}, mask, image.Point{}, draw.Over)
+		draw.DrawMask(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, mask, image.Point{}, draw.Over)
+	}
+
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: watermarkQuality})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err = png.Encode(&buf, dst)
+	return buf.Bytes(), "image/png", err
+}
+
+// watermarkMask returns the coverage of the watermark text on a page
+func watermarkMask(bounds image.Rectangle, text string, style string) (*image.Alpha, error) {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, fmt.Errorf("error loading font: %w", err)
+	}
+	width, height := bounds.Dx(), bounds.Dy()
+
+	size := float64(height) / 60
+	opacity := 0.7
+	if style == WatermarkDiagonal {
+		size = float64(width) / 12
+		opacity = 0.18
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: max(size, 8), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, fmt.Errorf("error loading font: %w", err)
+	}
+	defer face.Close()
+
+	// The text is drawn on its own line, then placed on the page
+	metrics := face.Metrics()
+	textWidth := font.MeasureString(face, text).Ceil()
+	textHeight := (metrics.Ascent + metrics.Descent).Ceil()
+	line := image.NewAlpha(image.Rect(0, 0, textWidth, textHeight))
+	drawer := &font.Drawer{Dst: line, Src: image.NewUniform(color.Alpha{A: uint8(255 * opacity)}), Face: face, Dot: fixed.Point26_6{Y: metrics.Ascent}}
+	drawer.DrawString(text)
+
+	mask := image.NewAlpha(image.Rect(0, 0, width, height))
+	if style != WatermarkDiagonal {
+		margin := height / 80
+		at := image.Pt(width-textWidth-margin, height-textHeight-margin)
+		draw.Draw(mask, line.Bounds().Add(at), line, image.Point{}, draw.Src)
+		return mask, nil
+	}
+
+	// Rotate the line along the diagonal from the bottom left corner, each
+	// page pixel sampling the line pixel it comes from
+	angle := math.Atan2(float64(height), float64(width))
+	sin, cos := math.Sin(angle), math.Cos(angle)
+	cx, cy := float64(width)/2, float64(height)/2
+	lx, ly := float64(textWidth)/2, float64(textHeight)/2
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			dx, dy := float64(x)-cx, float64(y)-cy
+			sx := int(dx*cos - dy*sin + lx) // rotation by the angle, counterclockwise on screen
+			sy := int(dx*sin + dy*cos + ly)
+			if sx >= 0 && sx < textWidth && sy >= 0 && sy < textHeight {
+				mask.Pix[y*mask.Stride+x] = line.Pix[sy*line.Stride+sx]
+			}
+		}
+	}
+	return mask, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime/trace"
+	"sync"
+)
+
+// startProfiling serves the pprof endpoints on pprofAddr and records an
+// execution trace into traceFile, each when not empty. The returned function
+// stops the trace; it can safely be called several times.
+func startProfiling(pprofAddr string, traceFile string) (func(), error) {
+	if pprofAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go func() {
+			if err := http.ListenAndServe(pprofAddr, mux); err != nil {
+				log.Printf("Error serving pprof on %s: %v", pprofAddr, err)
+			}
+		}()
+		log.Printf("Serving pprof on http://%s/debug/pprof/", pprofAddr)
+	}
+
+	if traceFile == "" {
+		return func() {}, nil
+	}
+
+	f, err := os.Create(traceFile)
+	if err != nil {
+		return nil, fmt.Errorf("error creating trace file: %w", err)
+	}
+	if err := trace.Start(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error starting trace: %w", err)
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			trace.Stop()
+			if err := f.Close(); err != nil {
+				log.Printf("Error writing trace file: %v", err)
+			}
+		})
+	}, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// progressInterval is the delay between two drawings of the progress bar,
+// which keeps the elapsed time and the estimate moving
+const progressInterval = 500 * time.Millisecond
+
+// progressBar draws the state of a batch on the last line of the terminal:
+// books converted out of the total, pages written, estimated time left and
+// the books being converted. Messages are printed above it.
+type progressBar struct {
+	mutex   sync.Mutex
+	out     *os.File
+	total   int
+	done    int
+	pages   int
+	active  []string  // books being converted, in start order
+	start   time.Time // start of the batch
+	running bool      // drawn between the start of the batch and close
+	drawn   int       // width of the line drawn, blanked by the next one
+	log     io.Writer // output of the log package before the bar
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// isTerminal reports whether a file is a terminal rather than a pipe or a file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// newProgressBar returns the progress bar of a batch of books, or nil when
+// the standard output is not a terminal, so logs and schedulers get plain
+// lines. It is drawn once the batch starts.
+func newProgressBar() *progressBar {
+	if !isTerminal(os.Stdout) {
+		return nil
+	}
+	return &progressBar{out: os.Stdout, stop: make(chan struct{})}
+}
+
+// writer returns an output printing its messages above the progress bar
+func (p *progressBar) writer(out io.Writer) io.Writer {
+	if p == nil {
+		return out
+	}
+	return progressWriter{p, out}
+}
+
+// startBatch starts drawing the progress bar of a batch of books, printing
+// the log above it
+func (p *progressBar) startBatch(total int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.total, p.start, p.running = total, time.Now(), true
+	p.log = log.Writer()
+	log.SetOutput(progressWriter{p, p.log})
+	p.mutex.Unlock()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mutex.Lock()
+				p.draw()
+				p.mutex.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// progressWriter prints the messages of an output above the progress bar
+type progressWriter struct {
+	p   *progressBar
+	out io.Writer
+}
+
+func (w progressWriter) Write(data []byte) (int, error) {
+	w.p.mutex.Lock()
+	defer w.p.mutex.Unlock()
+	w.p.clear()
+	n, err := w.out.Write(data)
+	w.p.draw()
+	return n, err
+}
+
+// startFile shows a book as being converted
+func (p *progressBar) startFile(path string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.active = append(p.active, path)
+	p.draw()
+}
+
+// finishFile counts a book as done, whatever the outcome of its conversion
+func (p *progressBar) finishFile(path string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i, active := range p.active {
+		if active == path {
+			p.active = append(p.active[:i], p.active[i+1:]...)
+			break
+		}
+	}
+	p.done++
+	p.draw()
+}
+
+// addPage counts a page written to an archive
+func (p *progressBar) addPage() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	p.pages++
+	p.mutex.Unlock()
+}
+
+// close removes the progress bar, restoring the plain log
+func (p *progressBar) close() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.wg.Wait()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clear()
+	if p.running {
+		p.running = false
+		log.SetOutput(p.log)
+	}
+}
+
+// clear blanks the line of the progress bar
+func (p *progressBar) clear() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\r%s\r", strings.Repeat(" ", p.drawn))
+		p.drawn = 0
+	}
+}
+
+// draw redraws the progress bar, cut to the width of the terminal
+func (p *progressBar) draw() {
+	if !p.running {
+		return
+	}
+	eta := "--"
+	if p.done > 0 {
+		elapsed := time.Since(p.start)
+		eta = (elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)).Round(time.Second).String()
+	}
+	line := fmt.Sprintf("[%d/%d] %d%%, %d pages, ETA %s", p.done, p.total, p.done*100/max(p.total, 1), p.pages, eta)
+	if len(p.active) > 0 {
+		line += ": " + filepath.Base(p.active[0])
+		if len(p.active) > 1 {
+			line += fmt.Sprintf(" (+%d)", len(p.active)-1)
+		}
+	}
+
+	// The last column is left empty, writing it wraps some terminals
+	width := 80
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		width = columns
+	}
+	if utf8.RuneCountInString(line) >= width {
+		line = string([]rune(line)[:width-1])
+	}
+	p.clear()
+	fmt.Fprint(p.out, line)
+	p.drawn = utf8.RuneCountInString(line)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/hgourvest/epub2cbz/pkg/epub2cbz"
+)
+
+// batchSummary counts the outcomes of the books of a batch, printed once
+// the batch ends
+type batchSummary struct {
+	mutex     sync.Mutex
+	converted int
+	skipped   int
+	warnings  map[string]int // number of warnings by book, for the books with some
+}
+
+// newBatchSummary starts the summary of a batch
+func newBatchSummary() *batchSummary {
+	return &batchSummary{warnings: make(map[string]int)}
+}
+
+// fileDone counts a book processed. Failures are counted from the list of
+// failed books, which includes the books that never reached a conversion.
+func (s *batchSummary) fileDone(result epub2cbz.FileResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch result.Status {
+	case epub2cbz.StatusSkipped:
+		s.skipped++
+	case epub2cbz.StatusConverted:
+		s.converted++
+	}
+	if len(result.Warnings) > 0 {
+		s.warnings[result.Source] = len(result.Warnings)
+	}
+}
+
+// print writes the counts of the batch and the books with warnings to w,
+// then the failed books on the standard error
+func (s *batchSummary) print(w io.Writer, failed []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	fmt.Fprintf(w, "\n%d converted, %d failed, %d skipped\n", s.converted, len(failed), s.skipped)
+	if len(s.warnings) > 0 {
+		fmt.Fprintf(w, "%d file(s) with warnings:\n", len(s.warnings))
+		for _, path := range slices.Sorted(maps.Keys(s.warnings)) {
+			fmt.Fprintf(w, "  %s: %d warning(s)\n", path, s.warnings[path])
+		}
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "%d file(s) failed:\n", len(failed))
+		for _, path := range failed {
+			fmt.Fprintf(os.Stderr, "  %s\n", path)
+		}
+	}
+}